@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/R44VC0RP/ossgrok/internal/client/config"
+	"github.com/R44VC0RP/ossgrok/internal/client/inspector"
 	"github.com/R44VC0RP/ossgrok/internal/client/wsclient"
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
 )
 
@@ -30,6 +41,14 @@ func main() {
 		handleConfig()
 	case "--url":
 		handleTunnel()
+	case "http":
+		handleHTTPTunnel()
+	case "tcp":
+		handleTCPTunnel()
+	case "start":
+		handleStart()
+	case "replay":
+		handleReplay()
 	default:
 		// If first arg starts with a number, treat as port (backward compat)
 		if _, err := strconv.Atoi(os.Args[1]); err == nil {
@@ -45,21 +64,39 @@ func main() {
 func handleConfig() {
 	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
 	server := configCmd.String("server", "", "Server domain (e.g., tunnel.example.com)")
+	token := configCmd.String("token", "", "Registration token issued by the server operator")
 
 	configCmd.Parse(os.Args[2:])
 
-	if *server == "" {
-		fmt.Fprintf(os.Stderr, "Error: --server flag is required\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: ossgrok config --server DOMAIN\n")
-		fmt.Fprintf(os.Stderr, "Example: ossgrok config --server tunnel.example.com\n")
+	if *server == "" && *token == "" {
+		fmt.Fprintf(os.Stderr, "Error: --server or --token flag is required\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok config [--server DOMAIN] [--token TOKEN]\n")
+		fmt.Fprintf(os.Stderr, "Example: ossgrok config --server tunnel.example.com --token s3cr3t\n")
 		os.Exit(1)
 	}
 
-	// Save configuration
-	cfg := &config.Config{
-		Server: *server,
+	// Update the existing configuration, if any, with the given flags. A
+	// config that can't be read is left alone rather than overwritten.
+	cfg, err := config.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		cfg = &config.Config{}
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *server != "" {
+		cfg.Server = *server
+	}
+	if *token != "" {
+		cfg.Token = *token
 	}
 
+	if cfg.Server == "" {
+		fmt.Fprintf(os.Stderr, "Error: no server configured, --server flag is required\n")
+		os.Exit(1)
+	}
+
+	// Save configuration
 	if err := config.Save(cfg); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: Failed to save config: %v\n", err)
 		os.Exit(1)
@@ -69,13 +106,18 @@ func handleConfig() {
 	fmt.Printf("Configuration saved to %s\n", configPath)
 	fmt.Printf("Server: %s\n", cfg.Server)
 	fmt.Printf("WebSocket URL: %s\n", cfg.GetWebSocketURL())
+	if cfg.Token != "" {
+		fmt.Printf("Token: configured\n")
+	}
 }
 
 func handleTunnel() {
 	tunnelCmd := flag.NewFlagSet("tunnel", flag.ExitOnError)
 	url := tunnelCmd.String("url", "", "Public domain for the tunnel")
+	inspect := addInspectFlags(tunnelCmd)
+	options := addTunnelFlags(tunnelCmd)
 
-	tunnelCmd.Parse(os.Args[2:])
+	tunnelCmd.Parse(os.Args[1:])
 
 	if *url == "" {
 		fmt.Fprintf(os.Stderr, "Error: --url flag is required\n\n")
@@ -86,20 +128,230 @@ func handleTunnel() {
 
 	// Get port from remaining args
 	args := tunnelCmd.Args()
-	if len(args) != 1 {
+	if len(args) != 1 && !options.serving() {
 		fmt.Fprintf(os.Stderr, "Error: PORT argument is required\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: ossgrok --url DOMAIN PORT\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok --url DOMAIN PORT | ossgrok --url DOMAIN --dir PATH\n")
 		fmt.Fprintf(os.Stderr, "Example: ossgrok --url development.exon.dev 3000\n")
 		os.Exit(1)
 	}
 
-	port, err := strconv.Atoi(args[0])
+	startTunnel(&wsclient.Tunnel{Domain: *url}, args, inspect, options)
+}
+
+func handleHTTPTunnel() {
+	httpCmd := flag.NewFlagSet("http", flag.ExitOnError)
+	subdomain := httpCmd.String("subdomain", "", "Subdomain of the server's base domain to ask for (random if unset)")
+	inspect := addInspectFlags(httpCmd)
+	options := addTunnelFlags(httpCmd)
+
+	httpCmd.Parse(os.Args[2:])
+
+	if httpCmd.NArg() != 1 && !options.serving() {
+		fmt.Fprintf(os.Stderr, "Error: PORT argument is required\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok http [--subdomain NAME] PORT | ossgrok http [--subdomain NAME] --dir PATH\n")
+		fmt.Fprintf(os.Stderr, "Example: ossgrok http --subdomain myapp 3000\n")
+		os.Exit(1)
+	}
+
+	startTunnel(&wsclient.Tunnel{Subdomain: *subdomain}, httpCmd.Args(), inspect, options)
+}
+
+func handleTCPTunnel() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "Error: PORT argument is required\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok tcp PORT\n")
+		fmt.Fprintf(os.Stderr, "Example: ossgrok tcp 5432\n")
+		os.Exit(1)
+	}
+
+	port, err := strconv.Atoi(os.Args[2])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Invalid port number: %s\n", args[0])
+		fmt.Fprintf(os.Stderr, "Error: Invalid port number: %s\n", os.Args[2])
 		os.Exit(1)
 	}
 
-	startTunnel(*url, port)
+	cfg := loadConfig()
+	runClient(wsclient.NewTCP(cfg.GetWebSocketURL(), cfg.Token, port))
+}
+
+func handleStart() {
+	startCmd := flag.NewFlagSet("start", flag.ExitOnError)
+	all := startCmd.Bool("all", false, "Start every tunnel in the config file")
+	inspect := addInspectFlags(startCmd)
+
+	startCmd.Parse(os.Args[2:])
+
+	names := startCmd.Args()
+	if *all == (len(names) > 0) {
+		fmt.Fprintf(os.Stderr, "Error: tunnel names or --all is required\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok start NAME... | ossgrok start --all\n")
+		fmt.Fprintf(os.Stderr, "Example: ossgrok start web api\n")
+		os.Exit(1)
+	}
+
+	cfg := loadConfig()
+	if len(cfg.Tunnels) == 0 {
+		configPath, _ := config.GetConfigPath()
+		fmt.Fprintf(os.Stderr, "Error: no tunnels defined in %s\n", configPath)
+		os.Exit(1)
+	}
+
+	if *all {
+		for name := range cfg.Tunnels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	tunnels := make([]*wsclient.Tunnel, 0, len(names))
+	for _, name := range names {
+		tc, ok := cfg.Tunnels[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown tunnel: %s\n", name)
+			os.Exit(1)
+		}
+		if err := tc.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: tunnel %s: %v\n", name, err)
+			os.Exit(1)
+		}
+
+		t := &wsclient.Tunnel{
+			Name:        name,
+			Protocol:    tc.Proto,
+			Domain:      tc.Domain,
+			Subdomain:   tc.Subdomain,
+			LoadBalance: tc.LoadBalance,
+			Weight:      tc.Weight,
+			HostHeader:  tc.HostHeader,
+			BasicAuth:   tc.BasicAuth,
+			AuthToken:   tc.AuthToken,
+			OIDC:        tc.OIDC,
+			AllowIPs:    tc.AllowIPs,
+			DenyIPs:     tc.DenyIPs,
+		}
+		if tc.Proto == "tcp" {
+			t.LocalAddr, _ = tc.LocalAddr()
+		} else {
+			t.Timeout, t.PathTimeouts, _ = tc.Timeouts()
+			t.Dir, t.DirListing, t.SPA = tc.Dir, tc.Listing, tc.SPA
+			if tc.Dir == "" {
+				t.Upstream, _ = tc.Upstream()
+				t.UpstreamTLS, _ = tc.UpstreamTLS()
+			}
+		}
+		tunnels = append(tunnels, t)
+	}
+
+	client := wsclient.NewWithTunnels(cfg.GetWebSocketURL(), cfg.Token, tunnels)
+	inspect.start(client)
+	runClient(client)
+}
+
+func handleReplay() {
+	replayCmd := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := replayCmd.String("inspect-addr", inspector.DefaultAddr, "Address of the running client's request inspector")
+	method := replayCmd.String("method", "", "Replace the request method")
+	path := replayCmd.String("path", "", "Replace the request path")
+	body := replayCmd.String("body", "", "Replace the request body")
+	bodyFile := replayCmd.String("body-file", "", "Replace the request body with the contents of a file")
+	var headers headerFlags
+	replayCmd.Var(&headers, "header", "Set a request header, as 'Name: value' (repeatable, 'Name:' removes it)")
+
+	replayCmd.Parse(os.Args[2:])
+
+	if replayCmd.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: REQUEST_ID argument is required\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ossgrok replay [--method M] [--path P] [--header 'Name: value'] [--body TEXT | --body-file FILE] REQUEST_ID\n")
+		fmt.Fprintf(os.Stderr, "Example: ossgrok replay --header 'X-Debug: 1' req-4c9f3f1b941e1af6c04dadbcfbbc810e\n")
+		os.Exit(1)
+	}
+	requestID := replayCmd.Arg(0)
+
+	opts := inspector.ReplayOptions{
+		Method:  *method,
+		Path:    *path,
+		Headers: headers.values,
+	}
+	replayCmd.Visit(func(f *flag.Flag) {
+		if f.Name == "body" {
+			opts.Body = body
+		}
+	})
+	if *bodyFile != "" {
+		data, err := os.ReadFile(*bodyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		text := string(data)
+		opts.Body = &text
+	}
+
+	payload, _ := json.Marshal(&opts)
+	endpoint := fmt.Sprintf("http://%s/api/requests/%s/replay", *addr, neturl.PathEscape(requestID))
+	resp, err := http.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to reach the inspector at %s (is a client running with --inspect?): %v\n", *addr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Fprintf(os.Stderr, "Error: Replay failed: %s\n", apiErr.Error)
+		os.Exit(1)
+	}
+
+	var ex inspector.Exchange
+	if err := json.NewDecoder(resp.Body).Decode(&ex); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid response from inspector: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Replayed %s as %s: %s %s\n", requestID, ex.ID, ex.Request.Method, ex.Request.Path)
+	if ex.Response == nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", ex.Error)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d %s (%s)\n", ex.Response.StatusCode, http.StatusText(ex.Response.StatusCode), ex.Duration.Round(time.Millisecond))
+	http.Header(ex.Response.Headers).Write(os.Stdout)
+	fmt.Println()
+	os.Stdout.Write(ex.Response.Body.Data)
+	if ex.Response.Body.Truncated {
+		fmt.Printf("\n(showing the first %d of %d bytes)", len(ex.Response.Body.Data), ex.Response.Body.Size)
+	}
+	fmt.Println()
+}
+
+// headerFlags collects repeated --header flags
+type headerFlags struct {
+	values map[string][]string
+}
+
+func (h *headerFlags) String() string {
+	return ""
+}
+
+func (h *headerFlags) Set(value string) error {
+	name, val, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("expected 'Name: value', got %q", value)
+	}
+	if h.values == nil {
+		h.values = make(map[string][]string)
+	}
+
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	if val = strings.TrimSpace(val); val == "" {
+		h.values[name] = []string{}
+	} else {
+		h.values[name] = append(h.values[name], val)
+	}
+	return nil
 }
 
 func handleTunnelShorthand() {
@@ -110,17 +362,245 @@ func handleTunnelShorthand() {
 	os.Exit(1)
 }
 
-func startTunnel(domain string, port int) {
-	// Load configuration
-	cfg, err := config.Load()
-	if err != nil {
+// startTunnel serves a single tunnel to the local service named by args (a
+// port or URL) or to the directory given with --dir
+func startTunnel(t *wsclient.Tunnel, args []string, inspect *inspectFlags, options *tunnelFlags) {
+	if err := options.apply(t, args); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	cfg := loadConfig()
+
 	// Create WebSocket client
-	client := wsclient.New(cfg.GetWebSocketURL(), domain, port)
+	client := wsclient.NewWithTunnels(cfg.GetWebSocketURL(), cfg.Token, []*wsclient.Tunnel{t})
+	inspect.start(client)
+	runClient(client)
+}
+
+// tunnelFlags are the HTTP tunnel options shared by the commands that start
+// a single tunnel
+type tunnelFlags struct {
+	balance    *balanceFlags
+	timeouts   *timeoutFlags
+	hostHeader *string
+	insecure   *bool
+	ca         *string
+	dir        *string
+	listing    *bool
+	spa        *bool
+	basicAuth  *string
+	authToken  *string
+	oidc       *bool
+	oidcDomain *string
+	oidcGroup  *string
+	allowIP    *string
+	denyIP     *string
+}
+
+// addTunnelFlags adds the HTTP tunnel option flags to a command
+func addTunnelFlags(cmd *flag.FlagSet) *tunnelFlags {
+	return &tunnelFlags{
+		balance:    addBalanceFlags(cmd),
+		timeouts:   addTimeoutFlags(cmd),
+		hostHeader: cmd.String("host-header", "", "Host header for the local app: rewrite (its own address, the default), preserve (the public host) or a fixed host"),
+		insecure:   cmd.Bool("insecure", false, "Skip verifying the certificate of an https upstream"),
+		ca:         cmd.String("ca", "", "PEM file of CAs to trust for an https upstream"),
+		dir:        cmd.String("dir", "", "Serve the files in a directory instead of a local app"),
+		listing:    cmd.Bool("listing", false, "List directories without an index.html, with --dir"),
+		spa:        cmd.Bool("spa", false, "Answer requests for missing files with index.html, with --dir"),
+		basicAuth:  cmd.String("basic-auth", "", "Require HTTP Basic auth on the public URL, as user:password"),
+		authToken:  cmd.String("auth-token", "", "Require this bearer token on the public URL"),
+		oidc:       cmd.Bool("oidc", false, "Make browsers log in with the server's OIDC provider"),
+		oidcDomain: cmd.String("oidc-email-domain", "", "Only let in users with an email in these comma-separated domains (implies --oidc)"),
+		oidcGroup:  cmd.String("oidc-group", "", "Only let in users in these comma-separated groups (implies --oidc)"),
+		allowIP:    cmd.String("allow-ip", "", "Only accept requests from these comma-separated IP addresses and CIDR ranges"),
+		denyIP:     cmd.String("deny-ip", "", "Refuse requests from these comma-separated IP addresses and CIDR ranges"),
+	}
+}
+
+// serving reports whether the tunnel serves a directory rather than a local
+// service
+func (f *tunnelFlags) serving() bool {
+	return *f.dir != ""
+}
+
+// apply sets the options on a tunnel, and points it at the local service
+// named by args or at the directory to serve
+func (f *tunnelFlags) apply(t *wsclient.Tunnel, args []string) error {
+	if err := f.balance.apply(t); err != nil {
+		return err
+	}
+	if err := f.timeouts.apply(t); err != nil {
+		return err
+	}
+	if err := config.ValidateHostHeader(*f.hostHeader); err != nil {
+		return err
+	}
+	t.HostHeader = *f.hostHeader
+
+	if err := config.ValidateBasicAuth(*f.basicAuth); err != nil {
+		return err
+	}
+	t.BasicAuth, t.AuthToken = *f.basicAuth, *f.authToken
+	if *f.oidc || *f.oidcDomain != "" || *f.oidcGroup != "" {
+		t.OIDC = &protocol.OIDCPolicy{
+			EmailDomains: config.ParseList(*f.oidcDomain),
+			Groups:       config.ParseList(*f.oidcGroup),
+		}
+	}
+
+	t.AllowIPs, t.DenyIPs = config.ParseList(*f.allowIP), config.ParseList(*f.denyIP)
+	if err := config.ValidateIPs(t.AllowIPs); err != nil {
+		return err
+	}
+	if err := config.ValidateIPs(t.DenyIPs); err != nil {
+		return err
+	}
+
+	tlsConfig, err := config.UpstreamTLS(*f.insecure, *f.ca)
+	if err != nil {
+		return err
+	}
+	t.UpstreamTLS = tlsConfig
+
+	if f.serving() {
+		if len(args) > 0 {
+			return fmt.Errorf("--dir serves files itself and takes no PORT")
+		}
+		if err := config.ValidateDir(*f.dir); err != nil {
+			return err
+		}
+		t.Dir, t.DirListing, t.SPA = *f.dir, *f.listing, *f.spa
+		return nil
+	}
+	upstream, err := config.ParseUpstream(args[0])
+	if err != nil {
+		return err
+	}
+	t.Upstream = upstream
+	return nil
+}
+
+// balanceFlags are the flags for sharing a domain with other clients
+type balanceFlags struct {
+	strategy *string
+	weight   *int
+}
+
+// addBalanceFlags adds the load balancing flags to a command
+func addBalanceFlags(cmd *flag.FlagSet) *balanceFlags {
+	return &balanceFlags{
+		strategy: cmd.String("lb", "", "Share the domain with other clients: round-robin, least-pending or weighted"),
+		weight:   cmd.Int("weight", 0, "This client's share of requests with --lb weighted"),
+	}
+}
+
+// apply sets the load balancing options on a tunnel
+func (f *balanceFlags) apply(t *wsclient.Tunnel) error {
+	if err := config.ValidateLoadBalance(*f.strategy, *f.weight); err != nil {
+		return err
+	}
+	t.LoadBalance = *f.strategy
+	t.Weight = *f.weight
+	return nil
+}
+
+// timeoutFlags are the flags for how long the server waits for responses
+type timeoutFlags struct {
+	timeout *string
+	paths   pathTimeoutFlags
+}
+
+// addTimeoutFlags adds the timeout flags to a command
+func addTimeoutFlags(cmd *flag.FlagSet) *timeoutFlags {
+	f := &timeoutFlags{
+		timeout: cmd.String("timeout", "", "How long the server waits for a response, e.g. 2m (default: the server's)"),
+	}
+	cmd.Var(&f.paths, "path-timeout", "Timeout for paths under a prefix, as PREFIX=DURATION (repeatable)")
+	return f
+}
+
+// apply sets the timeouts on a tunnel
+func (f *timeoutFlags) apply(t *wsclient.Tunnel) error {
+	if *f.timeout != "" {
+		timeout, err := config.ParseTimeout(*f.timeout)
+		if err != nil {
+			return err
+		}
+		t.Timeout = timeout
+	}
+	t.PathTimeouts = f.paths.values
+	return nil
+}
+
+// pathTimeoutFlags collects repeated --path-timeout flags
+type pathTimeoutFlags struct {
+	values map[string]time.Duration
+}
+
+func (p *pathTimeoutFlags) String() string {
+	return ""
+}
+
+func (p *pathTimeoutFlags) Set(value string) error {
+	prefix, timeout, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("expected PREFIX=DURATION, got %q", value)
+	}
+	d, err := config.ParsePathTimeout(prefix, timeout)
+	if err != nil {
+		return err
+	}
+	if p.values == nil {
+		p.values = make(map[string]time.Duration)
+	}
+	p.values[prefix] = d
+	return nil
+}
+
+// inspectFlags are the request inspector flags shared by the HTTP tunnel commands
+type inspectFlags struct {
+	enabled *bool
+	addr    *string
+}
+
+// addInspectFlags adds the request inspector flags to a command
+func addInspectFlags(cmd *flag.FlagSet) *inspectFlags {
+	return &inspectFlags{
+		enabled: cmd.Bool("inspect", false, "Record requests and show them in a local web UI"),
+		addr:    cmd.String("inspect-addr", inspector.DefaultAddr, "Address for the request inspector"),
+	}
+}
+
+// start runs the request inspector for client, if it was asked for
+func (f *inspectFlags) start(client *wsclient.Client) {
+	if !*f.enabled {
+		return
+	}
+
+	insp := inspector.New(inspector.DefaultCapacity)
+	client.SetInspector(insp)
+
+	go func() {
+		if err := insp.ListenAndServe(*f.addr); err != nil {
+			logger.Error("Inspector stopped: %v", err)
+		}
+	}()
+}
+
+// loadConfig loads the client configuration or exits with an error
+func loadConfig() *config.Config {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return cfg
+}
 
+// runClient connects the client and serves the tunnel until interrupted
+func runClient(client *wsclient.Client) {
 	// Connect to server
 	if err := client.Connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: Failed to connect: %v\n", err)
@@ -156,8 +636,37 @@ func printUsage() {
 	fmt.Fprintf(os.Stderr, "ossgrok - Self-hosted tunneling service\n\n")
 	fmt.Fprintf(os.Stderr, "Usage:\n")
 	fmt.Fprintf(os.Stderr, "  ossgrok config --server DOMAIN    Configure server settings\n")
-	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN PORT         Create HTTP tunnel\n\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok config --token TOKEN      Save registration token\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN PORT         Create HTTP tunnel\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --inspect PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Create HTTP tunnel with request inspector\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok http [--subdomain NAME] PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Create HTTP tunnel on a subdomain of the server's base domain\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --lb round-robin PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Share a domain with other clients\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --timeout 2m --path-timeout /reports=10m PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Wait longer than the server's default for responses\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --host-header preserve PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Send the public host to the local app\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN [--insecure | --ca FILE] URL\n")
+	fmt.Fprintf(os.Stderr, "                                    Forward to an https, remote or unix:// upstream\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --dir PATH [--listing] [--spa]\n")
+	fmt.Fprintf(os.Stderr, "                                    Serve the files in a directory\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --basic-auth USER:PASSWORD PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Require a login on the public URL\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --oidc [--oidc-email-domain DOMAINS] [--oidc-group GROUPS] PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Make browsers log in with the server's OIDC provider\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok --url DOMAIN --allow-ip CIDRS [--deny-ip CIDRS] PORT\n")
+	fmt.Fprintf(os.Stderr, "                                    Only accept requests from some addresses\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok tcp PORT                  Create TCP tunnel\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok start NAME...             Start tunnels from the config file\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok start --all               Start every tunnel in the config file\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok replay REQUEST_ID         Replay a request recorded by the inspector\n\n")
 	fmt.Fprintf(os.Stderr, "Examples:\n")
 	fmt.Fprintf(os.Stderr, "  ossgrok config --server tunnel.example.com\n")
 	fmt.Fprintf(os.Stderr, "  ossgrok --url development.exon.dev 3000\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok http --subdomain myapp 3000\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok http --insecure https://localhost:8443\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok tcp 5432\n")
+	fmt.Fprintf(os.Stderr, "  ossgrok start web api\n")
 }
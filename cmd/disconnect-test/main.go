@@ -0,0 +1,299 @@
+// Command disconnect-test checks that requests in flight through a tunnel
+// fail as soon as the tunnel's client disconnects, rather than when they time
+// out, and that nothing is left running afterwards.
+//
+// It runs a server and a scripted tunnel client in-process, so it needs no
+// deployment:
+//
+//	go run ./cmd/disconnect-test
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/httphandler"
+	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// failFast is how quickly a request must fail once its tunnel is gone. It is
+// far below the server's 30 second response timeout.
+const failFast = 2 * time.Second
+
+// harness is an in-process server with a control endpoint for tunnel
+// clients and a public endpoint for callers
+type harness struct {
+	manager *wsmanager.Manager
+	control *httptest.Server
+	public  *httptest.Server
+	client  *http.Client
+}
+
+func main() {
+	logger.SetLevel("warn")
+
+	fmt.Println("========================================")
+	fmt.Println("ossgrok Tunnel Disconnect Test")
+	fmt.Println("========================================")
+
+	reg := registry.New()
+	m := wsmanager.New(reg, wsmanager.Options{ReconnectGrace: time.Second})
+	h := &harness{
+		manager: m,
+		control: httptest.NewServer(http.HandlerFunc(m.HandleWebSocket)),
+		public:  httptest.NewServer(httphandler.New(m, httphandler.Options{})),
+		// Idle keep-alive connections would count as leaked goroutines
+		client: &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+	}
+	defer h.control.Close()
+	defer h.public.Close()
+
+	tests := []struct {
+		name string
+		run  func(*harness) error
+	}{
+		{"Client drops before responding", testBeforeResponse},
+		{"Client drops while streaming the response body", testDuringResponseBody},
+		{"Client drops while the request body is uploading", testDuringUpload},
+	}
+
+	// Let the servers settle before counting goroutines
+	baseline := settledGoroutines(0)
+
+	passed := 0
+	for i, tc := range tests {
+		fmt.Printf("\n[%d/%d] %s...\n", i+1, len(tests)+1, tc.name)
+		if err := tc.run(h); err != nil {
+			fmt.Printf("✗ %v\n", err)
+			continue
+		}
+		passed++
+	}
+
+	fmt.Printf("\n[%d/%d] Checking for leaks...\n", len(tests)+1, len(tests)+1)
+	if n := m.PendingRequests(); n != 0 {
+		fmt.Printf("✗ %d requests are still pending\n", n)
+	} else if n := settledGoroutines(baseline); n > baseline {
+		fmt.Printf("✗ %d goroutines running, %d before the tests\n", n, baseline)
+		buf := make([]byte, 1<<20)
+		os.Stdout.Write(buf[:runtime.Stack(buf, true)])
+	} else {
+		fmt.Printf("✓ No pending requests and no leaked goroutines (%d running)\n", n)
+		passed++
+	}
+
+	fmt.Println("\n========================================")
+	fmt.Printf("Passed: %d/%d tests\n", passed, len(tests)+1)
+	fmt.Println("========================================")
+	if passed != len(tests)+1 {
+		os.Exit(1)
+	}
+}
+
+// testBeforeResponse drops the client once it has the request
+func testBeforeResponse(h *harness) error {
+	client, err := h.connect("before.test")
+	if err != nil {
+		return err
+	}
+	go func() {
+		client.await(protocol.TypeHTTPRequest)
+		client.drop()
+	}()
+
+	start := time.Now()
+	resp, err := h.do(http.MethodGet, "before.test", nil)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		return fmt.Errorf("got %d %q, want 502", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := checkFast(start); err != nil {
+		return err
+	}
+	fmt.Printf("✓ 502 %q after %s\n", strings.TrimSpace(string(body)), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// testDuringResponseBody drops the client part way through a streamed response
+func testDuringResponseBody(h *harness) error {
+	client, err := h.connect("streaming.test")
+	if err != nil {
+		return err
+	}
+	go func() {
+		msg := client.await(protocol.TypeHTTPRequest)
+		if msg == nil {
+			return
+		}
+		req, _ := protocol.DecodeHTTPRequest(msg)
+		client.send(protocol.TypeHTTPResponse, &protocol.HTTPResponseMessage{
+			RequestID:  req.RequestID,
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+			BodyStream: true,
+		})
+		client.send(protocol.TypeHTTPResponseBody, &protocol.BodyChunkMessage{
+			RequestID: req.RequestID,
+			Data:      []byte("first chunk\n"),
+		})
+		time.Sleep(100 * time.Millisecond)
+		client.drop()
+	}()
+
+	start := time.Now()
+	resp, err := h.do(http.MethodGet, "streaming.test", nil)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "first chunk\n" {
+		return fmt.Errorf("got %d %q, want 200 with the first chunk", resp.StatusCode, body)
+	}
+	if readErr == nil {
+		return fmt.Errorf("response body ended cleanly, want it cut short")
+	}
+	if err := checkFast(start); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Body cut short (%v) after %s\n", readErr, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// testDuringUpload drops the client while the caller is still sending the
+// request body
+func testDuringUpload(h *harness) error {
+	client, err := h.connect("upload.test")
+	if err != nil {
+		return err
+	}
+	go func() {
+		client.await(protocol.TypeHTTPRequestBody)
+		client.drop()
+	}()
+
+	// Send a chunk now and the rest well after the client is gone
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("part one"))
+		time.Sleep(500 * time.Millisecond)
+		pw.Write([]byte("part two"))
+		pw.Close()
+	}()
+
+	start := time.Now()
+	resp, err := h.do(http.MethodPost, "upload.test", pr)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		return fmt.Errorf("got %d %q, want 502", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := checkFast(start); err != nil {
+		return err
+	}
+	fmt.Printf("✓ 502 %q after %s\n", strings.TrimSpace(string(body)), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// checkFast fails if a request took anywhere near the response timeout
+func checkFast(start time.Time) error {
+	if elapsed := time.Since(start); elapsed > failFast {
+		return fmt.Errorf("took %s, want under %s", elapsed.Round(time.Millisecond), failFast)
+	}
+	return nil
+}
+
+// settledGoroutines waits for the goroutine count to drop to target, or
+// for it to stop changing, and returns it
+func settledGoroutines(target int) int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 50 && n > target; i++ {
+		time.Sleep(100 * time.Millisecond)
+		next := runtime.NumGoroutine()
+		if target == 0 && next == n {
+			break
+		}
+		n = next
+	}
+	return n
+}
+
+// fakeClient is a scripted tunnel client speaking the oldest version of the
+// control protocol that streams bodies, without flow control
+type fakeClient struct {
+	conn *websocket.Conn
+}
+
+// connect registers a fake client for domain
+func (h *harness) connect(domain string) (*fakeClient, error) {
+	url := "ws" + strings.TrimPrefix(h.control.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	c := &fakeClient{conn: conn}
+	c.send(protocol.TypeRegister, &protocol.RegisterMessage{Domain: domain, ProtocolVersion: protocol.ProtocolVersionBinary})
+	if c.await(protocol.TypeRegistered) == nil {
+		conn.Close()
+		return nil, fmt.Errorf("registration for %s failed", domain)
+	}
+
+	return c, nil
+}
+
+// send writes a message to the server
+func (c *fakeClient) send(msgType protocol.MessageType, data interface{}) {
+	msg, _ := protocol.EncodeMessage(msgType, data)
+	protocol.WriteFrame(c.conn, msg, false)
+}
+
+// await reads messages until one of the given type arrives, returning nil if
+// the connection fails first
+func (c *fakeClient) await(msgType protocol.MessageType) *protocol.Message {
+	for {
+		msg, err := protocol.ReadFrame(c.conn)
+		if err != nil {
+			return nil
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// drop closes the connection without a close frame, like a client that
+// crashed or lost its network
+func (c *fakeClient) drop() {
+	c.conn.NetConn().Close()
+}
+
+// do sends a public request for host through the harness server
+func (h *harness) do(method, host string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.public.URL+"/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return h.client.Do(req)
+}
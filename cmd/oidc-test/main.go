@@ -0,0 +1,606 @@
+// Command oidc-test checks that tunnels behind an OIDC login send browsers
+// to log in, let the users their policies allow through with their identity
+// in headers, and turn everyone else away.
+//
+// It runs a stand-in OIDC provider, a server, a tunnel client and a local
+// app in-process, so it needs no deployment or real provider:
+//
+//	go run ./cmd/oidc-test
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/client/wsclient"
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/httphandler"
+	"github.com/R44VC0RP/ossgrok/internal/server/oidc"
+	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+const (
+	clientID     = "ossgrok"
+	clientSecret = "provider-secret"
+
+	// redirectURL is on a host of its own, like a real deployment's login
+	// domain. Every *.test host reaches the public server.
+	redirectURL = "http://login.test/_ossgrok/oidc/callback"
+)
+
+// user is an account at the stand-in provider
+type user struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+}
+
+var users = map[string]user{
+	"alice":   {"u-alice", "alice@example.com", true, []string{"eng", "ops"}},
+	"bob":     {"u-bob", "bob@other.com", true, nil},
+	"carol":   {"u-carol", "carol@example.com", false, nil},
+	"mallory": {"u-mallory", "mallory@evil.test", true, []string{"eng"}},
+}
+
+// harness is an in-process server with an OIDC gate, a tunnel client serving
+// three tunnels and a stand-in provider
+type harness struct {
+	provider *provider
+	public   *httptest.Server
+	wsURL    string
+}
+
+func main() {
+	logger.SetLevel("error")
+
+	fmt.Println("========================================")
+	fmt.Println("ossgrok OIDC Login Test")
+	fmt.Println("========================================")
+
+	h, err := start()
+	if err != nil {
+		fmt.Printf("✗ Failed to start: %v\n", err)
+		os.Exit(1)
+	}
+
+	tests := []struct {
+		name string
+		run  func(*harness) error
+	}{
+		{"Browsers log in and reach the app with their identity", testLogin},
+		{"Callers without a session get 401 unless they have the tunnel's token", testNonBrowser},
+		{"Users outside the policies are refused", testPolicy},
+		{"Sessions only work on the tunnel they were made for", testSessionScope},
+		{"Logging out ends the session", testLogout},
+		{"Forged tokens and foreign return URLs are refused", testForgery},
+		{"Servers without OIDC refuse tunnels that ask for it", testDisabled},
+		{"The login host belongs to the gate, not to tunnels", testLoginHost},
+	}
+
+	passed := 0
+	for i, tc := range tests {
+		fmt.Printf("\n[%d/%d] %s...\n", i+1, len(tests), tc.name)
+		if err := tc.run(h); err != nil {
+			fmt.Printf("✗ %v\n", err)
+			continue
+		}
+		passed++
+	}
+
+	fmt.Println("\n========================================")
+	fmt.Printf("Passed: %d/%d tests\n", passed, len(tests))
+	fmt.Println("========================================")
+	if passed != len(tests) {
+		os.Exit(1)
+	}
+}
+
+// start runs the provider, the server, the local app and the tunnel client
+func start() (*harness, error) {
+	p, err := newProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	// The local app reports what it was sent
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s user=%s email=%s groups=%s cookie=%s authorization=%s",
+			r.URL.RequestURI(), r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Forwarded-Email"),
+			r.Header.Get("X-Forwarded-Groups"), r.Header.Get("Cookie"), r.Header.Get("Authorization"))
+	}))
+
+	m := wsmanager.New(registry.New(), wsmanager.Options{OIDC: true})
+	gate, err := oidc.New(oidc.Config{
+		Issuer:       p.server.URL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		CookieSecret: "test-secret",
+		Policy:       oidc.NewPolicy([]string{"example.com", "other.com"}, nil),
+	}, func(domain string) (*oidc.Policy, bool) {
+		auth, ok := m.TunnelAuth(domain)
+		if !ok || auth.OIDC() == nil {
+			return nil, false
+		}
+		return auth.OIDC(), true
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.ReserveHosts(gate.RedirectHost())
+
+	h := &harness{
+		provider: p,
+		public:   httptest.NewServer(httphandler.New(m, httphandler.Options{OIDC: gate})),
+	}
+	control := httptest.NewServer(http.HandlerFunc(m.HandleWebSocket))
+	h.wsURL = "ws" + strings.TrimPrefix(control.URL, "http")
+
+	local := strings.TrimPrefix(app.URL, "http://")
+	client := wsclient.NewWithTunnels(h.wsURL, "", []*wsclient.Tunnel{
+		{Domain: "app.test", LocalAddr: local, OIDC: &protocol.OIDCPolicy{}},
+		{Domain: "eng.test", LocalAddr: local, OIDC: &protocol.OIDCPolicy{Groups: []string{"eng"}}},
+		{Domain: "api.test", LocalAddr: local, AuthToken: "tok", OIDC: &protocol.OIDCPolicy{EmailDomains: []string{"example.com"}}},
+	})
+	if err := client.Connect(); err != nil {
+		return nil, fmt.Errorf("tunnel client: %w", err)
+	}
+	go client.Run()
+	return h, nil
+}
+
+// testLogin logs alice in on app.test and checks what the app sees
+func testLogin(h *harness) error {
+	b := h.browser()
+	b.setCookie("http://app.test/", "theme", "dark")
+
+	resp, body, err := b.visit("alice", "http://app.test/page?x=1")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != "http://app.test/page?x=1" {
+		return fmt.Errorf("ended at %d %s: %q", resp.StatusCode, resp.Request.URL, body)
+	}
+	for _, want := range []string{"path=/page?x=1", "user=u-alice", "email=alice@example.com", "groups=eng,ops", "cookie=theme=dark "} {
+		if !strings.Contains(body, want) {
+			return fmt.Errorf("app saw %q, missing %q", body, want)
+		}
+	}
+	fmt.Printf("✓ Logged in and redirected back; app saw %q\n", body)
+
+	// Later requests go straight through on the session
+	resp, body, err = b.visit("", "http://app.test/again")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || h.provider.logins() != 1 {
+		return fmt.Errorf("second request: %d %q after %d logins", resp.StatusCode, body, h.provider.logins())
+	}
+	fmt.Printf("✓ Next request used the session without logging in again\n")
+	return nil
+}
+
+// testNonBrowser checks API callers and spoofed identity headers
+func testNonBrowser(h *harness) error {
+	resp, body, err := h.get("app.test", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("without a session: got %d %q, want 401", resp.StatusCode, body)
+	}
+	fmt.Printf("✓ 401 without a session\n")
+
+	resp, body, err = h.get("api.test", http.Header{
+		"Authorization":     {"Bearer tok"},
+		"X-Forwarded-Email": {"ceo@example.com"},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "email= ") || !strings.HasSuffix(body, "authorization=") {
+		return fmt.Errorf("with the token: got %d %q", resp.StatusCode, body)
+	}
+	fmt.Printf("✓ Bearer token let through without logging in, spoofed identity removed\n")
+	return nil
+}
+
+// testPolicy logs in users the server's or tunnel's policy turns away
+func testPolicy(h *harness) error {
+	cases := []struct {
+		login, target, why string
+	}{
+		{"bob", "http://eng.test/", "not in the tunnel's groups"},
+		{"mallory", "http://app.test/", "email domain not allowed by the server"},
+		{"carol", "http://app.test/", "email not verified"},
+		{"alice", "http://api.test/", ""},
+	}
+	for _, tc := range cases {
+		resp, body, err := h.browser().visit(tc.login, tc.target)
+		if err != nil {
+			return err
+		}
+		if tc.why == "" {
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s on %s: got %d %q, want 200", tc.login, tc.target, resp.StatusCode, body)
+			}
+			fmt.Printf("✓ %s allowed on %s\n", tc.login, tc.target)
+			continue
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			return fmt.Errorf("%s on %s: got %d %q, want 403", tc.login, tc.target, resp.StatusCode, body)
+		}
+		fmt.Printf("✓ %s refused on %s (%s)\n", tc.login, tc.target, tc.why)
+	}
+	return nil
+}
+
+// testSessionScope replays a session from one tunnel on another
+func testSessionScope(h *harness) error {
+	b := h.browser()
+	if resp, body, err := b.visit("alice", "http://app.test/"); err != nil || resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login failed: %v %q", err, body)
+	}
+	session := b.cookie("http://app.test/", oidc.SessionCookie)
+	if session == "" {
+		return fmt.Errorf("no session cookie on app.test")
+	}
+
+	resp, body, err := h.get("eng.test", http.Header{"Cookie": {oidc.SessionCookie + "=" + session}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("app.test session on eng.test: got %d %q, want 401", resp.StatusCode, body)
+	}
+	fmt.Printf("✓ app.test's session refused on eng.test\n")
+	return nil
+}
+
+// testLogout logs in, logs out and checks the next visit must log in again
+func testLogout(h *harness) error {
+	b := h.browser()
+	if resp, body, err := b.visit("alice", "http://app.test/"); err != nil || resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login failed: %v %q", err, body)
+	}
+	if _, _, err := b.visit("", "http://app.test"+oidc.PathPrefix+"logout"); err != nil {
+		return err
+	}
+
+	b.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, body, err := b.visit("", "http://app.test/")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), "http://login.test"+oidc.PathPrefix+"login?") {
+		return fmt.Errorf("after logout: got %d %q, want a redirect to log in", resp.StatusCode, body)
+	}
+	fmt.Printf("✓ Sent to log in again after logging out\n")
+	return nil
+}
+
+// testForgery calls the gate's endpoints with made up values
+func testForgery(h *harness) error {
+	b := h.browser()
+	b.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	cases := []struct {
+		target string
+		status int
+	}{
+		{"http://login.test" + oidc.PathPrefix + "login?rd=" + url.QueryEscape("http://evil.test/"), http.StatusNotFound},
+		{"http://app.test" + oidc.PathPrefix + "session?token=forged", http.StatusBadRequest},
+		{"http://login.test/_ossgrok/oidc/callback?code=x&state=forged", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		resp, body, err := b.visit("", tc.target)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != tc.status {
+			return fmt.Errorf("%s: got %d %q, want %d", tc.target, resp.StatusCode, body, tc.status)
+		}
+		fmt.Printf("✓ %d for %s\n", resp.StatusCode, tc.target)
+	}
+
+	// A login that would return to a path naming another host stays on the
+	// tunnel's domain
+	b = h.browser()
+	resp, body, err := b.visit("alice", "http://app.test//evil.test/")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != "http://app.test/" {
+		return fmt.Errorf("login for //evil.test/ ended at %d %s: %q", resp.StatusCode, resp.Request.URL, body)
+	}
+	fmt.Printf("✓ Login for //evil.test/ returned to %s\n", resp.Request.URL)
+	return nil
+}
+
+// testDisabled registers an OIDC tunnel on a server without a gate
+func testDisabled(h *harness) error {
+	m := wsmanager.New(registry.New(), wsmanager.Options{})
+	control := httptest.NewServer(http.HandlerFunc(m.HandleWebSocket))
+	defer control.Close()
+
+	client := wsclient.NewWithTunnels("ws"+strings.TrimPrefix(control.URL, "http"), "", []*wsclient.Tunnel{
+		{Domain: "app.test", LocalAddr: "localhost:1", OIDC: &protocol.OIDCPolicy{}},
+	})
+	defer client.Close()
+	err := client.Connect()
+	if err == nil || !strings.Contains(err.Error(), protocol.ErrCodeOIDCDisabled) {
+		return fmt.Errorf("got %v, want %s", err, protocol.ErrCodeOIDCDisabled)
+	}
+	fmt.Printf("✓ %v\n", err)
+	return nil
+}
+
+// testLoginHost checks that no tunnel can register the redirect URL's host,
+// and that the gate answers every path on it
+func testLoginHost(h *harness) error {
+	client := wsclient.NewWithTunnels(h.wsURL, "", []*wsclient.Tunnel{
+		{Domain: "LOGIN.test", LocalAddr: "localhost:1"},
+	})
+	defer client.Close()
+	regErr := client.Connect()
+	if regErr == nil || !strings.Contains(regErr.Error(), protocol.ErrCodeInvalidDomain) {
+		return fmt.Errorf("registering the login host: got %v, want %s", regErr, protocol.ErrCodeInvalidDomain)
+	}
+
+	resp, body, err := h.get("login.test", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("login host: got %d %q, want 404 from the gate", resp.StatusCode, body)
+	}
+	fmt.Printf("✓ %v\n", regErr)
+	return nil
+}
+
+// get sends a request to the public server as a non-browser caller
+func (h *harness) get(host string, header http.Header) (*http.Response, string, error) {
+	req, err := http.NewRequest(http.MethodGet, h.public.URL+"/", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Host = host
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return read(http.DefaultClient.Do(req))
+}
+
+// browser follows redirects and keeps cookies. Every *.test host reaches
+// the public server.
+type browser struct {
+	h      *harness
+	client *http.Client
+}
+
+func (h *harness) browser() *browser {
+	jar, _ := cookiejar.New(nil)
+	public := h.public.Listener.Addr().String()
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(addr); strings.HasSuffix(host, ".test") {
+				addr = public
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	return &browser{h: h, client: &http.Client{Jar: jar, Transport: transport}}
+}
+
+// visit opens a page as a browser would, logging in at the provider as
+// login if asked to
+func (b *browser) visit(login, target string) (*http.Response, string, error) {
+	b.h.provider.setLogin(login)
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	return read(b.client.Do(req))
+}
+
+func (b *browser) setCookie(target, name, value string) {
+	u, _ := url.Parse(target)
+	b.client.Jar.SetCookies(u, []*http.Cookie{{Name: name, Value: value}})
+}
+
+func (b *browser) cookie(target, name string) string {
+	u, _ := url.Parse(target)
+	for _, c := range b.client.Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// read reads a response's body
+func read(resp *http.Response, err error) (*http.Response, string, error) {
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, strings.TrimSpace(string(body)), err
+}
+
+// provider is a stand-in OIDC provider. Its authorize endpoint logs in
+// whichever user the test picked, without asking.
+type provider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	login  string
+	codes  map[string]grant
+	issued int
+}
+
+// grant is an authorization code waiting to be redeemed
+type grant struct {
+	user        user
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func newProvider() (*provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &provider{key: key, codes: make(map[string]grant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	return p, nil
+}
+
+func (p *provider) setLogin(login string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.login = login
+}
+
+// logins returns how many ID tokens have been issued
+func (p *provider) logins() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.issued
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.server.URL,
+		"authorization_endpoint": p.server.URL + "/authorize",
+		"token_endpoint":         p.server.URL + "/token",
+		"jwks_uri":               p.server.URL + "/jwks",
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p.mu.Lock()
+	u, ok := users[p.login]
+	p.mu.Unlock()
+	if !ok || q.Get("client_id") != clientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("redirect_uri") != redirectURL {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = grant{user: u, nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+	p.mu.Unlock()
+
+	back, _ := url.Parse(q.Get("redirect_uri"))
+	back.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != clientID || secret != clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != g.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.sign(map[string]interface{}{
+		"iss":            p.server.URL,
+		"sub":            g.user.Subject,
+		"aud":            clientID,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+		"groups":         g.user.Groups,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.mu.Lock()
+	p.issued++
+	p.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"access_token": randomString(), "token_type": "Bearer", "id_token": idToken})
+}
+
+// sign makes an RS256 JWT
+func (p *provider) sign(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/admin"
+	"github.com/R44VC0RP/ossgrok/internal/server/auth"
+	"github.com/R44VC0RP/ossgrok/internal/server/certs"
 	"github.com/R44VC0RP/ossgrok/internal/server/httphandler"
+	"github.com/R44VC0RP/ossgrok/internal/server/metrics"
+	"github.com/R44VC0RP/ossgrok/internal/server/oidc"
 	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/tcptunnel"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
 	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
 )
@@ -31,6 +41,22 @@ func main() {
 	autocertDomains := getEnv("AUTOCERT_DOMAINS", "")
 	autocertEmail := getEnv("AUTOCERT_EMAIL", "")
 	autocertCacheDir := getEnv("AUTOCERT_CACHE_DIR", "/var/lib/autocert")
+	tcpPortRange := getEnv("TCP_PORT_RANGE", "")
+	authTokensFile := getEnv("AUTH_TOKENS_FILE", "")
+	reconnectGrace := getEnv("RECONNECT_GRACE_PERIOD", "30s")
+	requestTimeout := getEnv("REQUEST_TIMEOUT", wsmanager.DefaultRequestTimeout.String())
+	maxRequestTimeout := getEnv("MAX_REQUEST_TIMEOUT", wsmanager.DefaultMaxRequestTimeout.String())
+	minProtocolVersion := getEnv("MIN_PROTOCOL_VERSION", protocol.MinProtocolVersion)
+	trustedProxies := getEnv("TRUSTED_PROXIES", "")
+	adminAddr := getEnv("ADMIN_ADDR", "")
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	baseDomain := getEnv("BASE_DOMAIN", "")
+	wildcardCertFile := getEnv("WILDCARD_CERT_FILE", "")
+	wildcardKeyFile := getEnv("WILDCARD_KEY_FILE", "")
+	ipAllowlist := getEnv("IP_ALLOWLIST", "")
+	ipDenylist := getEnv("IP_DENYLIST", "")
+	oidcIssuer := getEnv("OIDC_ISSUER", "")
+	oidcSessionTTL := getEnv("OIDC_SESSION_TTL", oidc.DefaultSessionTTL.String())
 
 	if autocertDomains == "" {
 		logger.Fatal("AUTOCERT_DOMAINS environment variable is required")
@@ -46,18 +72,141 @@ func main() {
 	// Create tunnel registry
 	reg := registry.New()
 
+	var opts wsmanager.Options
+
+	grace, err := time.ParseDuration(reconnectGrace)
+	if err != nil {
+		logger.Fatal("Invalid RECONNECT_GRACE_PERIOD: %v", err)
+	}
+	opts.ReconnectGrace = grace
+
+	if opts.RequestTimeout, err = time.ParseDuration(requestTimeout); err != nil || opts.RequestTimeout <= 0 {
+		logger.Fatal("Invalid REQUEST_TIMEOUT: %q", requestTimeout)
+	}
+	if opts.MaxRequestTimeout, err = time.ParseDuration(maxRequestTimeout); err != nil || opts.MaxRequestTimeout < opts.RequestTimeout {
+		logger.Fatal("Invalid MAX_REQUEST_TIMEOUT: %q, must be at least REQUEST_TIMEOUT", maxRequestTimeout)
+	}
+
+	// Refuse clients older than the minimum protocol version, so they are
+	// told to upgrade instead of failing on messages they don't understand
+	version, err := protocol.ParseVersion(minProtocolVersion)
+	if err != nil || version.Less(protocol.MustParseVersion(protocol.MinProtocolVersion)) ||
+		protocol.MustParseVersion(protocol.ProtocolVersion).Less(version) {
+		logger.Fatal("Invalid MIN_PROTOCOL_VERSION: %q, must be between %s and %s",
+			minProtocolVersion, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+	}
+	opts.MinProtocolVersion = minProtocolVersion
+
+	// Create TCP tunnel server if a port range is configured
+	if tcpPortRange != "" {
+		minPort, maxPort, err := tcptunnel.ParsePortRange(tcpPortRange)
+		if err != nil {
+			logger.Fatal("Invalid TCP_PORT_RANGE: %v", err)
+		}
+		opts.TCP = tcptunnel.New(minPort, maxPort)
+		logger.Info("TCP tunnels enabled on ports %d-%d", minPort, maxPort)
+	}
+
+	// Files reloaded on SIGHUP
+	var reloaders []func() error
+
+	// Load registration tokens
+	if authTokensFile != "" {
+		tokens, err := auth.LoadFile(authTokensFile)
+		if err != nil {
+			logger.Fatal("Failed to load AUTH_TOKENS_FILE: %v", err)
+		}
+		opts.Tokens = tokens
+		reloaders = append(reloaders, tokens.Reload)
+	} else {
+		logger.Warn("AUTH_TOKENS_FILE is not set, any client can register any configured domain")
+	}
+
+	// Assign subdomains of the base domain to clients that don't pick a domain
+	if baseDomain != "" {
+		opts.BaseDomain = baseDomain
+		logger.Info("Assigning subdomains of %s", baseDomain)
+	}
+
+	// Load the wildcard certificate, if one was issued out of band
+	var wildcard *certs.Wildcard
+	if wildcardCertFile != "" || wildcardKeyFile != "" {
+		wildcard, err = certs.LoadWildcard(wildcardCertFile, wildcardKeyFile)
+		if err != nil {
+			logger.Fatal("Invalid WILDCARD_CERT_FILE or WILDCARD_KEY_FILE: %v", err)
+		}
+		reloaders = append(reloaders, wildcard.Reload)
+	}
+
+	if len(reloaders) > 0 {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				for _, reload := range reloaders {
+					if err := reload(); err != nil {
+						logger.Error("Failed to reload: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Let tunnels ask for browsers to log in with an OIDC provider
+	opts.OIDC = oidcIssuer != ""
+
 	// Create WebSocket manager
-	wsManager := wsmanager.New(reg)
+	wsManager := wsmanager.New(reg, opts)
+
+	// Create HTTP handler, trusting the forwarding headers of the load
+	// balancers in front of the server
+	var handlerOpts httphandler.Options
+	if trustedProxies != "" {
+		if handlerOpts.TrustedProxies, err = httphandler.ParseTrustedProxies(trustedProxies); err != nil {
+			logger.Fatal("Invalid TRUSTED_PROXIES: %v", err)
+		}
+		logger.Info("Trusting forwarding headers from %s", trustedProxies)
+	}
+	if handlerOpts.IPRules, err = tunnel.NewIPRules(strings.Split(ipAllowlist, ","), strings.Split(ipDenylist, ",")); err != nil {
+		logger.Fatal("Invalid IP_ALLOWLIST or IP_DENYLIST: %v", err)
+	}
+	if opts.TCP != nil {
+		opts.TCP.SetIPRules(handlerOpts.IPRules)
+	}
+	if ipAllowlist != "" {
+		logger.Info("Only accepting tunnel traffic from %s", ipAllowlist)
+	}
+	if opts.OIDC {
+		handlerOpts.OIDC = newOIDCGate(oidcIssuer, oidcSessionTTL, domains, wsManager)
+		wsManager.ReserveHosts(handlerOpts.OIDC.RedirectHost())
+	}
+	httpHandler := httphandler.New(wsManager, handlerOpts)
 
-	// Create HTTP handler
-	httpHandler := httphandler.New(wsManager)
+	// Export live state as gauges
+	metrics.NewGaugeFunc("ossgrok_active_tunnels", "HTTP tunnels currently registered.", func() float64 {
+		return float64(reg.Count())
+	})
+	metrics.NewGaugeFunc("ossgrok_pending_requests", "HTTP requests waiting on tunnel clients, including responses still streaming.", func() float64 {
+		return float64(wsManager.PendingRequests())
+	})
+	if opts.TCP != nil {
+		metrics.NewGaugeFunc("ossgrok_active_tcp_tunnels", "TCP tunnels with a public port open.", func() float64 {
+			return float64(opts.TCP.Count())
+		})
+	}
 
 	// Setup autocert manager
 	certManager := &autocert.Manager{
-		Prompt:      autocert.AcceptTOS,
-		HostPolicy:  autocert.HostWhitelist(domains...),
-		Cache:       autocert.DirCache(autocertCacheDir),
-		Email:       autocertEmail,
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy(domains, wsManager, reg),
+		Cache:      autocert.DirCache(autocertCacheDir),
+		Email:      autocertEmail,
+	}
+
+	// Serve the wildcard certificate where it applies, autocert elsewhere
+	tlsConfig := certManager.TLSConfig()
+	if wildcard != nil {
+		tlsConfig.GetCertificate = wildcard.GetCertificate(tlsConfig.GetCertificate)
 	}
 
 	// Create HTTP server for ACME challenges and redirect
@@ -70,7 +219,7 @@ func main() {
 	httpsServer := &http.Server{
 		Addr:      ":" + httpsPort,
 		Handler:   httpHandler,
-		TLSConfig: certManager.TLSConfig(),
+		TLSConfig: tlsConfig,
 	}
 
 	// Create WebSocket server for control plane
@@ -80,7 +229,24 @@ func main() {
 	wsServer := &http.Server{
 		Addr:      ":" + wsPort,
 		Handler:   wsMux,
-		TLSConfig: certManager.TLSConfig(),
+		TLSConfig: tlsConfig,
+	}
+
+	// Create admin server for metrics and the admin API, if configured
+	var adminServer *http.Server
+	if adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metrics.Handler())
+		if adminToken != "" {
+			adminMux.Handle("/api/", admin.New(wsManager, reg, adminToken))
+		} else {
+			logger.Warn("ADMIN_TOKEN is not set, the admin API is disabled")
+		}
+
+		adminServer = &http.Server{
+			Addr:    adminAddr,
+			Handler: adminMux,
+		}
 	}
 
 	// Start HTTP server (for ACME challenges)
@@ -107,15 +273,24 @@ func main() {
 		}
 	}()
 
+	// Start admin server (for metrics)
+	if adminServer != nil {
+		go func() {
+			logger.Info("Starting admin server on %s (metrics at /metrics, API at /api/)", adminAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("Admin server error: %v", err)
+			}
+		}()
+	}
+
 	logger.Info("ossgrok server is running!")
-	logger.Info("Active tunnels: 0")
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 
-	logger.Info("Shutting down gracefully...")
+	logger.Info("Shutting down gracefully with %d active tunnels...", reg.Count())
 
 	// Shutdown servers
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -133,9 +308,73 @@ func main() {
 		logger.Error("WebSocket server shutdown error: %v", err)
 	}
 
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Error("Admin server shutdown error: %v", err)
+		}
+	}
+
 	logger.Info("Server stopped")
 }
 
+// hostPolicy allows certificates for the configured domains, and for
+// assigned subdomains that have a tunnel registered. Subdomains covered by a
+// wildcard certificate never reach autocert.
+func hostPolicy(domains []string, wsManager *wsmanager.Manager, reg *registry.Registry) autocert.HostPolicy {
+	whitelist := autocert.HostWhitelist(domains...)
+	return func(ctx context.Context, host string) error {
+		if err := whitelist(ctx, host); err == nil {
+			return nil
+		}
+		if wsManager.InBaseDomain(host) {
+			if _, ok := reg.GetTunnel(host); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("acme/autocert: host %q not configured", host)
+	}
+}
+
+// newOIDCGate configures the OIDC login from the environment
+func newOIDCGate(issuer, sessionTTL string, domains []string, wsManager *wsmanager.Manager) *oidc.Gate {
+	cfg := oidc.Config{
+		Issuer:       issuer,
+		ClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  getEnv("OIDC_REDIRECT_URL", ""),
+		Scopes:       strings.Fields(getEnv("OIDC_SCOPES", "")),
+		GroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", ""),
+		CookieSecret: getEnv("OIDC_COOKIE_SECRET", ""),
+		Policy: oidc.NewPolicy(
+			strings.Split(getEnv("OIDC_ALLOWED_EMAIL_DOMAINS", ""), ","),
+			strings.Split(getEnv("OIDC_ALLOWED_GROUPS", ""), ",")),
+	}
+
+	var err error
+	if cfg.SessionTTL, err = time.ParseDuration(sessionTTL); err != nil || cfg.SessionTTL <= 0 {
+		logger.Fatal("Invalid OIDC_SESSION_TTL: %q", sessionTTL)
+	}
+	if cfg.CookieSecret == "" {
+		logger.Warn("OIDC_COOKIE_SECRET is not set, OIDC logins will not survive a restart")
+	}
+
+	gate, err := oidc.New(cfg, func(domain string) (*oidc.Policy, bool) {
+		auth, ok := wsManager.TunnelAuth(domain)
+		if !ok || auth.OIDC() == nil {
+			return nil, false
+		}
+		return auth.OIDC(), true
+	})
+	if err != nil {
+		logger.Fatal("Invalid OIDC configuration: %v", err)
+	}
+	if !slices.Contains(domains, gate.RedirectHost()) {
+		logger.Warn("OIDC_REDIRECT_URL host %s is not in AUTOCERT_DOMAINS, autocert will not issue a certificate for it", gate.RedirectHost())
+	}
+	logger.Info("OIDC login enabled with %s", issuer)
+	return gate
+}
+
 // redirectToHTTPS redirects HTTP requests to HTTPS
 func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 	target := "https://" + r.Host + r.URL.RequestURI()
@@ -3,8 +3,11 @@ module github.com/R44VC0RP/ossgrok
 go 1.25.4
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/crypto v0.45.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.45.0
+)
+
+require (
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
 )
@@ -1,15 +1,353 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
 )
 
 // Config represents the client configuration
 type Config struct {
-	Server string `json:"server"`
+	Server  string                   `json:"server"`
+	Token   string                   `json:"token,omitempty"`
+	Tunnels map[string]*TunnelConfig `json:"tunnels,omitempty"`
+}
+
+// TunnelConfig is a named tunnel started with 'ossgrok start NAME'
+type TunnelConfig struct {
+	// Proto is "http" (the default) or "tcp"
+	Proto string `json:"proto,omitempty"`
+
+	// Domain is the public domain of an HTTP tunnel. When empty, the server
+	// assigns a subdomain of its base domain.
+	Domain string `json:"domain,omitempty"`
+
+	// Subdomain asks the server for a particular subdomain instead of a
+	// random one, when Domain is empty
+	Subdomain string `json:"subdomain,omitempty"`
+
+	// LoadBalance shares the domain with other clients using the same
+	// strategy: "round-robin", "least-pending" or "weighted"
+	LoadBalance string `json:"load_balance,omitempty"`
+
+	// Weight is this client's share of requests under weighted balancing
+	Weight int `json:"weight,omitempty"`
+
+	// Timeout is how long the server waits for the local service to respond,
+	// such as "2m", instead of its default
+	Timeout string `json:"timeout,omitempty"`
+
+	// PathTimeouts overrides Timeout for requests whose path starts with a
+	// prefix, e.g. {"/reports/": "10m"}
+	PathTimeouts map[string]string `json:"path_timeouts,omitempty"`
+
+	// HostHeader is the Host header the local service sees: "rewrite" for
+	// its own address (the default), "preserve" for the public host, or a
+	// fixed host such as "myapp.test"
+	HostHeader string `json:"host_header,omitempty"`
+
+	// BasicAuth ("user:password") and AuthToken make the server require HTTP
+	// Basic auth or a bearer token on the public URL
+	BasicAuth string `json:"basic_auth,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+
+	// OIDC makes browsers log in with the server's OIDC provider, e.g.
+	// {"email_domains": ["example.com"], "groups": ["eng"]}. Empty lists let
+	// in anyone the server lets log in.
+	OIDC *protocol.OIDCPolicy `json:"oidc,omitempty"`
+
+	// AllowIPs makes the server only accept requests from these IP addresses
+	// and CIDR ranges, and DenyIPs refuses requests from these
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	DenyIPs  []string `json:"deny_ips,omitempty"`
+
+	// Addr is the local service, as a port or host:port. HTTP tunnels also
+	// take a URL: http or https on any host, or unix:///path/to.sock.
+	Addr string `json:"addr"`
+
+	// Insecure skips verifying the certificate of an https upstream, and CA
+	// is a PEM file of CAs to trust for it instead of the system's
+	Insecure bool   `json:"insecure,omitempty"`
+	CA       string `json:"ca,omitempty"`
+
+	// Dir serves the files in a directory instead of forwarding to Addr.
+	// Listing lists directories without an index.html, and SPA answers
+	// requests for missing files with the root index.html.
+	Dir     string `json:"dir,omitempty"`
+	Listing bool   `json:"listing,omitempty"`
+	SPA     bool   `json:"spa,omitempty"`
+}
+
+// LocalAddr returns the host:port of a TCP tunnel's local service
+func (t *TunnelConfig) LocalAddr() (string, error) {
+	if t.Addr == "" {
+		return "", fmt.Errorf("addr is required")
+	}
+	if _, err := strconv.Atoi(t.Addr); err == nil {
+		return "localhost:" + t.Addr, nil
+	}
+	if _, _, err := net.SplitHostPort(t.Addr); err != nil {
+		return "", fmt.Errorf("invalid addr %q: %w", t.Addr, err)
+	}
+	return t.Addr, nil
+}
+
+// Upstream returns the URL of an HTTP tunnel's local service
+func (t *TunnelConfig) Upstream() (*url.URL, error) {
+	if t.Addr == "" {
+		return nil, fmt.Errorf("addr is required")
+	}
+	return ParseUpstream(t.Addr)
+}
+
+// UpstreamTLS returns the TLS settings for an https upstream, or nil for the
+// defaults
+func (t *TunnelConfig) UpstreamTLS() (*tls.Config, error) {
+	return UpstreamTLS(t.Insecure, t.CA)
+}
+
+// Validate checks that the tunnel is complete
+func (t *TunnelConfig) Validate() error {
+	switch t.Proto {
+	case "", "http":
+		if t.Domain != "" && t.Subdomain != "" {
+			return fmt.Errorf("domain and subdomain cannot both be set")
+		}
+		if err := ValidateLoadBalance(t.LoadBalance, t.Weight); err != nil {
+			return err
+		}
+		if _, _, err := t.Timeouts(); err != nil {
+			return err
+		}
+		if err := ValidateHostHeader(t.HostHeader); err != nil {
+			return err
+		}
+		if err := ValidateBasicAuth(t.BasicAuth); err != nil {
+			return err
+		}
+		if err := ValidateIPs(t.AllowIPs); err != nil {
+			return err
+		}
+		if err := ValidateIPs(t.DenyIPs); err != nil {
+			return err
+		}
+		if t.Dir != "" {
+			if t.Addr != "" {
+				return fmt.Errorf("addr and dir cannot both be set")
+			}
+			return ValidateDir(t.Dir)
+		}
+		if _, err := t.UpstreamTLS(); err != nil {
+			return err
+		}
+		_, err := t.Upstream()
+		return err
+	case "tcp":
+		if t.Dir != "" {
+			return fmt.Errorf("dir needs an http tunnel")
+		}
+		if t.BasicAuth != "" || t.AuthToken != "" || t.OIDC != nil {
+			return fmt.Errorf("basic_auth, auth_token and oidc need an http tunnel")
+		}
+		if len(t.AllowIPs) > 0 || len(t.DenyIPs) > 0 {
+			return fmt.Errorf("allow_ips and deny_ips need an http tunnel")
+		}
+		_, err := t.LocalAddr()
+		return err
+	default:
+		return fmt.Errorf("unknown proto %q (expected http or tcp)", t.Proto)
+	}
+}
+
+// ParseUpstream parses the local service of an HTTP tunnel: a port, a
+// host:port, an http or https URL, or unix:///path/to.sock
+func ParseUpstream(addr string) (*url.URL, error) {
+	if _, err := strconv.Atoi(addr); err == nil {
+		return &url.URL{Scheme: "http", Host: "localhost:" + addr}, nil
+	}
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid addr %q: %w", addr, err)
+		}
+		return &url.URL{Scheme: "http", Host: addr}, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr %q: %w", addr, err)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("invalid addr %q (upstream URLs take no query, fragment or user)", addr)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid addr %q (missing host)", addr)
+		}
+	case "unix":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid addr %q (expected unix:///path/to.sock)", addr)
+		}
+	default:
+		return nil, fmt.Errorf("invalid addr %q (expected http, https or unix URL)", addr)
+	}
+	return u, nil
+}
+
+// UpstreamTLS builds the TLS settings for an https upstream: insecure skips
+// certificate verification, and caFile is a PEM file of CAs to trust instead
+// of the system's. It returns nil when neither is set.
+func UpstreamTLS(insecure bool, caFile string) (*tls.Config, error) {
+	if !insecure && caFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca %s", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// ParseList splits a comma-separated list, dropping blank entries
+func ParseList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// ValidateIPs checks a list of IP addresses and CIDR ranges, such as
+// "10.0.0.0/8" or "203.0.113.7"
+func ValidateIPs(list []string) error {
+	for _, entry := range list {
+		if strings.Contains(entry, "/") {
+			if _, err := netip.ParsePrefix(entry); err != nil {
+				return fmt.Errorf("invalid IP range %q", entry)
+			}
+		} else if _, err := netip.ParseAddr(entry); err != nil {
+			return fmt.Errorf("invalid IP address %q", entry)
+		}
+	}
+	return nil
+}
+
+// ValidateBasicAuth checks Basic auth credentials, given as user:password.
+// Empty means none.
+func ValidateBasicAuth(value string) error {
+	if value == "" {
+		return nil
+	}
+	user, password, ok := strings.Cut(value, ":")
+	if !ok || user == "" || password == "" {
+		return fmt.Errorf("invalid basic_auth (expected user:password)")
+	}
+	return nil
+}
+
+// ValidateDir checks that a directory to serve exists
+func ValidateDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid dir: %s is not a directory", dir)
+	}
+	return nil
+}
+
+// ValidateLoadBalance checks a load balancing strategy and weight
+func ValidateLoadBalance(strategy string, weight int) error {
+	switch strategy {
+	case "", protocol.LoadBalanceRoundRobin, protocol.LoadBalanceLeastPending, protocol.LoadBalanceWeighted:
+	default:
+		return fmt.Errorf("unknown load_balance %q (expected round-robin, least-pending or weighted)", strategy)
+	}
+	if weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if weight > 0 && strategy == "" {
+		return fmt.Errorf("a weight needs a load balancing strategy")
+	}
+	return nil
+}
+
+// ValidateHostHeader checks a Host header setting: "rewrite", "preserve" or
+// a host, with an optional port. Empty means the default.
+func ValidateHostHeader(value string) error {
+	if strings.ContainsAny(value, " \t/\\@?#") {
+		return fmt.Errorf("invalid host_header %q (expected rewrite, preserve or a host)", value)
+	}
+	return nil
+}
+
+// Timeouts parses the tunnel's timeout and path timeouts
+func (t *TunnelConfig) Timeouts() (time.Duration, map[string]time.Duration, error) {
+	var timeout time.Duration
+	if t.Timeout != "" {
+		var err error
+		if timeout, err = ParseTimeout(t.Timeout); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var paths map[string]time.Duration
+	for prefix, value := range t.PathTimeouts {
+		d, err := ParsePathTimeout(prefix, value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if paths == nil {
+			paths = make(map[string]time.Duration)
+		}
+		paths[prefix] = d
+	}
+	return timeout, paths, nil
+}
+
+// ParseTimeout parses a timeout such as "90s"
+func ParseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q (expected a duration such as 90s or 5m)", value)
+	}
+	return d, nil
+}
+
+// ParsePathTimeout parses the timeout for requests under a path prefix
+func ParsePathTimeout(prefix, value string) (time.Duration, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return 0, fmt.Errorf("invalid timeout path %q (must start with /)", prefix)
+	}
+	d, err := ParseTimeout(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", prefix, err)
+	}
+	return d, nil
 }
 
 const (
@@ -28,7 +366,8 @@ func GetConfigPath() (string, error) {
 	return filepath.Join(configDir, configFileName), nil
 }
 
-// Load loads the configuration from the config file
+// Load loads the configuration from the config file. The error matches
+// fs.ErrNotExist if there is none yet.
 func Load() (*Config, error) {
 	configPath, err := GetConfigPath()
 	if err != nil {
@@ -38,7 +377,7 @@ func Load() (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("config file not found at %s (run 'ossgrok config --server DOMAIN' first)", configPath)
+			return nil, &notFoundError{path: configPath}
 		}
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
@@ -51,6 +390,20 @@ func Load() (*Config, error) {
 	return &cfg, nil
 }
 
+// notFoundError is returned by Load when there is no config file yet. It
+// matches fs.ErrNotExist.
+type notFoundError struct {
+	path string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("config file not found at %s (run 'ossgrok config --server DOMAIN' first)", e.path)
+}
+
+func (e *notFoundError) Unwrap() error {
+	return fs.ErrNotExist
+}
+
 // Save saves the configuration to the config file
 func Save(cfg *Config) error {
 	configPath, err := GetConfigPath()
@@ -58,11 +411,19 @@ func Save(cfg *Config) error {
 		return err
 	}
 
-	// Create config directory if it doesn't exist
+	// The file holds tokens and credentials, so only the user may read it.
+	// Tighten a directory and file left readable by older versions, before
+	// writing anything new into them.
 	configDir := filepath.Dir(configPath)
-	if err := os.MkdirAll(configDir, 0755); err != nil {
+	if err := os.MkdirAll(configDir, 0700); err != nil {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
+	if err := os.Chmod(configDir, 0700); err != nil {
+		return fmt.Errorf("failed to restrict config directory permissions: %w", err)
+	}
+	if err := os.Chmod(configPath, 0600); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to restrict config file permissions: %w", err)
+	}
 
 	// Marshal config to JSON
 	data, err := json.MarshalIndent(cfg, "", "  ")
@@ -71,7 +432,7 @@ func Save(cfg *Config) error {
 	}
 
 	// Write to file
-	if err := os.WriteFile(configPath, data, 0644); err != nil {
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
@@ -0,0 +1,179 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// Options configures a Server
+type Options struct {
+	// Listing lists the contents of directories without an index.html.
+	// Without it they are not found.
+	Listing bool
+
+	// SPA answers requests for files that don't exist with the root
+	// index.html, for single-page apps that route in the browser
+	SPA bool
+}
+
+// Server answers a tunnel's HTTP requests from the files in a directory,
+// instead of proxying them to a local application. Range requests and
+// conditional requests are handled as by http.FileServer.
+type Server struct {
+	root    http.FileSystem
+	handler http.Handler
+	spa     bool
+}
+
+// New creates a file server for dir
+func New(dir string, opts Options) *Server {
+	var root http.FileSystem = http.Dir(dir)
+	if !opts.Listing {
+		root = noListing{root}
+	}
+	return &Server{
+		root:    root,
+		handler: http.FileServer(root),
+		spa:     opts.SPA,
+	}
+}
+
+// ProxyRequest answers an HTTP request from the directory, with the same
+// contract as proxy.Proxy's: the returned response body streams the file and
+// must be closed by the caller, and is nil when the response has no body.
+// The response is abandoned when ctx is canceled.
+func (s *Server) ProxyRequest(ctx context.Context, req *protocol.HTTPRequestMessage, body io.Reader) (*protocol.HTTPResponseMessage, io.ReadCloser, error) {
+	logger.Debug("Serving file: %s %s", req.Method, req.Path)
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.Path, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range req.Headers {
+		for _, value := range values {
+			httpReq.Header.Add(key, value)
+		}
+	}
+	if s.spa && s.fallback(httpReq) {
+		httpReq.URL.Path = "/"
+	}
+
+	pr, pw := io.Pipe()
+	w := &responseWriter{header: http.Header{}, body: pw, ready: make(chan struct{})}
+	go func() {
+		s.handler.ServeHTTP(w, httpReq)
+		w.commit(false)
+		pw.Close()
+	}()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		pr.CloseWithError(context.Cause(ctx))
+		return nil, nil, fmt.Errorf("request canceled: %w", context.Cause(ctx))
+	}
+
+	resp := &protocol.HTTPResponseMessage{
+		RequestID:  req.RequestID,
+		StatusCode: w.status,
+		Headers:    w.sent,
+	}
+	if !w.hasBody {
+		pr.Close()
+		return resp, nil, nil
+	}
+	resp.BodyStream = true
+	return resp, pr, nil
+}
+
+// fallback reports whether an SPA request should get the root index.html:
+// a GET or HEAD for a file that doesn't exist
+func (s *Server) fallback(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	f, err := s.root.Open(path.Clean("/" + r.URL.Path))
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	f.Close()
+	return false
+}
+
+// responseWriter passes the file server's response on through a pipe. The
+// headers are ready once the body starts, or once the handler returns
+// without one.
+type responseWriter struct {
+	header http.Header
+	body   *io.PipeWriter
+
+	once    sync.Once
+	ready   chan struct{}
+	status  int
+	sent    http.Header // the headers as they were when committed
+	hasBody bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.commit(true)
+	return w.body.Write(p)
+}
+
+// commit makes the status and headers ready, once
+func (w *responseWriter) commit(hasBody bool) {
+	w.once.Do(func() {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.sent = w.header.Clone()
+		w.hasBody = hasBody
+		close(w.ready)
+	})
+}
+
+// noListing hides directories that have no index.html
+type noListing struct {
+	http.FileSystem
+}
+
+func (n noListing) Open(name string) (http.File, error) {
+	f, err := n.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := n.FileSystem.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,259 @@
+package inspector
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+const (
+	// DefaultAddr is where the inspector UI listens by default
+	DefaultAddr = "localhost:4040"
+
+	// DefaultCapacity is how many exchanges are kept by default
+	DefaultCapacity = 100
+
+	// maxBodyCapture is how much of each request and response body is kept.
+	// Bodies are still proxied in full; only the recording is cut short.
+	maxBodyCapture = 256 << 10
+)
+
+// Body is a captured request or response body. Incomplete is set on a
+// request body the local application stopped reading before its end, whose
+// Size and Data only cover what it read.
+type Body struct {
+	Data       []byte `json:"data,omitempty"`
+	Size       int64  `json:"size"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Incomplete bool   `json:"incomplete,omitempty"`
+}
+
+// Request is the request half of a recorded exchange
+type Request struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers"`
+	Body    Body                `json:"body"`
+}
+
+// Response is the response half of a recorded exchange
+type Response struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       Body                `json:"body"`
+}
+
+// Exchange is one request proxied through a tunnel and its response
+type Exchange struct {
+	ID       string        `json:"id"`
+	Tunnel   string        `json:"tunnel,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Request  Request       `json:"request"`
+	Response *Response     `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	// ReplayOf is the ID of the exchange this one replayed, if any
+	ReplayOf string `json:"replay_of,omitempty"`
+}
+
+// Inspector records the most recent exchanges in a ring buffer
+type Inspector struct {
+	mu        sync.RWMutex
+	exchanges []*Exchange
+	next      int // index the next exchange is written to
+	count     int
+	replayer  Replayer
+}
+
+// New creates an inspector that keeps the last capacity exchanges
+func New(capacity int) *Inspector {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Inspector{
+		exchanges: make([]*Exchange, capacity),
+	}
+}
+
+// List returns the recorded exchanges, newest first
+func (i *Inspector) List() []*Exchange {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	list := make([]*Exchange, 0, i.count)
+	for n := 1; n <= i.count; n++ {
+		idx := (i.next - n + len(i.exchanges)) % len(i.exchanges)
+		list = append(list, i.exchanges[idx])
+	}
+	return list
+}
+
+// Get returns a recorded exchange by ID
+func (i *Inspector) Get(id string) (*Exchange, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for _, ex := range i.exchanges {
+		if ex != nil && ex.ID == id {
+			return ex, true
+		}
+	}
+	return nil, false
+}
+
+// add stores a finished exchange, evicting the oldest when full
+func (i *Inspector) add(ex *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.exchanges[i.next] = ex
+	i.next = (i.next + 1) % len(i.exchanges)
+	if i.count < len(i.exchanges) {
+		i.count++
+	}
+}
+
+// Capture records one exchange while it is being proxied. Exchanges become
+// visible once Finish is called.
+type Capture struct {
+	inspector *Inspector
+	exchange  *Exchange
+	reqStream bool  // the request body is streamed rather than sent whole
+	reqLength int64 // of a streamed request body, or -1 if unknown
+	reqBody   *bodyCapture
+	respBody  *bodyCapture
+}
+
+// Begin starts recording a request for a tunnel
+func (i *Inspector) Begin(tunnel string, req *protocol.HTTPRequestMessage) *Capture {
+	c := &Capture{
+		inspector: i,
+		exchange: &Exchange{
+			ID:      req.RequestID,
+			Tunnel:  tunnel,
+			Started: time.Now(),
+			Request: Request{
+				Method:  req.Method,
+				Path:    req.Path,
+				Headers: req.Headers,
+			},
+		},
+		reqStream: req.BodyStream,
+		reqLength: req.ContentLength,
+	}
+	if !req.BodyStream && len(req.Body) > 0 {
+		// The whole body is here already, whatever the local application reads
+		capture := &bodyCapture{}
+		capture.record(req.Body)
+		c.exchange.Request.Body = capture.body()
+	}
+	return c
+}
+
+// RequestBody wraps a streamed request body so what the local application
+// reads is recorded. A body sent whole is recorded by Begin instead.
+func (c *Capture) RequestBody(body io.ReadCloser) io.ReadCloser {
+	if !c.reqStream {
+		return body
+	}
+	c.reqBody = &bodyCapture{ReadCloser: body}
+	return c.reqBody
+}
+
+// Response records the response headers, and the body if it is not streamed
+func (c *Capture) Response(resp *protocol.HTTPResponseMessage) {
+	c.exchange.Response = &Response{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+	}
+	if !resp.BodyStream && len(resp.Body) > 0 {
+		capture := &bodyCapture{}
+		capture.record(resp.Body)
+		c.exchange.Response.Body = capture.body()
+	}
+}
+
+// ResponseBody wraps a streamed response body so it is recorded as it is sent
+func (c *Capture) ResponseBody(body io.ReadCloser) io.ReadCloser {
+	c.respBody = &bodyCapture{ReadCloser: body}
+	return c.respBody
+}
+
+// Finish records how the exchange ended and adds it to the inspector
+func (c *Capture) Finish(err error) *Exchange {
+	ex := c.exchange
+	ex.Duration = time.Since(ex.Started)
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	if c.reqBody != nil {
+		ex.Request.Body = c.reqBody.body()
+		ex.Request.Body.Incomplete = !c.reqBody.complete(c.reqLength)
+	}
+	if c.respBody != nil && ex.Response != nil {
+		ex.Response.Body = c.respBody.body()
+	}
+
+	c.inspector.add(ex)
+	return ex
+}
+
+// bodyCapture records the first maxBodyCapture bytes read through it
+type bodyCapture struct {
+	io.ReadCloser
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	size int64
+	eof  bool
+}
+
+func (b *bodyCapture) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.record(p[:n])
+	}
+	if err == io.EOF {
+		b.mu.Lock()
+		b.eof = true
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// complete reports whether the whole body was read, which is when the
+// reader got to its end or read all length bytes of it. A length of -1 means
+// only the end counts.
+func (b *bodyCapture) complete(length int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.eof || (length >= 0 && b.size >= length)
+}
+
+// record adds data to the capture, up to the limit
+func (b *bodyCapture) record(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size += int64(len(data))
+	if room := maxBodyCapture - b.buf.Len(); room > 0 {
+		b.buf.Write(data[:min(len(data), room)])
+	}
+}
+
+// body returns what has been captured so far
+func (b *bodyCapture) body() Body {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return Body{
+		Data:      bytes.Clone(b.buf.Bytes()),
+		Size:      b.size,
+		Truncated: b.size > int64(b.buf.Len()),
+	}
+}
@@ -0,0 +1,139 @@
+package inspector
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+var (
+	// ErrNotFound is returned when no recorded exchange has the given ID
+	ErrNotFound = errors.New("request not found")
+
+	// ErrBodyTruncated is returned when replaying a request whose body was too
+	// large to record in full, unless a replacement body is given
+	ErrBodyTruncated = errors.New("request body was too large to record, give a replacement body")
+
+	// ErrBodyIncomplete is returned when replaying a request whose body the
+	// local application did not read to the end, unless a replacement body is
+	// given
+	ErrBodyIncomplete = errors.New("request body was not read in full, give a replacement body")
+
+	// ErrReplayUnavailable is returned when the inspector has no way to send
+	// requests to the local application
+	ErrReplayUnavailable = errors.New("replay is not available")
+)
+
+// Replayer sends a request to the local application of the named tunnel
+type Replayer func(tunnel string, req *protocol.HTTPRequestMessage, body io.Reader) (*protocol.HTTPResponseMessage, io.ReadCloser, error)
+
+// ReplayOptions edits a recorded request before it is replayed. Empty fields
+// keep the recorded value.
+type ReplayOptions struct {
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	// Headers replaces the listed headers. A header with no values is removed.
+	Headers map[string][]string `json:"headers,omitempty"`
+
+	// Body replaces the request body
+	Body *string `json:"body,omitempty"`
+}
+
+// SetReplayer sets how replayed requests reach the local application
+func (i *Inspector) SetReplayer(replayer Replayer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.replayer = replayer
+}
+
+// Replay sends a recorded request to the local application again, edited by
+// opts if it is not nil. The replay is recorded as a new exchange.
+func (i *Inspector) Replay(id string, opts *ReplayOptions) (*Exchange, error) {
+	i.mu.RLock()
+	replayer := i.replayer
+	i.mu.RUnlock()
+
+	if replayer == nil {
+		return nil, ErrReplayUnavailable
+	}
+
+	original, ok := i.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+
+	req := &protocol.HTTPRequestMessage{
+		RequestID: generateReplayID(),
+		Method:    original.Request.Method,
+		Path:      original.Request.Path,
+		Headers:   http.Header(original.Request.Headers).Clone(),
+	}
+	if req.Headers == nil {
+		req.Headers = make(map[string][]string)
+	}
+	if opts.Method != "" {
+		req.Method = opts.Method
+	}
+	if opts.Path != "" {
+		req.Path = opts.Path
+	}
+	for key, values := range opts.Headers {
+		key = http.CanonicalHeaderKey(key)
+		if len(values) == 0 {
+			delete(req.Headers, key)
+		} else {
+			req.Headers[key] = values
+		}
+	}
+
+	body := original.Request.Body.Data
+	if opts.Body != nil {
+		body = []byte(*opts.Body)
+	} else if original.Request.Body.Truncated {
+		return nil, ErrBodyTruncated
+	} else if original.Request.Body.Incomplete {
+		return nil, ErrBodyIncomplete
+	}
+	if len(body) > 0 {
+		req.BodyStream = true
+		req.ContentLength = int64(len(body))
+		http.Header(req.Headers).Set("Content-Length", strconv.Itoa(len(body)))
+	} else {
+		delete(req.Headers, "Content-Length")
+	}
+
+	capture := i.Begin(original.Tunnel, req)
+	capture.exchange.ReplayOf = original.ID
+
+	resp, respBody, err := replayer(original.Tunnel, req, capture.RequestBody(io.NopCloser(bytes.NewReader(body))))
+	if err != nil {
+		return capture.Finish(err), nil
+	}
+
+	capture.Response(resp)
+	if respBody != nil {
+		respBody = capture.ResponseBody(respBody)
+		_, err = io.Copy(io.Discard, respBody)
+		respBody.Close()
+	}
+	return capture.Finish(err), nil
+}
+
+// generateReplayID generates a request ID for a replayed request
+func generateReplayID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "replay-" + hex.EncodeToString(b)
+}
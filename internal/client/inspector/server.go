@@ -0,0 +1,252 @@
+package inspector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// Handler returns the inspector's web UI and JSON API:
+//
+//	GET  /                           list of recorded exchanges
+//	GET  /requests/{id}              one exchange in detail
+//	POST /requests/{id}/replay       replay an exchange and show the result
+//	GET  /api/requests               recorded exchanges as JSON, newest first
+//	GET  /api/requests/{id}          one exchange as JSON
+//	POST /api/requests/{id}/replay   replay an exchange, edited by an optional
+//	                                 ReplayOptions body, and return the result
+//
+// The recorded exchanges hold other people's credentials, so requests must
+// name the inspector by a loopback host or the address they reached it at,
+// which a web page can't do through DNS rebinding. Replays must come from the
+// inspector's own pages or from outside a browser, so other sites can't
+// trigger them.
+func (i *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", i.serveList)
+	mux.HandleFunc("GET /requests/{id}", i.serveDetail)
+	mux.HandleFunc("POST /requests/{id}/replay", i.serveReplay)
+	mux.HandleFunc("GET /api/requests", i.serveAPIList)
+	mux.HandleFunc("GET /api/requests/{id}", i.serveAPIDetail)
+	mux.HandleFunc("POST /api/requests/{id}/replay", i.serveAPIReplay)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedHost(r) {
+			http.Error(w, "Forbidden: the inspector only answers on localhost", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && !sameOrigin(r) {
+			http.Error(w, "Forbidden: cross-origin request", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether a request names the inspector by localhost,
+// 127.0.0.1, [::1] or the local address it arrived at, on the port it
+// arrived at
+func allowedHost(r *http.Request) bool {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = strings.Trim(r.Host, "[]"), "80"
+	}
+
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localHost, localPort, err := net.SplitHostPort(local.String())
+		if err != nil || port != localPort {
+			return false
+		}
+		if host == localHost {
+			return true
+		}
+	}
+
+	switch strings.ToLower(host) {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// sameOrigin reports whether a request comes from the inspector's own pages.
+// Browsers say where a request comes from; other clients, such as the replay
+// command, send neither header.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+// ListenAndServe serves the inspector on addr until it fails
+func (i *Inspector) ListenAndServe(addr string) error {
+	logger.Info("Inspector running at http://%s", addr)
+	return http.ListenAndServe(addr, i.Handler())
+}
+
+func (i *Inspector) serveList(w http.ResponseWriter, r *http.Request) {
+	render(w, listTemplate, i.List())
+}
+
+func (i *Inspector) serveDetail(w http.ResponseWriter, r *http.Request) {
+	ex, ok := i.Get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	render(w, detailTemplate, ex)
+}
+
+func (i *Inspector) serveReplay(w http.ResponseWriter, r *http.Request) {
+	ex, err := i.Replay(r.PathValue("id"), nil)
+	if err != nil {
+		http.Error(w, err.Error(), replayErrorStatus(err))
+		return
+	}
+	http.Redirect(w, r, "/requests/"+ex.ID, http.StatusSeeOther)
+}
+
+func (i *Inspector) serveAPIList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, i.List())
+}
+
+func (i *Inspector) serveAPIDetail(w http.ResponseWriter, r *http.Request) {
+	ex, ok := i.Get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "request not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ex)
+}
+
+func (i *Inspector) serveAPIReplay(w http.ResponseWriter, r *http.Request) {
+	var opts ReplayOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid replay options: " + err.Error()})
+		return
+	}
+
+	ex, err := i.Replay(r.PathValue("id"), &opts)
+	if err != nil {
+		writeJSON(w, replayErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, ex)
+}
+
+// replayErrorStatus maps a Replay error to an HTTP status
+func replayErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBodyTruncated), errors.Is(err, ErrBodyIncomplete):
+		return http.StatusConflict
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// render executes a page template, reporting failures as a 500
+func render(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		logger.Error("Failed to render inspector page: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// prettyBody formats a captured body for display. JSON is indented, forms are
+// listed one field per line, and binary bodies are summarized.
+func prettyBody(headers map[string][]string, body Body) string {
+	if body.Size == 0 && !body.Incomplete {
+		return ""
+	}
+
+	var text string
+	mediaType, _, _ := mime.ParseMediaType(http.Header(headers).Get("Content-Type"))
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, body.Data, "", "  "); err == nil {
+			text = buf.String()
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body.Data)); err == nil {
+			text = formatForm(values)
+		}
+	}
+
+	if text == "" {
+		if !utf8.Valid(body.Data) {
+			return fmt.Sprintf("(%d bytes of binary data)", body.Size)
+		}
+		text = string(body.Data)
+	}
+
+	if body.Truncated {
+		text += fmt.Sprintf("\n\n(showing the first %d of %d bytes)", len(body.Data), body.Size)
+	}
+	if body.Incomplete {
+		text += fmt.Sprintf("\n\n(the local app stopped reading after %d bytes)", body.Size)
+	}
+	return text
+}
+
+// formatForm lists form fields as "key = value" lines, sorted by key
+func formatForm(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		for _, value := range values[key] {
+			fmt.Fprintf(&b, "%s = %s\n", key, value)
+		}
+	}
+	return b.String()
+}
+
+// sortedHeaders returns headers as sorted "Name: value" lines
+func sortedHeaders(headers map[string][]string) []string {
+	lines := make([]string, 0, len(headers))
+	for key, values := range headers {
+		for _, value := range values {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
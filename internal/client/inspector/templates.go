@@ -0,0 +1,101 @@
+package inspector
+
+import (
+	"html/template"
+	"time"
+)
+
+var templateFuncs = template.FuncMap{
+	"pretty":  prettyBody,
+	"headers": sortedHeaders,
+	"ms": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"clock": func(t time.Time) string {
+		return t.Format("15:04:05.000")
+	},
+}
+
+const pageStyle = `
+<style>
+  body { font-family: -apple-system, BlinkMacSystemFont, sans-serif; margin: 2em; color: #222; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #eee; font-size: 14px; }
+  th { color: #666; font-weight: normal; }
+  tr:hover td { background: #f8f8f8; }
+  a { color: #0366d6; text-decoration: none; }
+  pre { background: #f6f8fa; padding: 12px; overflow-x: auto; font-size: 13px; }
+  .error { color: #c00; }
+  button { font-size: 14px; padding: 4px 12px; cursor: pointer; }
+  .status-2 { color: #28a745; } .status-3 { color: #6f42c1; }
+  .status-4 { color: #d97706; } .status-5 { color: #c00; }
+</style>
+`
+
+var listTemplate = template.Must(template.New("list").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>ossgrok inspector</title>
+<meta http-equiv="refresh" content="2">
+` + pageStyle + `
+</head>
+<body>
+<h1>ossgrok inspector</h1>
+{{if not .}}
+<p>No requests yet. Requests through the tunnel will show up here.</p>
+{{else}}
+<table>
+  <tr><th>Time</th><th>Tunnel</th><th>Method</th><th>Path</th><th>Status</th><th>Duration</th><th>Size</th></tr>
+  {{range .}}
+  <tr>
+    <td>{{clock .Started}}</td>
+    <td>{{.Tunnel}}</td>
+    <td>{{.Request.Method}}</td>
+    <td><a href="/requests/{{.ID}}">{{.Request.Path}}</a></td>
+    {{if .Response}}
+    <td class="status-{{printf "%.1s" (print .Response.StatusCode)}}">{{.Response.StatusCode}}</td>
+    {{else}}
+    <td class="error">failed</td>
+    {{end}}
+    <td>{{ms .Duration}}</td>
+    <td>{{if .Response}}{{.Response.Body.Size}}{{end}}</td>
+  </tr>
+  {{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+var detailTemplate = template.Must(template.New("detail").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Request.Method}} {{.Request.Path}} - ossgrok inspector</title>
+` + pageStyle + `
+</head>
+<body>
+<p><a href="/">&larr; All requests</a></p>
+<h1>{{.Request.Method}} {{.Request.Path}}</h1>
+<p>
+  {{clock .Started}} &middot; {{ms .Duration}}
+  {{if .Tunnel}}&middot; tunnel {{.Tunnel}}{{end}}
+  &middot; <code>{{.ID}}</code>
+  {{if .ReplayOf}}&middot; replay of <a href="/requests/{{.ReplayOf}}">{{.ReplayOf}}</a>{{end}}
+</p>
+<form method="post" action="/requests/{{.ID}}/replay"><button type="submit">Replay</button></form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+
+<h2>Request</h2>
+<pre>{{range headers .Request.Headers}}{{.}}
+{{end}}</pre>
+{{with pretty .Request.Headers .Request.Body}}<pre>{{.}}</pre>{{end}}
+
+{{with .Response}}
+<h2>Response <span class="status-{{printf "%.1s" (print .StatusCode)}}">{{.StatusCode}}</span></h2>
+<pre>{{range headers .Headers}}{{.}}
+{{end}}</pre>
+{{with pretty .Headers .Body}}<pre>{{.}}</pre>{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -1,62 +1,154 @@
 package proxy
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/R44VC0RP/ossgrok/internal/protocol"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
 )
 
+// ErrTimeout is returned when the local application does not start responding
+// within the timeout the server sent with the request
+var ErrTimeout = errors.New("local application did not respond in time")
+
+// Host header modes for Options.HostHeader. Any other value is sent as the
+// Host header as it is.
+const (
+	// HostRewrite sends the local address, as if the local application were
+	// called directly. It is the default.
+	HostRewrite = "rewrite"
+
+	// HostPreserve sends the public host the caller asked for
+	HostPreserve = "preserve"
+)
+
+// Options configures a Proxy
+type Options struct {
+	// HostHeader sets the Host header the local application sees:
+	// HostRewrite, HostPreserve or a fixed host
+	HostHeader string
+
+	// TLSConfig configures the connection to an https upstream, such as the
+	// CAs to trust. Nil uses the system's.
+	TLSConfig *tls.Config
+}
+
 // Proxy handles proxying HTTP requests to a local application
 type Proxy struct {
-	localURL string
-	client   *http.Client
+	baseURL    string
+	hostHeader string
+	client     *http.Client
+	dialer     *websocket.Dialer
 }
 
-// New creates a new HTTP proxy
-func New(localURL string) *Proxy {
+// New creates a new HTTP proxy to the application at upstream: an http or
+// https URL, optionally with a base path, or unix:///path/to.sock for a Unix
+// socket
+func New(upstream *url.URL, opts Options) *Proxy {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: opts.TLSConfig,
+		// Pass bodies on as the local application encoded them, so a
+		// Content-Encoding reaches the caller and the tunnel doesn't
+		// compress them again
+		DisableCompression: true,
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  opts.TLSConfig,
+	}
+
+	baseURL := strings.TrimSuffix(upstream.String(), "/")
+	if upstream.Scheme == "unix" {
+		socket := upstream.Path
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		transport.Proxy, transport.DialContext = nil, dial
+		dialer.Proxy, dialer.NetDialContext = nil, dial
+		baseURL = "http://localhost"
+	}
+
 	return &Proxy{
-		localURL: localURL,
+		baseURL:    baseURL,
+		hostHeader: opts.HostHeader,
 		client: &http.Client{
-			Timeout: 0, // No timeout, let the server handle it
+			Timeout:   0, // Each request carries the server's timeout instead
+			Transport: transport,
 		},
+		dialer: dialer,
 	}
 }
 
-// ProxyRequest proxies an HTTP request to the local application
-func (p *Proxy) ProxyRequest(req *protocol.HTTPRequestMessage) (*protocol.HTTPResponseMessage, error) {
+// ProxyRequest proxies an HTTP request to the local application, reading the
+// request body from body. The returned response body streams straight from
+// the local application and must be closed by the caller; it is nil when the
+// response has no body.
+//
+// The request to the local application, including the response body, is
+// abandoned when ctx is canceled. If req.Timeout is set, it is also abandoned
+// with ErrTimeout when the local application has not sent the response
+// headers by the time the server gives up on it.
+func (p *Proxy) ProxyRequest(ctx context.Context, req *protocol.HTTPRequestMessage, body io.Reader) (*protocol.HTTPResponseMessage, io.ReadCloser, error) {
 	// Build target URL
-	targetURL := p.localURL + req.Path
+	targetURL := p.baseURL + req.Path
 
 	logger.Debug("Proxying request: %s %s", req.Method, targetURL)
 
+	ctx, cancel := context.WithCancelCause(ctx)
+	deadline := &deadline{timeout: time.Duration(req.Timeout) * time.Millisecond, cancel: cancel}
+	// Like the server, count the timeout from the start of the request body
+	deadline.start()
+
 	// Create HTTP request
-	httpReq, err := http.NewRequest(req.Method, targetURL, bytes.NewReader(req.Body))
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, targetURL, body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		cancel(nil)
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if req.BodyStream {
+		httpReq.ContentLength = req.ContentLength
 	}
 
 	// Copy headers
 	for key, values := range req.Headers {
+		if http.CanonicalHeaderKey(key) == "Host" {
+			continue
+		}
 		for _, value := range values {
 			httpReq.Header.Add(key, value)
 		}
 	}
+	if host := p.host(req.Host, req.Headers); host != "" {
+		httpReq.Host = host
+	}
 
 	// Execute request
 	httpResp, err := p.client.Do(httpReq)
+	deadline.stop()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
-	}
-	defer httpResp.Body.Close()
-
-	// Read response body
-	respBody, err := io.ReadAll(httpResp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		cause := context.Cause(ctx)
+		cancel(nil)
+		if errors.Is(cause, ErrTimeout) {
+			return nil, nil, fmt.Errorf("%w after %s", ErrTimeout, deadline.timeout)
+		}
+		if cause != nil {
+			return nil, nil, fmt.Errorf("request canceled: %w", cause)
+		}
+		return nil, nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 
 	// Create response message
@@ -64,10 +156,77 @@ func (p *Proxy) ProxyRequest(req *protocol.HTTPRequestMessage) (*protocol.HTTPRe
 		RequestID:  req.RequestID,
 		StatusCode: httpResp.StatusCode,
 		Headers:    httpResp.Header,
-		Body:       respBody,
 	}
 
 	logger.Debug("Request proxied successfully: %s %s -> %d", req.Method, req.Path, httpResp.StatusCode)
 
-	return resp, nil
+	if httpResp.ContentLength == 0 {
+		httpResp.Body.Close()
+		cancel(nil)
+		return resp, nil, nil
+	}
+
+	resp.BodyStream = true
+	return resp, &cancelCloser{ReadCloser: httpResp.Body, cancel: cancel}, nil
+}
+
+// host returns the Host header to send the local application for a request
+// to the public host publicHost, or "" for the local address
+func (p *Proxy) host(publicHost string, headers map[string][]string) string {
+	switch p.hostHeader {
+	case "", HostRewrite:
+		return ""
+	case HostPreserve:
+		if publicHost == "" {
+			// Servers that predate the host field still send X-Forwarded-Host
+			publicHost = http.Header(headers).Get("X-Forwarded-Host")
+		}
+		return publicHost
+	default:
+		return p.hostHeader
+	}
+}
+
+// deadline cancels a request that has had no response within timeout of
+// being started. It does nothing when timeout is zero.
+type deadline struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// start starts the timer, unless it was already started or stopped
+func (d *deadline) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timeout > 0 && d.timer == nil && !d.stopped {
+		d.timer = time.AfterFunc(d.timeout, func() { d.cancel(ErrTimeout) })
+	}
+}
+
+// stop stops the timer once the response has arrived
+func (d *deadline) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// cancelCloser releases a request's context when its response body is closed
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (c *cancelCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel(nil)
+	return err
 }
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// webSocketHandshakeHeaders are set by the dialer or the proxy itself and must
+// not be copied from the public caller's handshake
+var webSocketHandshakeHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Host":                     true,
+}
+
+// DialWebSocket opens a WebSocket to the local application for a proxied
+// upgrade. On failure the returned opened message carries the error, and the
+// local application's status code if it answered the handshake.
+func (p *Proxy) DialWebSocket(open *protocol.WebSocketOpenMessage) (*websocket.Conn, *protocol.WebSocketOpenedMessage) {
+	targetURL := "ws" + strings.TrimPrefix(p.baseURL, "http") + open.Path
+
+	logger.Debug("Dialing WebSocket: %s", targetURL)
+
+	header := http.Header{}
+	for key, values := range open.Headers {
+		if webSocketHandshakeHeaders[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	if host := p.host(open.Host, open.Headers); host != "" {
+		header.Set("Host", host)
+	}
+
+	opened := &protocol.WebSocketOpenedMessage{StreamID: open.StreamID}
+
+	conn, resp, err := p.dialer.Dial(targetURL, header)
+	if err != nil {
+		opened.Error = err.Error()
+		if resp != nil {
+			opened.StatusCode = resp.StatusCode
+			if body, readErr := io.ReadAll(io.LimitReader(resp.Body, 4096)); readErr == nil && len(body) > 0 {
+				opened.Error = string(body)
+			}
+			resp.Body.Close()
+		}
+		return nil, opened
+	}
+
+	opened.Subprotocol = conn.Subprotocol()
+	opened.Headers = resp.Header
+
+	logger.Debug("WebSocket dialed successfully: %s", targetURL)
+
+	return conn, opened
+}
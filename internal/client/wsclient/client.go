@@ -1,173 +1,929 @@
 package wsclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/R44VC0RP/ossgrok/internal/client/fileserver"
+	"github.com/R44VC0RP/ossgrok/internal/client/inspector"
 	"github.com/R44VC0RP/ossgrok/internal/client/proxy"
 	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// errUnknownTunnel is reported for traffic addressed to a tunnel the
+	// client doesn't serve
+	errUnknownTunnel = errors.New("no such tunnel on this client")
+
+	// errNoWebSockets is reported for WebSocket upgrades to a tunnel that
+	// serves files
+	errNoWebSockets = errors.New("this tunnel serves files and has no WebSocket endpoints")
+
+	// errRequestCanceled is the cause of a request nobody is waiting for the
+	// response to any more
+	errRequestCanceled = errors.New("request canceled by the server")
+)
+
+const (
+	// heartbeatInterval is how often the client pings the server
+	heartbeatInterval = 30 * time.Second
+
+	// readTimeout is how long the connection may stay silent before it is
+	// considered dead. Pongs arrive at least every heartbeatInterval.
+	readTimeout = 2*heartbeatInterval + 15*time.Second
 )
 
-// Client represents a WebSocket client for tunneling
+// dialer connects to the server like websocket.DefaultDialer, but offers
+// permessage-deflate
+var dialer = &websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
+}
+
+// Tunnel is one tunnel served by a client
+type Tunnel struct {
+	// Name identifies the tunnel in logs, e.g. its name in the config file
+	Name string
+
+	// Protocol is protocol.ProtocolHTTP or protocol.ProtocolTCP
+	Protocol string
+
+	// Domain is the public domain of an HTTP tunnel. When empty, the server
+	// assigns a subdomain of its base domain and Domain is set to it once
+	// registered.
+	Domain string
+
+	// Subdomain asks for a particular subdomain when Domain is empty
+	Subdomain string
+
+	// LoadBalance shares Domain with other clients that register it with the
+	// same strategy: protocol.LoadBalanceRoundRobin, LoadBalanceLeastPending
+	// or LoadBalanceWeighted. Weight is this client's share under weighted
+	// balancing.
+	LoadBalance string
+	Weight      int
+
+	// Timeout asks the server to wait this long for the local service to
+	// respond instead of its default. PathTimeouts override it for requests
+	// whose path starts with a given prefix. The server caps both.
+	Timeout      time.Duration
+	PathTimeouts map[string]time.Duration
+
+	// LocalAddr is the host:port of the local service
+	LocalAddr string
+
+	// Upstream is the URL of an HTTP tunnel's local service, when it is more
+	// than http://LocalAddr: https, a remote host, a base path, or a Unix
+	// socket as unix:///path/to.sock. UpstreamTLS configures https upstreams.
+	Upstream    *url.URL
+	UpstreamTLS *tls.Config
+
+	// HostHeader sets the Host header of requests to the local service:
+	// proxy.HostRewrite (the default), proxy.HostPreserve or a fixed host
+	HostHeader string
+
+	// BasicAuth ("user:password") and AuthToken ask the server to require
+	// HTTP Basic auth or a bearer token on the public URL. With both, either
+	// is accepted.
+	BasicAuth string
+	AuthToken string
+
+	// OIDC asks the server to make browsers log in with its OIDC provider,
+	// letting through the users the policy allows. Callers with BasicAuth or
+	// AuthToken credentials don't need to log in.
+	OIDC *protocol.OIDCPolicy
+
+	// AllowIPs and DenyIPs ask the server to only accept public requests
+	// from some IP addresses and CIDR ranges. Denied addresses are refused
+	// even when allowed; with no AllowIPs, every address not denied is
+	// accepted.
+	AllowIPs []string
+	DenyIPs  []string
+
+	// Dir serves the files in a directory instead of forwarding to a local
+	// service. DirListing lists directories without an index.html, and SPA
+	// answers requests for missing files with the root index.html.
+	Dir        string
+	DirListing bool
+	SPA        bool
+
+	id      string       // tunnel ID assigned by the server
+	secret  string       // resume secret for id
+	service localService // answers the tunnel's HTTP requests
+	proxy   *proxy.Proxy // the local service, unless serving Dir
+}
+
+// localService answers an HTTP tunnel's requests: a proxy.Proxy to the local
+// application, or a fileserver.Server
+type localService interface {
+	ProxyRequest(ctx context.Context, req *protocol.HTTPRequestMessage, body io.Reader) (*protocol.HTTPResponseMessage, io.ReadCloser, error)
+}
+
+// upstream returns the URL of an HTTP tunnel's local service
+func (t *Tunnel) upstream() *url.URL {
+	if t.Upstream != nil {
+		return t.Upstream
+	}
+	return &url.URL{Scheme: "http", Host: t.LocalAddr}
+}
+
+// auth returns the credentials the tunnel asks the server to require, if any
+func (t *Tunnel) auth() *protocol.TunnelAuth {
+	if t.BasicAuth == "" && t.AuthToken == "" && t.OIDC == nil {
+		return nil
+	}
+	return &protocol.TunnelAuth{Basic: t.BasicAuth, Token: t.AuthToken, OIDC: t.OIDC}
+}
+
+// ipRules returns the addresses the tunnel asks the server to accept
+// requests from, if it limits them
+func (t *Tunnel) ipRules() *protocol.IPRules {
+	if len(t.AllowIPs) == 0 && len(t.DenyIPs) == 0 {
+		return nil
+	}
+	return &protocol.IPRules{Allow: t.AllowIPs, Deny: t.DenyIPs}
+}
+
+// label names the tunnel for the inspector: its name, or else its domain
+func (t *Tunnel) label() string {
+	if t == nil {
+		return ""
+	}
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Domain
+}
+
+// pathTimeouts returns the tunnel's path timeouts as sent to the server
+func (t *Tunnel) pathTimeouts() []protocol.PathTimeout {
+	var paths []protocol.PathTimeout
+	for prefix, timeout := range t.PathTimeouts {
+		paths = append(paths, protocol.PathTimeout{Prefix: prefix, Timeout: timeout.Milliseconds()})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Prefix < paths[j].Prefix })
+	return paths
+}
+
+// Client represents a WebSocket client for tunneling. One client serves all
+// of its tunnels over a single control connection.
 type Client struct {
 	serverURL string
-	domain    string
-	proxy     *proxy.Proxy
+	token     string
+	tunnels   []*Tunnel
+	tunnelsMu sync.RWMutex // guards the tunnel IDs and removing tunnels
 	conn      *websocket.Conn
-	tunnelID  string
+	writeMu   sync.Mutex
+	binary    bool // binary framing on conn, guarded by writeMu
+	compress  bool // gzip bodies on conn, guarded by writeMu
+	flow      bool // flow control on conn, guarded by writeMu
+	closing   chan struct{}
+	closeOnce sync.Once
+	inspector *inspector.Inspector
+
+	// pending holds messages that arrived while registering, before serve
+	pending []*protocol.Message
+
+	requestBodies  sync.Map // map[requestID]*stream.Body
+	requestCancels sync.Map // map[requestID]context.CancelCauseFunc
+	webSockets     sync.Map // map[streamID]*localWebSocket
+	streams        sync.Map // map[streamID]*stream.Body
+	sendWindows    sync.Map // map[requestID or streamID]*stream.Window
 }
 
 // New creates a new WebSocket client
-func New(serverURL, domain string, localPort int) *Client {
-	localURL := fmt.Sprintf("http://localhost:%d", localPort)
+func New(serverURL, token, domain string, localPort int) *Client {
+	return NewWithTunnels(serverURL, token, []*Tunnel{{
+		Protocol:  protocol.ProtocolHTTP,
+		Domain:    domain,
+		LocalAddr: fmt.Sprintf("localhost:%d", localPort),
+	}})
+}
+
+// NewTCP creates a new WebSocket client for a TCP tunnel to a local port
+func NewTCP(serverURL, token string, localPort int) *Client {
+	return NewWithTunnels(serverURL, token, []*Tunnel{{
+		Protocol:  protocol.ProtocolTCP,
+		LocalAddr: fmt.Sprintf("localhost:%d", localPort),
+	}})
+}
+
+// NewWithTunnels creates a new WebSocket client serving several tunnels
+func NewWithTunnels(serverURL, token string, tunnels []*Tunnel) *Client {
+	for _, t := range tunnels {
+		if t.Protocol == "" {
+			t.Protocol = protocol.ProtocolHTTP
+		}
+		if t.Protocol != protocol.ProtocolHTTP {
+			continue
+		}
+		if t.Dir != "" {
+			t.service = fileserver.New(t.Dir, fileserver.Options{
+				Listing: t.DirListing,
+				SPA:     t.SPA,
+			})
+		} else {
+			t.proxy = proxy.New(t.upstream(), proxy.Options{
+				HostHeader: t.HostHeader,
+				TLSConfig:  t.UpstreamTLS,
+			})
+			t.service = t.proxy
+		}
+	}
+
 	return &Client{
 		serverURL: serverURL,
-		domain:    domain,
-		proxy:     proxy.New(localURL),
+		token:     token,
+		tunnels:   tunnels,
+		closing:   make(chan struct{}),
+	}
+}
+
+// SetInspector records the HTTP requests handled by the client in insp, and
+// lets insp replay them against the tunnels' local applications
+func (c *Client) SetInspector(insp *inspector.Inspector) {
+	c.inspector = insp
+	insp.SetReplayer(c.replay)
+}
+
+// replay sends a request recorded by the inspector to the local application
+// of the tunnel with the given label
+func (c *Client) replay(label string, req *protocol.HTTPRequestMessage, body io.Reader) (*protocol.HTTPResponseMessage, io.ReadCloser, error) {
+	c.tunnelsMu.RLock()
+	tunnels := c.tunnels
+	c.tunnelsMu.RUnlock()
+
+	for _, t := range tunnels {
+		if t.label() == label && t.service != nil {
+			return t.service.ProxyRequest(context.Background(), req, body)
+		}
 	}
+	return nil, nil, fmt.Errorf("%w: %s", errUnknownTunnel, label)
 }
 
-// Connect connects to the server and registers the tunnel
+// Connect connects to the server and registers every tunnel. After the first
+// successful registration, later calls resume the same tunnel IDs so the
+// server hands back the domains and ports it held for us.
 func (c *Client) Connect() error {
 	logger.Info("Connecting to server: %s", c.serverURL)
 
 	// Connect to WebSocket
-	conn, _, err := websocket.DefaultDialer.Dial(c.serverURL, nil)
+	conn, _, err := dialer.Dial(c.serverURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %w", err)
 	}
 
+	// Register the tunnels one at a time, so each answer is for the tunnel
+	// we just asked for. Once the server has agreed to binary framing, the
+	// rest of the connection uses it.
+	c.pending = nil
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	registered := make([]*protocol.RegisteredMessage, len(c.tunnels))
+	binary, compress, flow := false, false, false
+	for i, t := range c.tunnels {
+		registered[i], err = c.register(conn, t, binary)
+		if err == nil && protocol.BinaryFraming(registered[i].ProtocolVersion) {
+			binary = true
+		}
+		if err == nil && protocol.Compression(registered[i].ProtocolVersion) {
+			compress = true
+		}
+		if err == nil && protocol.FlowControl(registered[i].ProtocolVersion) {
+			flow = true
+		}
+		if err != nil {
+			// Close cleanly so the server releases the tunnels that did register
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteMessage(websocket.CloseMessage, closeMsg)
+			conn.Close()
+			if t.Name != "" {
+				return fmt.Errorf("tunnel %s: %w", t.Name, err)
+			}
+			return err
+		}
+	}
+
+	c.writeMu.Lock()
 	c.conn = conn
+	c.binary = binary
+	c.compress = compress
+	c.flow = flow
+	c.writeMu.Unlock()
+
+	if len(registered) > 0 && registered[0].ProtocolVersion != "" {
+		logger.Debug("Server speaks protocol %s with capabilities: %s",
+			registered[0].ProtocolVersion, strings.Join(registered[0].Capabilities, ", "))
+	} else {
+		logger.Debug("Server predates protocol negotiation, speaking protocol %s", protocol.ProtocolVersionJSON)
+	}
+
+	firstConnect := true
+	c.tunnelsMu.Lock()
+	for i, t := range c.tunnels {
+		if t.id != "" {
+			firstConnect = false
+		}
+		t.id = registered[i].TunnelID
+		t.secret = registered[i].ResumeSecret
+
+		// Keep an assigned subdomain across reconnects
+		if t.Domain == "" && t.Protocol == protocol.ProtocolHTTP && registered[i].Domain != "" {
+			t.Domain = registered[i].Domain
+		}
+	}
+	c.tunnelsMu.Unlock()
+
+	if !firstConnect {
+		for _, r := range registered {
+			logger.Info("Tunnel resumed: %s", r.ServerURL)
+		}
+		return nil
+	}
+
+	for i, t := range c.tunnels {
+		if t.Name != "" {
+			logger.Info("Tunnel %s registered successfully!", t.Name)
+		} else {
+			logger.Info("Tunnel registered successfully!")
+		}
+		logger.Info("  Tunnel ID: %s", t.id)
+		logger.Info("  Public URL: %s", registered[i].ServerURL)
+		switch {
+		case t.Protocol == protocol.ProtocolTCP:
+			logger.Info("  Forwarding to: %s", t.LocalAddr)
+		case t.Dir != "":
+			logger.Info("  Serving files from: %s", t.Dir)
+		default:
+			logger.Info("  Forwarding to: %s", t.upstream())
+		}
+	}
+	logger.Info("")
+	if len(c.tunnels) == 1 {
+		logger.Info("Tunnel is active. Press Ctrl+C to stop.")
+	} else {
+		logger.Info("%d tunnels are active. Press Ctrl+C to stop.", len(c.tunnels))
+	}
+
+	return nil
+}
 
-	// Send registration message
+// register sends the registration for one tunnel and waits for the answer.
+// Traffic for tunnels that are already registered may arrive in between; it
+// is queued for serve.
+func (c *Client) register(conn *websocket.Conn, t *Tunnel, binary bool) (*protocol.RegisteredMessage, error) {
 	registerMsg, err := protocol.EncodeMessage(protocol.TypeRegister, &protocol.RegisterMessage{
-		Domain:          c.domain,
-		ProtocolVersion: "1.0",
+		Domain:          t.Domain,
+		Subdomain:       t.Subdomain,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Protocol:        t.Protocol,
+		Token:           c.token,
+		ResumeTunnelID:  t.id,
+		ResumeSecret:    t.secret,
+		LoadBalance:     t.LoadBalance,
+		Weight:          t.Weight,
+		Timeout:         t.Timeout.Milliseconds(),
+		PathTimeouts:    t.pathTimeouts(),
+		Auth:            t.auth(),
+		IPRules:         t.ipRules(),
 	})
 	if err != nil {
-		c.conn.Close()
-		return fmt.Errorf("failed to encode register message: %w", err)
+		return nil, fmt.Errorf("failed to encode register message: %w", err)
 	}
 
-	if err := c.conn.WriteJSON(registerMsg); err != nil {
-		c.conn.Close()
-		return fmt.Errorf("failed to send register message: %w", err)
+	if err := protocol.WriteFrame(conn, registerMsg, binary); err != nil {
+		return nil, fmt.Errorf("failed to send register message: %w", err)
 	}
 
 	// Wait for registration confirmation
-	var msg protocol.Message
-	if err := c.conn.ReadJSON(&msg); err != nil {
-		c.conn.Close()
-		return fmt.Errorf("failed to read registration response: %w", err)
-	}
+	for {
+		msg, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read registration response: %w", err)
+		}
 
-	if msg.Type == protocol.TypeError {
-		errMsg, _ := protocol.DecodeError(&msg)
-		c.conn.Close()
-		return fmt.Errorf("registration failed: %s - %s", errMsg.Code, errMsg.Message)
+		switch msg.Type {
+		case protocol.TypeRegistered:
+			registered, err := protocol.DecodeRegistered(msg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode registered message: %w", err)
+			}
+			if t.auth() != nil && !slices.Contains(registered.Capabilities, protocol.CapabilityAuth) {
+				// An older server would leave the tunnel open to everyone
+				return nil, &RegistrationError{
+					Code:    protocol.ErrCodeUnsupportedProtocol,
+					Message: "the server does not support tunnel auth, upgrade the ossgrok server",
+				}
+			}
+			if t.ipRules() != nil && !slices.Contains(registered.Capabilities, protocol.CapabilityIPRules) {
+				return nil, &RegistrationError{
+					Code:    protocol.ErrCodeUnsupportedProtocol,
+					Message: "the server does not support IP rules, upgrade the ossgrok server",
+				}
+			}
+			if t.OIDC != nil && !slices.Contains(registered.Capabilities, protocol.CapabilityOIDC) {
+				return nil, &RegistrationError{
+					Code:    protocol.ErrCodeOIDCDisabled,
+					Message: "the server does not support OIDC login, upgrade the ossgrok server and configure an OIDC provider",
+				}
+			}
+			return registered, nil
+		case protocol.TypeError:
+			errMsg, _ := protocol.DecodeError(msg)
+			if errMsg.Code == protocol.ErrCodeTunnelClosed {
+				// About a tunnel registered before this one
+				c.pending = append(c.pending, msg)
+				continue
+			}
+			return nil, &RegistrationError{Code: errMsg.Code, Message: errMsg.Message}
+		case protocol.TypeHTTPRequest, protocol.TypeHTTPRequestBody,
+			protocol.TypeWebSocketOpen, protocol.TypeWebSocketFrame, protocol.TypeWebSocketClose,
+			protocol.TypeStreamOpen, protocol.TypeStreamData, protocol.TypeStreamClose:
+			c.pending = append(c.pending, msg)
+		default:
+			return nil, fmt.Errorf("unexpected message type: %s", msg.Type)
+		}
 	}
+}
 
-	if msg.Type != protocol.TypeRegistered {
-		c.conn.Close()
-		return fmt.Errorf("unexpected message type: %s", msg.Type)
+// tunnelFor returns the tunnel a server message is addressed to. Servers that
+// predate multiple tunnels per connection leave tunnelID empty.
+func (c *Client) tunnelFor(tunnelID string) *Tunnel {
+	c.tunnelsMu.RLock()
+	defer c.tunnelsMu.RUnlock()
+
+	if tunnelID == "" && len(c.tunnels) == 1 {
+		return c.tunnels[0]
+	}
+	for _, t := range c.tunnels {
+		if t.id == tunnelID {
+			return t
+		}
 	}
+	return nil
+}
 
-	registered, err := protocol.DecodeRegistered(&msg)
-	if err != nil {
-		c.conn.Close()
-		return fmt.Errorf("failed to decode registered message: %w", err)
+// removeTunnel stops serving a tunnel the server has closed, so it is not
+// registered again on reconnect. It reports whether any tunnels are left.
+func (c *Client) removeTunnel(tunnelID, reason string) bool {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	for i, t := range c.tunnels {
+		if t.id == tunnelID {
+			logger.Warn("Tunnel %s closed by server: %s", tunnelID, reason)
+			c.tunnels = slices.Delete(slices.Clone(c.tunnels), i, i+1)
+			break
+		}
 	}
+	return len(c.tunnels) > 0
+}
 
-	c.tunnelID = registered.TunnelID
+// Run starts the client event loop. When the connection drops it reconnects
+// with backoff and resumes the tunnel, returning only when the client is
+// closed, the server refuses the registration outright or the server
+// disconnects the client on purpose.
+func (c *Client) Run() error {
+	for {
+		err := c.serve()
 
-	logger.Info("Tunnel registered successfully!")
-	logger.Info("  Tunnel ID: %s", c.tunnelID)
-	logger.Info("  Public URL: %s", registered.ServerURL)
-	logger.Info("  Forwarding to: http://localhost:%s", c.proxy)
-	logger.Info("")
-	logger.Info("Tunnel is active. Press Ctrl+C to stop.")
+		// Anything in flight belonged to the old connection
+		c.closeWebSockets()
+		c.closeStreams()
+		c.closeRequestBodies()
+		c.cancelRequests()
+		c.closeSendWindows()
 
-	return nil
+		if c.isClosing() {
+			return nil
+		}
+
+		var disconnected *DisconnectedError
+		if errors.As(err, &disconnected) {
+			return err
+		}
+
+		logger.Error("Connection error: %v", err)
+		if err := c.reconnect(); err != nil {
+			return err
+		}
+		if c.isClosing() {
+			c.Close()
+			return nil
+		}
+	}
 }
 
-// Run starts the client event loop
-func (c *Client) Run() error {
+// serve handles messages on the current connection until it fails
+func (c *Client) serve() error {
+	done := make(chan struct{})
+	defer close(done)
+
 	// Start heartbeat
-	go c.heartbeat()
+	go c.heartbeat(done)
+
+	// Handle traffic that arrived while registering, then listen for messages
+	pending := c.pending
+	c.pending = nil
 
-	// Listen for messages
 	for {
 		var msg protocol.Message
-		if err := c.conn.ReadJSON(&msg); err != nil {
-			logger.Error("Connection error: %v", err)
-			return fmt.Errorf("connection closed: %w", err)
+		if len(pending) > 0 {
+			msg = *pending[0]
+			pending = pending[1:]
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+			next, err := protocol.ReadFrame(c.conn)
+			if err != nil {
+				return fmt.Errorf("connection closed: %w", err)
+			}
+			msg = *next
 		}
 
 		switch msg.Type {
 		case protocol.TypeHTTPRequest:
-			go c.handleHTTPRequest(&msg)
+			c.dispatchHTTPRequest(&msg)
+		case protocol.TypeHTTPRequestBody:
+			c.handleRequestBody(&msg)
+		case protocol.TypeCancel:
+			c.handleCancel(&msg)
+		case protocol.TypeWebSocketOpen:
+			go c.handleWebSocketOpen(&msg)
+		case protocol.TypeWebSocketFrame:
+			c.handleWebSocketFrame(&msg)
+		case protocol.TypeWebSocketClose:
+			c.handleWebSocketClose(&msg)
+		case protocol.TypeStreamOpen:
+			c.handleStreamOpen(&msg)
+		case protocol.TypeStreamData:
+			c.handleStreamData(&msg)
+		case protocol.TypeStreamClose:
+			c.handleStreamClose(&msg)
+		case protocol.TypeWindowUpdate:
+			c.handleWindowUpdate(&msg)
 		case protocol.TypePong:
 			// Heartbeat response, ignore
+		case protocol.TypeError:
+			errMsg, err := protocol.DecodeError(&msg)
+			if err != nil {
+				logger.Error("Failed to decode error message: %v", err)
+				continue
+			}
+			if errMsg.Code == protocol.ErrCodeDisconnected {
+				return &DisconnectedError{Message: errMsg.Message}
+			}
+			if errMsg.Code == protocol.ErrCodeTunnelClosed {
+				if !c.removeTunnel(errMsg.TunnelID, errMsg.Message) {
+					return &DisconnectedError{Message: errMsg.Message}
+				}
+				continue
+			}
+			logger.Warn("Server error: %s - %s", errMsg.Code, errMsg.Message)
 		default:
 			logger.Warn("Unknown message type: %s", msg.Type)
 		}
 	}
 }
 
-// handleHTTPRequest handles an incoming HTTP request from the server
-func (c *Client) handleHTTPRequest(msg *protocol.Message) {
+// dispatchHTTPRequest decodes an HTTP request and hands it off to be proxied.
+// Streamed request bodies and the means to cancel the request are registered
+// here, before any later message about the request can arrive.
+func (c *Client) dispatchHTTPRequest(msg *protocol.Message) {
 	req, err := protocol.DecodeHTTPRequest(msg)
 	if err != nil {
 		logger.Error("Failed to decode HTTP request: %v", err)
 		return
 	}
 
+	var body io.ReadCloser = io.NopCloser(bytes.NewReader(req.Body))
+	if req.BodyStream {
+		streamed := c.newBody(req.RequestID)
+		c.requestBodies.Store(req.RequestID, streamed)
+		body = streamed
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	c.requestCancels.Store(req.RequestID, cancel)
+
+	go c.handleHTTPRequest(ctx, c.tunnelFor(req.TunnelID), req, body)
+}
+
+// handleCancel abandons a request the server is no longer waiting on
+func (c *Client) handleCancel(msg *protocol.Message) {
+	cancelMsg, err := protocol.DecodeCancel(msg)
+	if err != nil {
+		logger.Error("Failed to decode cancel message: %v", err)
+		return
+	}
+
+	value, ok := c.requestCancels.LoadAndDelete(cancelMsg.RequestID)
+	if !ok {
+		logger.Debug("Ignoring cancel for unknown request ID: %s", cancelMsg.RequestID)
+		return
+	}
+
+	logger.Debug("Request %s canceled by the server: %s", cancelMsg.RequestID, cancelMsg.Reason)
+	cause := fmt.Errorf("%w: %s", errRequestCanceled, cancelMsg.Reason)
+	value.(context.CancelCauseFunc)(cause)
+	if body, ok := c.requestBodies.LoadAndDelete(cancelMsg.RequestID); ok {
+		body.(*stream.Body).Finish(cause)
+	}
+	if window, ok := c.sendWindows.LoadAndDelete(cancelMsg.RequestID); ok {
+		window.(*stream.Window).Close()
+	}
+}
+
+// handleWindowUpdate gives the server's credit to the stream it is for
+func (c *Client) handleWindowUpdate(msg *protocol.Message) {
+	update, err := protocol.DecodeWindowUpdate(msg)
+	if err != nil {
+		logger.Error("Failed to decode window update: %v", err)
+		return
+	}
+
+	if value, ok := c.sendWindows.Load(update.StreamID); ok {
+		value.(*stream.Window).Grant(update.Chunks)
+	}
+}
+
+// handleRequestBody handles a chunk of a streamed request body. The server
+// waits for credit while the local application is slower than the tunnel; a
+// server that outruns the buffer anyway has the body cut short rather than
+// stall the tunnel.
+func (c *Client) handleRequestBody(msg *protocol.Message) {
+	chunk, err := protocol.DecodeBodyChunk(msg)
+	if err != nil {
+		logger.Error("Failed to decode request body chunk: %v", err)
+		return
+	}
+
+	value, ok := c.requestBodies.Load(chunk.RequestID)
+	if !ok {
+		logger.Debug("Dropping request body chunk for unknown request ID: %s", chunk.RequestID)
+		return
+	}
+	body := value.(*stream.Body)
+
+	if len(chunk.Data) > 0 {
+		err := body.Push(chunk.Data)
+		if errors.Is(err, stream.ErrFull) {
+			logger.Warn("Resetting request body for request %s: the local application is too slow", chunk.RequestID)
+			body.Finish(fmt.Errorf("request body reset: %w", err))
+		}
+		if err != nil {
+			// The local application stopped reading, drop the rest of the body
+			c.requestBodies.Delete(chunk.RequestID)
+			return
+		}
+	}
+
+	if chunk.EOF {
+		if chunk.Error != "" {
+			body.Finish(fmt.Errorf("request body aborted: %s", chunk.Error))
+		} else {
+			body.Finish(nil)
+		}
+		c.requestBodies.Delete(chunk.RequestID)
+	}
+}
+
+// handleHTTPRequest handles an incoming HTTP request from the server for
+// tunnel t, which is nil if the server named a tunnel we don't have. The
+// request is abandoned when ctx is canceled.
+func (c *Client) handleHTTPRequest(ctx context.Context, t *Tunnel, req *protocol.HTTPRequestMessage, body io.ReadCloser) {
+	defer func() {
+		body.Close()
+		c.requestBodies.Delete(req.RequestID)
+		if cancel, ok := c.requestCancels.LoadAndDelete(req.RequestID); ok {
+			cancel.(context.CancelCauseFunc)(nil)
+		}
+	}()
+
 	logger.Debug("Received request: %s %s", req.Method, req.Path)
 
+	// Record the exchange for the inspector, if it is running
+	var capture *inspector.Capture
+	if c.inspector != nil {
+		capture = c.inspector.Begin(t.label(), req)
+		body = capture.RequestBody(body)
+	}
+
 	// Proxy request to local application
-	resp, err := c.proxy.ProxyRequest(req)
-	if err != nil {
-		logger.Error("Failed to proxy request: %v", err)
+	var resp *protocol.HTTPResponseMessage
+	var respBody io.ReadCloser
+	proxyErr := errUnknownTunnel
+	if t != nil && t.service != nil {
+		resp, respBody, proxyErr = t.service.ProxyRequest(ctx, req, body)
+	}
+
+	// Nobody is waiting for the response if the server canceled the request
+	// or, after a timeout, has already answered the caller itself
+	abandoned := context.Cause(ctx)
+	if errors.Is(proxyErr, proxy.ErrTimeout) {
+		abandoned = proxyErr
+	}
+	if errors.Is(abandoned, errRequestCanceled) || errors.Is(abandoned, proxy.ErrTimeout) {
+		logger.Info("Abandoned request %s %s: %v", req.Method, req.Path, abandoned)
+		if respBody != nil {
+			respBody.Close()
+		}
+		if capture != nil {
+			capture.Finish(abandoned)
+		}
+		return
+	}
+	if proxyErr != nil {
+		logger.Error("Failed to proxy request: %v", proxyErr)
 
 		// Send error response
 		resp = &protocol.HTTPResponseMessage{
 			RequestID:  req.RequestID,
 			StatusCode: 502,
 			Headers:    make(map[string][]string),
-			Body:       []byte("Bad Gateway: " + err.Error()),
+			Body:       []byte("Bad Gateway: " + proxyErr.Error()),
+		}
+	}
+	if capture != nil {
+		capture.Response(resp)
+		if respBody != nil {
+			respBody = capture.ResponseBody(respBody)
 		}
 	}
 
-	// Send response back to server
-	respMsg, err := protocol.EncodeMessage(protocol.TypeHTTPResponse, resp)
-	if err != nil {
-		logger.Error("Failed to encode response: %v", err)
-		return
+	err := c.sendHTTPResponse(ctx, req.RequestID, resp, respBody)
+	if capture != nil {
+		if err == nil {
+			err = proxyErr
+		}
+		capture.Finish(err)
 	}
+}
 
-	if err := c.conn.WriteJSON(respMsg); err != nil {
+// sendHTTPResponse sends the response headers back to the server, then
+// streams the response body, if any, until ctx is canceled
+func (c *Client) sendHTTPResponse(ctx context.Context, requestID string, resp *protocol.HTTPResponseMessage, respBody io.ReadCloser) error {
+	if respBody != nil {
+		defer respBody.Close()
+	}
+
+	if err := c.send(protocol.TypeHTTPResponse, resp); err != nil {
 		logger.Error("Failed to send response: %v", err)
+		return err
 	}
+
+	if respBody != nil {
+		// Gzip the body on its way through the tunnel if the server can take
+		// it and the body isn't compressed already
+		c.writeMu.Lock()
+		compress := c.compress
+		c.writeMu.Unlock()
+		precompressed := !protocol.Compressible(resp.Headers)
+		window := c.newWindow(requestID)
+		defer c.closeWindow(requestID, window)
+
+		if _, err := stream.Copy(requestID, respBody, func(chunk *protocol.BodyChunkMessage) error {
+			if len(chunk.Data) > 0 {
+				if err := window.Acquire(); err != nil {
+					return err
+				}
+			}
+			chunk.Precompressed = precompressed
+			if compress && !precompressed {
+				protocol.CompressChunk(chunk)
+			}
+			return c.send(protocol.TypeHTTPResponseBody, chunk)
+		}); err != nil {
+			if cause := context.Cause(ctx); errors.Is(cause, errRequestCanceled) {
+				logger.Debug("Stopped streaming response body for request %s: %v", requestID, cause)
+				return cause
+			}
+			logger.Error("Failed to stream response body: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// send encodes and writes a message to the server. Requests are handled
+// concurrently, so writes are serialized here.
+func (c *Client) send(msgType protocol.MessageType, data interface{}) error {
+	msg, err := protocol.EncodeMessage(msgType, data)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return protocol.WriteFrame(c.conn, msg, c.binary)
 }
 
 // heartbeat sends periodic ping messages to keep the connection alive
-func (c *Client) heartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
+func (c *Client) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		pingMsg, _ := protocol.EncodeMessage(protocol.TypePing, nil)
-		if err := c.conn.WriteJSON(pingMsg); err != nil {
-			logger.Error("Failed to send ping: %v", err)
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
+			if err := c.send(protocol.TypePing, nil); err != nil {
+				logger.Error("Failed to send ping: %v", err)
+				return
+			}
 		}
 	}
 }
 
-// Close closes the WebSocket connection
+// newBody creates the body for a stream the server sends, granting the
+// server credit as it is read if the connection is flow controlled
+func (c *Client) newBody(streamID string) *stream.Body {
+	c.writeMu.Lock()
+	flow := c.flow
+	c.writeMu.Unlock()
+
+	if !flow {
+		return stream.NewBody()
+	}
+	return stream.NewBodyWithCredit(func(chunks int) {
+		c.send(protocol.TypeWindowUpdate, &protocol.WindowUpdateMessage{StreamID: streamID, Chunks: chunks})
+	})
+}
+
+// newWindow creates the window for a stream sent to the server, or nil if
+// the connection is not flow controlled. It must be released with closeWindow.
+func (c *Client) newWindow(streamID string) *stream.Window {
+	c.writeMu.Lock()
+	flow := c.flow
+	c.writeMu.Unlock()
+
+	if !flow {
+		return nil
+	}
+	window := stream.NewWindow()
+	c.sendWindows.Store(streamID, window)
+	return window
+}
+
+// closeWindow releases the window for a stream sent to the server
+func (c *Client) closeWindow(streamID string, window *stream.Window) {
+	if window != nil {
+		c.sendWindows.CompareAndDelete(streamID, window)
+		window.Close()
+	}
+}
+
+// closeRequestBodies aborts every streamed request body
+func (c *Client) closeRequestBodies() {
+	c.requestBodies.Range(func(key, value interface{}) bool {
+		c.requestBodies.Delete(key)
+		value.(*stream.Body).Finish(errors.New("tunnel connection lost"))
+		return true
+	})
+}
+
+// closeSendWindows fails every stream waiting on the server for credit
+func (c *Client) closeSendWindows() {
+	c.sendWindows.Range(func(key, value interface{}) bool {
+		c.sendWindows.Delete(key)
+		value.(*stream.Window).Close()
+		return true
+	})
+}
+
+// cancelRequests abandons every request being proxied
+func (c *Client) cancelRequests() {
+	c.requestCancels.Range(func(key, value interface{}) bool {
+		c.requestCancels.Delete(key)
+		value.(context.CancelCauseFunc)(fmt.Errorf("%w: tunnel connection lost", errRequestCanceled))
+		return true
+	})
+}
+
+// Close closes the WebSocket connection and stops reconnecting
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
 	if c.conn != nil {
 		logger.Info("Closing tunnel connection...")
 		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
@@ -176,3 +932,13 @@ func (c *Client) Close() error {
 	}
 	return nil
 }
+
+// isClosing reports whether Close has been called
+func (c *Client) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
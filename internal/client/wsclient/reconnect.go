@@ -0,0 +1,80 @@
+package wsclient
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+const (
+	// initialBackoff is the delay before the first reconnect attempt
+	initialBackoff = 500 * time.Millisecond
+
+	// maxBackoff caps the delay between reconnect attempts
+	maxBackoff = 30 * time.Second
+)
+
+// RegistrationError is returned when the server rejects a registration
+type RegistrationError struct {
+	Code    string
+	Message string
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Code == protocol.ErrCodeUnauthorized {
+		return fmt.Sprintf("registration failed: %s - %s (run 'ossgrok config --token TOKEN')", e.Code, e.Message)
+	}
+	return fmt.Sprintf("registration failed: %s - %s", e.Code, e.Message)
+}
+
+// Retryable reports whether registering again later might succeed. A domain
+// that is still held by a previous connection is released eventually; a bad
+// token or a disabled feature is not going to change.
+func (e *RegistrationError) Retryable() bool {
+	return e.Code == protocol.ErrCodeRegistrationFailed
+}
+
+// DisconnectedError is returned when the server ends the connection on
+// purpose, such as when an operator disconnects the tunnel
+type DisconnectedError struct {
+	Message string
+}
+
+func (e *DisconnectedError) Error() string {
+	return "disconnected by server: " + e.Message
+}
+
+// reconnect re-establishes the tunnel, backing off exponentially with jitter
+// between attempts. It returns nil once connected or when the client is closed.
+func (c *Client) reconnect() error {
+	backoff := initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		// Equal jitter: wait between half and all of the current backoff
+		delay := backoff/2 + rand.N(backoff/2+1)
+		logger.Info("Reconnecting in %s (attempt %d)...", delay.Round(time.Millisecond), attempt)
+
+		select {
+		case <-time.After(delay):
+		case <-c.closing:
+			return nil
+		}
+
+		err := c.Connect()
+		if err == nil {
+			return nil
+		}
+
+		var regErr *RegistrationError
+		if errors.As(err, &regErr) && !regErr.Retryable() {
+			return err
+		}
+		logger.Warn("Reconnect failed: %v", err)
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
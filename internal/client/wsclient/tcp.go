@@ -0,0 +1,132 @@
+package wsclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// handleStreamOpen registers a new TCP stream and starts relaying it to the
+// local address. The stream is registered before returning so that data
+// arriving while the local dial is in progress is buffered.
+func (c *Client) handleStreamOpen(msg *protocol.Message) {
+	open, err := protocol.DecodeStreamOpen(msg)
+	if err != nil {
+		logger.Error("Failed to decode stream open: %v", err)
+		return
+	}
+
+	t := c.tunnelFor(open.TunnelID)
+	if t == nil || t.Protocol != protocol.ProtocolTCP {
+		logger.Error("Received TCP connection for unknown tunnel: %s", open.TunnelID)
+		c.send(protocol.TypeStreamClose, &protocol.StreamCloseMessage{
+			StreamID: open.StreamID,
+			Error:    errUnknownTunnel.Error(),
+		})
+		return
+	}
+
+	inbound := c.newBody(open.StreamID)
+	c.streams.Store(open.StreamID, inbound)
+	window := c.newWindow(open.StreamID)
+
+	go c.relayStream(t.LocalAddr, open, inbound, window)
+}
+
+// relayStream dials the local address and relays one TCP stream until both
+// sides have finished
+func (c *Client) relayStream(localAddr string, open *protocol.StreamOpenMessage, inbound *stream.Body, window *stream.Window) {
+	defer c.streams.Delete(open.StreamID)
+	defer c.closeWindow(open.StreamID, window)
+
+	logger.Debug("TCP connection from %s (stream %s)", open.RemoteAddr, open.StreamID)
+
+	localConn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		logger.Error("Failed to connect to %s: %v", localAddr, err)
+		inbound.Close()
+		c.send(protocol.TypeStreamClose, &protocol.StreamCloseMessage{
+			StreamID: open.StreamID,
+			Error:    err.Error(),
+		})
+		return
+	}
+
+	stream.Relay(localConn, inbound, func(data []byte) error {
+		if err := window.Acquire(); err != nil {
+			return err
+		}
+		return c.send(protocol.TypeStreamData, &protocol.StreamDataMessage{StreamID: open.StreamID, Data: data})
+	}, func(err error) {
+		closeMsg := &protocol.StreamCloseMessage{StreamID: open.StreamID}
+		if err != nil {
+			closeMsg.Error = err.Error()
+		}
+		c.send(protocol.TypeStreamClose, closeMsg)
+	})
+
+	logger.Debug("TCP connection from %s closed (stream %s)", open.RemoteAddr, open.StreamID)
+}
+
+// handleStreamData delivers bytes from the public connection to the local
+// connection. The server waits for credit while the local side is slower than
+// the tunnel; a server that outruns the buffer anyway has the connection reset
+// rather than stall the tunnel.
+func (c *Client) handleStreamData(msg *protocol.Message) {
+	data, err := protocol.DecodeStreamData(msg)
+	if err != nil {
+		logger.Error("Failed to decode stream data: %v", err)
+		return
+	}
+
+	value, ok := c.streams.Load(data.StreamID)
+	if !ok {
+		logger.Debug("Dropping stream data for unknown stream: %s", data.StreamID)
+		return
+	}
+
+	inbound := value.(*stream.Body)
+	err = inbound.Push(data.Data)
+	if errors.Is(err, stream.ErrFull) {
+		logger.Warn("Resetting TCP stream %s: the local connection is too slow", data.StreamID)
+		inbound.Finish(fmt.Errorf("stream reset: %w", err))
+	} else if err != nil {
+		logger.Debug("Discarding data for closed stream %s: %v", data.StreamID, err)
+	}
+}
+
+// handleStreamClose handles the public side finishing its half of a stream
+func (c *Client) handleStreamClose(msg *protocol.Message) {
+	closeMsg, err := protocol.DecodeStreamClose(msg)
+	if err != nil {
+		logger.Error("Failed to decode stream close: %v", err)
+		return
+	}
+
+	value, ok := c.streams.Load(closeMsg.StreamID)
+	if !ok {
+		return
+	}
+
+	if closeMsg.Error != "" {
+		// The public side aborted the stream and reads no more of it either
+		value.(*stream.Body).Finish(errors.New(closeMsg.Error))
+		if window, ok := c.sendWindows.Load(closeMsg.StreamID); ok {
+			window.(*stream.Window).Close()
+		}
+	} else {
+		value.(*stream.Body).Finish(nil)
+	}
+}
+
+// closeStreams aborts every TCP stream, used when the tunnel goes away
+func (c *Client) closeStreams() {
+	c.streams.Range(func(key, value interface{}) bool {
+		value.(*stream.Body).Finish(errors.New("tunnel closed"))
+		return true
+	})
+}
@@ -0,0 +1,245 @@
+package wsclient
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// localWebSocket is a WebSocket to the local application. Frames from the
+// public caller are queued and written by their own goroutine, so a local
+// application that reads slowly does not stall the tunnel.
+type localWebSocket struct {
+	conn   *websocket.Conn
+	frames chan *protocol.WebSocketFrameMessage
+	done   chan struct{}
+	once   sync.Once
+
+	// closeCode and closeReason are the close frame to send the local
+	// application once the queue is flushed, set before done is closed
+	closeCode   int
+	closeReason string
+
+	// window is the credit for frames sent to the server, nil if the
+	// server predates flow control
+	window *stream.Window
+}
+
+// newLocalWebSocket wraps a dialed local WebSocket for a stream
+func (c *Client) newLocalWebSocket(streamID string, conn *websocket.Conn) *localWebSocket {
+	return &localWebSocket{
+		conn:   conn,
+		frames: make(chan *protocol.WebSocketFrameMessage, stream.DefaultDepth),
+		done:   make(chan struct{}),
+		window: c.newWindow(streamID),
+	}
+}
+
+// writeFrames writes queued frames to the local application until the
+// WebSocket closes, granting the server credit as the queue drains
+func (c *Client) writeFrames(streamID string, ws *localWebSocket) {
+	taken := 0
+	for {
+		select {
+		case frame := <-ws.frames:
+			if err := ws.conn.WriteMessage(frame.MessageType, frame.Data); err != nil {
+				logger.Debug("Failed to write WebSocket frame to local application: %v", err)
+				ws.conn.Close()
+				return
+			}
+			taken++
+			if ws.window != nil && taken >= stream.DefaultDepth/2 {
+				c.send(protocol.TypeWindowUpdate, &protocol.WindowUpdateMessage{StreamID: streamID, Chunks: taken})
+				taken = 0
+			}
+		case <-ws.done:
+			if ws.closeCode == 0 {
+				return
+			}
+			// Flush what the public caller sent before it closed
+		flush:
+			for {
+				select {
+				case frame := <-ws.frames:
+					if err := ws.conn.WriteMessage(frame.MessageType, frame.Data); err != nil {
+						break flush
+					}
+				default:
+					break flush
+				}
+			}
+			frame := websocket.FormatCloseMessage(ws.closeCode, ws.closeReason)
+			ws.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second))
+			ws.conn.Close()
+			return
+		}
+	}
+}
+
+// closeLocalWebSocket closes the local WebSocket for a stream. With a close
+// code, the writer sends the queued frames and a close frame first; without
+// one, the connection is dropped at once.
+func (c *Client) closeLocalWebSocket(streamID string, ws *localWebSocket, code int, reason string) {
+	ws.once.Do(func() {
+		ws.closeCode = code
+		ws.closeReason = reason
+		close(ws.done)
+		c.closeWindow(streamID, ws.window)
+		if code == 0 {
+			ws.conn.Close()
+		}
+	})
+}
+
+// handleWebSocketOpen dials the local application for a proxied WebSocket and
+// relays its frames back to the server until either side closes
+func (c *Client) handleWebSocketOpen(msg *protocol.Message) {
+	open, err := protocol.DecodeWebSocketOpen(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket open: %v", err)
+		return
+	}
+
+	logger.Debug("Received WebSocket upgrade: %s", open.Path)
+
+	var localConn *websocket.Conn
+	var opened *protocol.WebSocketOpenedMessage
+	if t := c.tunnelFor(open.TunnelID); t != nil && t.proxy != nil {
+		localConn, opened = t.proxy.DialWebSocket(open)
+	} else if t != nil {
+		opened = &protocol.WebSocketOpenedMessage{StreamID: open.StreamID, StatusCode: http.StatusNotFound, Error: errNoWebSockets.Error()}
+	} else {
+		opened = &protocol.WebSocketOpenedMessage{StreamID: open.StreamID, Error: errUnknownTunnel.Error()}
+	}
+
+	var ws *localWebSocket
+	if localConn != nil {
+		// Register before replying so frames that follow the reply find it
+		ws = c.newLocalWebSocket(open.StreamID, localConn)
+		c.webSockets.Store(open.StreamID, ws)
+	} else {
+		logger.Error("Failed to dial local WebSocket: %s", opened.Error)
+	}
+
+	if err := c.send(protocol.TypeWebSocketOpened, opened); err != nil {
+		logger.Error("Failed to send WebSocket opened: %v", err)
+		if ws != nil {
+			c.webSockets.Delete(open.StreamID)
+			c.closeLocalWebSocket(open.StreamID, ws, 0, "")
+		}
+		return
+	}
+	if ws == nil {
+		return
+	}
+	go c.writeFrames(open.StreamID, ws)
+
+	// Local application -> server
+	for {
+		messageType, data, err := localConn.ReadMessage()
+		if err != nil {
+			// Only report the close if the server didn't initiate it
+			if _, ok := c.webSockets.LoadAndDelete(open.StreamID); ok {
+				code, reason := closeStatus(err)
+				c.send(protocol.TypeWebSocketClose, &protocol.WebSocketCloseMessage{
+					StreamID: open.StreamID,
+					Code:     code,
+					Reason:   reason,
+				})
+			}
+			c.closeLocalWebSocket(open.StreamID, ws, 0, "")
+			return
+		}
+
+		if err := ws.window.Acquire(); err != nil {
+			// The stream was closed while waiting for the server
+			c.closeLocalWebSocket(open.StreamID, ws, 0, "")
+			return
+		}
+		if err := c.send(protocol.TypeWebSocketFrame, &protocol.WebSocketFrameMessage{
+			StreamID:    open.StreamID,
+			MessageType: messageType,
+			Data:        data,
+		}); err != nil {
+			logger.Error("Failed to send WebSocket frame: %v", err)
+			c.webSockets.Delete(open.StreamID)
+			c.closeLocalWebSocket(open.StreamID, ws, 0, "")
+			return
+		}
+	}
+}
+
+// handleWebSocketFrame queues a frame from the public caller for the local
+// application. The server waits for credit while the local application is
+// slower than the tunnel; a server that overflows the queue anyway has the
+// WebSocket closed rather than stall the tunnel.
+func (c *Client) handleWebSocketFrame(msg *protocol.Message) {
+	frame, err := protocol.DecodeWebSocketFrame(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket frame: %v", err)
+		return
+	}
+
+	value, ok := c.webSockets.Load(frame.StreamID)
+	if !ok {
+		logger.Debug("Dropping WebSocket frame for unknown stream: %s", frame.StreamID)
+		return
+	}
+
+	ws := value.(*localWebSocket)
+
+	select {
+	case ws.frames <- frame:
+	default:
+		logger.Warn("Closing WebSocket stream %s: the local application is too slow", frame.StreamID)
+		if _, ok := c.webSockets.LoadAndDelete(frame.StreamID); ok {
+			c.send(protocol.TypeWebSocketClose, &protocol.WebSocketCloseMessage{
+				StreamID: frame.StreamID,
+				Code:     websocket.CloseInternalServerErr,
+				Reason:   "message queue full",
+			})
+		}
+		c.closeLocalWebSocket(frame.StreamID, ws, websocket.CloseInternalServerErr, "message queue full")
+	}
+}
+
+// handleWebSocketClose closes the local WebSocket after the public caller closed theirs
+func (c *Client) handleWebSocketClose(msg *protocol.Message) {
+	closeMsg, err := protocol.DecodeWebSocketClose(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket close: %v", err)
+		return
+	}
+
+	value, ok := c.webSockets.LoadAndDelete(closeMsg.StreamID)
+	if !ok {
+		return
+	}
+
+	c.closeLocalWebSocket(closeMsg.StreamID, value.(*localWebSocket), closeMsg.Code, closeMsg.Reason)
+}
+
+// closeWebSockets closes every local WebSocket, used when the tunnel goes away
+func (c *Client) closeWebSockets() {
+	c.webSockets.Range(func(key, value interface{}) bool {
+		c.webSockets.Delete(key)
+		c.closeLocalWebSocket(key.(string), value.(*localWebSocket), 0, "")
+		return true
+	})
+}
+
+// closeStatus returns the close code and reason to report for a local read
+// error, mapping abrupt drops to going away
+func closeStatus(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+		return closeErr.Code, closeErr.Text
+	}
+	return websocket.CloseGoingAway, ""
+}
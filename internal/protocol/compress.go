@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// EncodingGzip marks a body chunk whose data was gzipped for the trip
+// through the tunnel
+const EncodingGzip = "gzip"
+
+// minCompressSize is the smallest body chunk worth compressing
+const minCompressSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+var gzipReaders sync.Pool // *gzip.Reader
+
+// Compressible reports whether a body with the given headers is worth
+// compressing in the tunnel. Bodies that already have a Content-Encoding
+// are not.
+func Compressible(headers map[string][]string) bool {
+	encoding := http.Header(headers).Get("Content-Encoding")
+	return encoding == "" || encoding == "identity"
+}
+
+// CompressChunk gzips a body chunk's data, unless it is too small or would
+// not get any smaller. The chunk's data is replaced rather than overwritten.
+func CompressChunk(chunk *BodyChunkMessage) {
+	if chunk.Encoding != "" || len(chunk.Data) < minCompressSize {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(chunk.Data) / 2)
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write(chunk.Data); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+
+	if buf.Len() < len(chunk.Data) {
+		chunk.Data = buf.Bytes()
+		chunk.Encoding = EncodingGzip
+	}
+}
+
+// decompressChunk restores the data of a chunk the sender compressed.
+// Senders only compress chunks of at most MaxBodyChunkSize bytes, so
+// anything that expands beyond that is refused.
+func decompressChunk(chunk *BodyChunkMessage) error {
+	switch chunk.Encoding {
+	case "":
+		return nil
+	case EncodingGzip:
+	default:
+		return fmt.Errorf("unknown body chunk encoding %q", chunk.Encoding)
+	}
+
+	var zr *gzip.Reader
+	var err error
+	if pooled, ok := gzipReaders.Get().(*gzip.Reader); ok {
+		zr = pooled
+		err = zr.Reset(bytes.NewReader(chunk.Data))
+	} else {
+		zr, err = gzip.NewReader(bytes.NewReader(chunk.Data))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid gzip body chunk: %w", err)
+	}
+	defer gzipReaders.Put(zr)
+
+	data, err := io.ReadAll(io.LimitReader(zr, MaxBodyChunkSize+1))
+	if err != nil {
+		return fmt.Errorf("invalid gzip body chunk: %w", err)
+	}
+	if len(data) > MaxBodyChunkSize {
+		return fmt.Errorf("gzip body chunk expands beyond %d bytes", MaxBodyChunkSize)
+	}
+
+	chunk.Data = data
+	chunk.Encoding = ""
+	return nil
+}
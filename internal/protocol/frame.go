@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameHeaderLen is the size of the header length that starts a binary frame
+const frameHeaderLen = 4
+
+// maxFrameHeader bounds the JSON header of a binary frame
+const maxFrameHeader = 1 << 20
+
+// payloader is implemented by messages that carry raw bytes. EncodeMessage
+// keeps those bytes out of Message.Data so binary frames can send them as
+// they are; key is the name of their JSON field, which must be omitempty.
+// clone returns a shallow copy of the message.
+type payloader interface {
+	payload() (key string, data *[]byte)
+	clone() payloader
+}
+
+func (m *HTTPRequestMessage) payload() (string, *[]byte)    { return "body", &m.Body }
+func (m *HTTPResponseMessage) payload() (string, *[]byte)   { return "body", &m.Body }
+func (m *BodyChunkMessage) payload() (string, *[]byte)      { return "data", &m.Data }
+func (m *WebSocketFrameMessage) payload() (string, *[]byte) { return "data", &m.Data }
+func (m *StreamDataMessage) payload() (string, *[]byte)     { return "data", &m.Data }
+
+func (m *HTTPRequestMessage) clone() payloader    { c := *m; return &c }
+func (m *HTTPResponseMessage) clone() payloader   { c := *m; return &c }
+func (m *BodyChunkMessage) clone() payloader      { c := *m; return &c }
+func (m *WebSocketFrameMessage) clone() payloader { c := *m; return &c }
+func (m *StreamDataMessage) clone() payloader     { c := *m; return &c }
+
+// unmarshal decodes a message's data into v, restoring the payload a binary
+// frame carried separately
+func unmarshal(msg *Message, v interface{}) error {
+	if err := json.Unmarshal(msg.Data, v); err != nil {
+		return err
+	}
+	if p, ok := v.(payloader); ok && msg.Payload != nil {
+		_, data := p.payload()
+		*data = msg.Payload
+	}
+	return nil
+}
+
+// MarshalJSON encodes a message in the JSON framing of protocol version 1.0,
+// with the payload base64-encoded back into its field of the message data
+func (m *Message) MarshalJSON() ([]byte, error) {
+	data := m.Data
+	if len(m.Payload) > 0 {
+		data = m.inlinePayload()
+	}
+	return json.Marshal(struct {
+		Type MessageType     `json:"type"`
+		Data json.RawMessage `json:"data,omitempty"`
+	}{m.Type, data})
+}
+
+// inlinePayload returns the message data with the payload field added at
+// the front. Data is always a JSON object when there is a payload.
+func (m *Message) inlinePayload() json.RawMessage {
+	n := base64.StdEncoding.EncodedLen(len(m.Payload))
+	buf := make([]byte, 0, len(m.Data)+len(m.payloadKey)+n+6)
+	buf = append(buf, '{', '"')
+	buf = append(buf, m.payloadKey...)
+	buf = append(buf, '"', ':', '"')
+	buf = base64.StdEncoding.AppendEncode(buf, m.Payload)
+	buf = append(buf, '"')
+	if len(m.Data) > 2 {
+		buf = append(buf, ',')
+		buf = append(buf, m.Data[1:]...)
+	} else {
+		buf = append(buf, '}')
+	}
+	return buf
+}
+
+// WriteBinary encodes a message as a binary frame of protocol version 1.1: a
+// 4-byte big-endian header length, the message as JSON without its payload,
+// then the payload bytes
+func WriteBinary(w io.Writer, msg *Message) error {
+	header, err := json.Marshal(struct {
+		Type MessageType     `json:"type"`
+		Data json.RawMessage `json:"data,omitempty"`
+	}{msg.Type, msg.Data})
+	if err != nil {
+		return err
+	}
+
+	var size [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(header)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(msg.Payload) > 0 {
+		_, err = w.Write(msg.Payload)
+	}
+	return err
+}
+
+// ReadBinary decodes a binary frame. The payload shares frame's memory.
+func ReadBinary(frame []byte) (*Message, error) {
+	if len(frame) < frameHeaderLen {
+		return nil, fmt.Errorf("binary frame too short")
+	}
+	size := binary.BigEndian.Uint32(frame)
+	if size > maxFrameHeader || int(size) > len(frame)-frameHeaderLen {
+		return nil, fmt.Errorf("invalid binary frame header length %d", size)
+	}
+
+	var msg Message
+	header := frame[frameHeaderLen : frameHeaderLen+int(size)]
+	if err := json.Unmarshal(header, &msg); err != nil {
+		return nil, fmt.Errorf("invalid binary frame header: %w", err)
+	}
+	if payload := frame[frameHeaderLen+int(size):]; len(payload) > 0 {
+		msg.Payload = payload
+	}
+	return &msg, nil
+}
+
+// WriteFrame writes a message to a WebSocket connection, as a binary frame
+// if binaryFrames is set and as JSON otherwise. Messages are compressed with
+// permessage-deflate, if the connection negotiated it, unless they carry
+// data that is already compressed. Writes must be serialized by the caller.
+func WriteFrame(conn *websocket.Conn, msg *Message, binaryFrames bool) error {
+	messageType, write := websocket.TextMessage, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(msg)
+	}
+	if binaryFrames {
+		messageType, write = websocket.BinaryMessage, func(w io.Writer) error {
+			return WriteBinary(w, msg)
+		}
+	}
+
+	conn.EnableWriteCompression(!msg.compressed)
+	w, err := conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if err := write(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// ReadFrame reads the next message from a WebSocket connection in whichever
+// framing the peer used
+func ReadFrame(conn *websocket.Conn) (*Message, error) {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType == websocket.BinaryMessage {
+		return ReadBinary(data)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,206 @@
+// The benchmarks compare the two control plane framings: JSON text messages
+// with base64 bodies (protocol version 1.0) and binary frames with raw
+// bodies (version 1.1), with and without the gzipped body chunks of version
+// 1.2. Each first checks that the framing carries the message intact, and
+// reports the bytes it puts on the wire as wire-B/op.
+//
+//	go test ./internal/protocol -run '^$' -bench .
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+// framing is one way of putting a message on the wire
+type framing struct {
+	name   string
+	encode func(w io.Writer, msg *protocol.Message) error
+	decode func(frame []byte) (*protocol.Message, error)
+}
+
+var framings = []framing{
+	{
+		name: "json",
+		encode: func(w io.Writer, msg *protocol.Message) error {
+			return json.NewEncoder(w).Encode(msg)
+		},
+		decode: func(frame []byte) (*protocol.Message, error) {
+			var msg protocol.Message
+			err := json.Unmarshal(frame, &msg)
+			return &msg, err
+		},
+	},
+	{
+		name:   "binary",
+		encode: protocol.WriteBinary,
+		decode: protocol.ReadBinary,
+	},
+}
+
+// sample is a message to benchmark, with the size of the bytes it carries.
+// Body chunks with compress set are gzipped before they are encoded.
+type sample struct {
+	name     string
+	msgType  protocol.MessageType
+	data     interface{}
+	payload  int
+	compress bool
+}
+
+func samples() []sample {
+	headers := map[string][]string{
+		"Accept":          {"text/html,application/xhtml+xml"},
+		"Accept-Encoding": {"gzip, deflate, br"},
+		"User-Agent":      {"Mozilla/5.0 (X11; Linux x86_64)"},
+	}
+	return []sample{
+		{"request_headers", protocol.TypeHTTPRequest, &protocol.HTTPRequestMessage{
+			RequestID: "0123456789abcdef", Method: "GET", Path: "/index.html", Headers: headers,
+		}, 0, false},
+		{"body_chunk_1KB", protocol.TypeHTTPResponseBody, &protocol.BodyChunkMessage{
+			RequestID: "0123456789abcdef", Data: pattern(1024),
+		}, 1024, false},
+		{"body_chunk_32KB", protocol.TypeHTTPResponseBody, &protocol.BodyChunkMessage{
+			RequestID: "0123456789abcdef", Data: pattern(protocol.MaxBodyChunkSize),
+		}, protocol.MaxBodyChunkSize, false},
+		{"stream_data_32KB", protocol.TypeStreamData, &protocol.StreamDataMessage{
+			StreamID: "0123456789abcdef", Data: pattern(protocol.MaxBodyChunkSize),
+		}, protocol.MaxBodyChunkSize, false},
+		{"json_body_chunk_32KB", protocol.TypeHTTPResponseBody, &protocol.BodyChunkMessage{
+			RequestID: "0123456789abcdef", Data: records(protocol.MaxBodyChunkSize),
+		}, protocol.MaxBodyChunkSize, false},
+		{"json_body_chunk_32KB_gzipped", protocol.TypeHTTPResponseBody, &protocol.BodyChunkMessage{
+			RequestID: "0123456789abcdef", Data: records(protocol.MaxBodyChunkSize),
+		}, protocol.MaxBodyChunkSize, true},
+	}
+}
+
+// pattern returns n bytes that are not all the same, like a real body
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// records returns about n bytes of a JSON API response
+func records(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 1; buf.Len() < n-100; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"User %d","email":"user%d@example.com","active":%t},`, i, i, i, i%3 != 0)
+	}
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// encode encodes a sample's message, compressing it first if it asks for that
+func (s sample) encode() (*protocol.Message, error) {
+	data := s.data
+	if s.compress {
+		chunk := *s.data.(*protocol.BodyChunkMessage)
+		protocol.CompressChunk(&chunk)
+		data = &chunk
+	}
+	return protocol.EncodeMessage(s.msgType, data)
+}
+
+// frame encodes a sample with a framing, checks that it decodes back to the
+// same message and returns the bytes on the wire
+func frame(b *testing.B, f framing, s sample) []byte {
+	b.Helper()
+
+	msg, err := s.encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := f.encode(&buf, msg); err != nil {
+		b.Fatal(err)
+	}
+
+	decoded, err := f.decode(buf.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
+	got, err := decodeSample(decoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+	want, _ := json.Marshal(s.data)
+	if have, _ := json.Marshal(got); !bytes.Equal(have, want) {
+		b.Fatalf("message changed on the way: %s", have)
+	}
+	return buf.Bytes()
+}
+
+func decodeSample(msg *protocol.Message) (interface{}, error) {
+	switch msg.Type {
+	case protocol.TypeHTTPRequest:
+		return protocol.DecodeHTTPRequest(msg)
+	case protocol.TypeHTTPResponseBody:
+		return protocol.DecodeBodyChunk(msg)
+	case protocol.TypeStreamData:
+		return protocol.DecodeStreamData(msg)
+	default:
+		return nil, fmt.Errorf("unexpected message type %s", msg.Type)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, s := range samples() {
+		for _, f := range framings {
+			b.Run(s.name+"/"+f.name, func(b *testing.B) {
+				wire := frame(b, f, s)
+
+				var buf bytes.Buffer
+				b.SetBytes(int64(s.payload))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					msg, err := s.encode()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := f.encode(&buf, msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(wire)), "wire-B/op")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, s := range samples() {
+		for _, f := range framings {
+			b.Run(s.name+"/"+f.name, func(b *testing.B) {
+				wire := frame(b, f, s)
+
+				b.SetBytes(int64(s.payload))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					decoded, err := f.decode(wire)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := decodeSample(decoded); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(wire)), "wire-B/op")
+			})
+		}
+	}
+}
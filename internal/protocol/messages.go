@@ -9,67 +9,360 @@ import (
 type MessageType string
 
 const (
-	TypeRegister     MessageType = "register"
-	TypeRegistered   MessageType = "registered"
-	TypeHTTPRequest  MessageType = "http_request"
-	TypeHTTPResponse MessageType = "http_response"
-	TypePing         MessageType = "ping"
-	TypePong         MessageType = "pong"
-	TypeError        MessageType = "error"
+	TypeRegister         MessageType = "register"
+	TypeRegistered       MessageType = "registered"
+	TypeHTTPRequest      MessageType = "http_request"
+	TypeHTTPResponse     MessageType = "http_response"
+	TypeHTTPRequestBody  MessageType = "http_request_body"
+	TypeHTTPResponseBody MessageType = "http_response_body"
+	TypeCancel           MessageType = "cancel"
+	TypeWebSocketOpen    MessageType = "ws_open"
+	TypeWebSocketOpened  MessageType = "ws_opened"
+	TypeWebSocketFrame   MessageType = "ws_frame"
+	TypeWebSocketClose   MessageType = "ws_close"
+	TypeStreamOpen       MessageType = "stream_open"
+	TypeStreamData       MessageType = "stream_data"
+	TypeStreamClose      MessageType = "stream_close"
+	TypeWindowUpdate     MessageType = "window_update"
+	TypePing             MessageType = "ping"
+	TypePong             MessageType = "pong"
+	TypeError            MessageType = "error"
 )
 
+// Tunnel protocols a client can register
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+)
+
+// Load balancing strategies for HTTP tunnels sharing a domain
+const (
+	LoadBalanceRoundRobin   = "round-robin"
+	LoadBalanceLeastPending = "least-pending"
+	LoadBalanceWeighted     = "weighted"
+)
+
+// Error codes sent in ErrorMessage
+const (
+	ErrCodeInvalidMessage      = "INVALID_MESSAGE"
+	ErrCodeDecodeError         = "DECODE_ERROR"
+	ErrCodeRegistrationFailed  = "REGISTRATION_FAILED"
+	ErrCodeUnsupportedProtocol = "UNSUPPORTED_PROTOCOL"
+	ErrCodeTCPDisabled         = "TCP_DISABLED"
+	ErrCodeInvalidDomain       = "INVALID_DOMAIN"
+
+	// ErrCodeUnsupportedVersion means the server does not speak the protocol
+	// version the client asked for. The message says which side to upgrade.
+	ErrCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+
+	// ErrCodeUnauthorized means the registration token was missing or unknown
+	ErrCodeUnauthorized = "UNAUTHORIZED"
+
+	// ErrCodeForbidden means the token is valid but may not register the tunnel
+	ErrCodeForbidden = "FORBIDDEN"
+
+	// ErrCodeDisconnected is sent before the server closes a client's
+	// connection on purpose, such as when an operator disconnects a tunnel.
+	// The client should not reconnect.
+	ErrCodeDisconnected = "DISCONNECTED"
+
+	// ErrCodeTunnelClosed is sent with the TunnelID of one tunnel the server
+	// has closed, such as when an operator disconnects it, while the client's
+	// other tunnels carry on. The client should stop serving it and not
+	// register it again.
+	ErrCodeTunnelClosed = "TUNNEL_CLOSED"
+
+	// ErrCodeOIDCDisabled means the tunnel asked for an OIDC login but the
+	// server has no OIDC provider configured
+	ErrCodeOIDCDisabled = "OIDC_DISABLED"
+)
+
+// MaxBodyChunkSize is the largest body payload carried by a single body chunk message
+const MaxBodyChunkSize = 32 * 1024
+
 // Message is the base message structure
 type Message struct {
-	Type MessageType `json:"type"`
+	Type MessageType     `json:"type"`
 	Data json.RawMessage `json:"data,omitempty"`
+
+	// Payload holds the raw bytes of messages that carry them, such as body
+	// chunks, outside Data. The JSON framing puts them back into Data.
+	Payload    []byte `json:"-"`
+	payloadKey string
+
+	// compressed is set for messages not worth compressing again with
+	// permessage-deflate
+	compressed bool
 }
 
-// RegisterMessage is sent from client to server to register a domain
+// RegisterMessage is sent from client to server to register a domain.
+// Protocol selects the tunnel type and defaults to HTTP; TCP tunnels ignore
+// Domain and are given a public port instead. A reconnecting client sets
+// ResumeTunnelID and ResumeSecret to the tunnel ID and resume secret it was
+// given before, to reclaim the domain or port the server held for it. A
+// resume without the matching secret is treated as a new tunnel.
+//
+// An HTTP tunnel with no Domain is given a subdomain of the server's base
+// domain: Subdomain if set, or else a random one.
+//
+// Several clients may serve the same domain by all setting LoadBalance to
+// the same strategy. Weight is the client's share of requests under weighted
+// balancing and defaults to 1.
+//
+// Timeout is how long, in milliseconds, the server should wait for the
+// tunnel's responses instead of its default; PathTimeouts override it for
+// requests under particular paths. The server caps both at its maximum.
+//
+// A client may send further register messages on the same connection to
+// serve several tunnels over it. The server answers each one, in order, with
+// a registered or error message.
 type RegisterMessage struct {
 	Domain          string `json:"domain"`
+	Subdomain       string `json:"subdomain,omitempty"`
 	ProtocolVersion string `json:"protocol_version"`
+	Protocol        string `json:"protocol,omitempty"`
+	Token           string `json:"token,omitempty"`
+	ResumeTunnelID  string `json:"resume_tunnel_id,omitempty"`
+	ResumeSecret    string `json:"resume_secret,omitempty"`
+	LoadBalance     string `json:"load_balance,omitempty"`
+	Weight          int    `json:"weight,omitempty"`
+
+	Timeout      int64         `json:"timeout_ms,omitempty"`
+	PathTimeouts []PathTimeout `json:"path_timeouts,omitempty"`
+
+	Auth    *TunnelAuth `json:"auth,omitempty"`
+	IPRules *IPRules    `json:"ip_rules,omitempty"`
+}
+
+// TunnelAuth asks the server to require credentials on an HTTP tunnel's
+// public URL before forwarding requests. Basic is "user:password" for HTTP
+// Basic auth and Token is a bearer token; when both are set, either is
+// accepted. Servers without CapabilityAuth ignore it, so clients must check.
+//
+// OIDC asks for browsers to log in with the server's OIDC provider instead,
+// which servers without CapabilityOIDC refuse. Callers with the Basic or
+// Token credentials still get through without logging in.
+type TunnelAuth struct {
+	Basic string      `json:"basic,omitempty"`
+	Token string      `json:"token,omitempty"`
+	OIDC  *OIDCPolicy `json:"oidc,omitempty"`
+}
+
+// OIDCPolicy restricts who may log in to a tunnel: users with a verified
+// email address in one of EmailDomains, or in one of Groups. When both are
+// empty, anyone the server's provider lets log in may.
+type OIDCPolicy struct {
+	EmailDomains []string `json:"email_domains,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
 }
 
-// RegisteredMessage is sent from server to client after successful registration
+// IPRules asks the server to only accept public requests to an HTTP tunnel
+// from some addresses. Allow and Deny list IP addresses and CIDR ranges;
+// denied addresses are refused even when allowed, and an empty Allow accepts
+// every address that isn't denied. Servers without CapabilityIPRules ignore
+// it, so clients must check.
+type IPRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// PathTimeout overrides a tunnel's timeout, in milliseconds, for requests
+// whose path starts with Prefix. The longest matching prefix wins.
+type PathTimeout struct {
+	Prefix  string `json:"prefix"`
+	Timeout int64  `json:"timeout_ms"`
+}
+
+// RegisteredMessage is sent from server to client after successful
+// registration. Domain is the domain an HTTP tunnel was registered for, which
+// the client should ask for again when it reconnects.
+//
+// ProtocolVersion is the version the server chose for the connection, and
+// Capabilities lists the features it offers on it. Servers that predate
+// version negotiation leave both empty, which means 1.0.
+//
+// ResumeSecret proves the client owns TunnelID when it reconnects, and
+// should not be shared. Servers that predate it leave it empty.
 type RegisteredMessage struct {
-	TunnelID  string `json:"tunnel_id"`
-	ServerURL string `json:"server_url"`
+	TunnelID        string   `json:"tunnel_id"`
+	ResumeSecret    string   `json:"resume_secret,omitempty"`
+	ServerURL       string   `json:"server_url"`
+	Domain          string   `json:"domain,omitempty"`
+	RemotePort      int      `json:"remote_port,omitempty"`
+	ProtocolVersion string   `json:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
 }
 
-// HTTPRequestMessage is sent from server to client with HTTP request to proxy
+// HTTPRequestMessage is sent from server to client with HTTP request to proxy.
+// When BodyStream is set, Body is empty and the body follows in
+// http_request_body chunks. TunnelID identifies which of the client's tunnels
+// the request is for.
+//
+// Timeout is how long, in milliseconds, the server waits for the response
+// headers, counting the time spent sending the request body. The client
+// should give up on the local application at the same point.
+//
+// Host is the public host the caller asked for, which Headers don't include.
 type HTTPRequestMessage struct {
-	RequestID string              `json:"request_id"`
-	Method    string              `json:"method"`
-	Path      string              `json:"path"`
-	Headers   map[string][]string `json:"headers"`
-	Body      []byte              `json:"body,omitempty"`
+	RequestID     string              `json:"request_id"`
+	TunnelID      string              `json:"tunnel_id,omitempty"`
+	Method        string              `json:"method"`
+	Host          string              `json:"host,omitempty"`
+	Path          string              `json:"path"`
+	Headers       map[string][]string `json:"headers"`
+	Body          []byte              `json:"body,omitempty"`
+	BodyStream    bool                `json:"body_stream,omitempty"`
+	ContentLength int64               `json:"content_length,omitempty"`
+	Timeout       int64               `json:"timeout_ms,omitempty"`
 }
 
-// HTTPResponseMessage is sent from client to server with HTTP response
+// HTTPResponseMessage is sent from client to server with HTTP response.
+// When BodyStream is set, Body is empty and the body follows in
+// http_response_body chunks.
 type HTTPResponseMessage struct {
 	RequestID  string              `json:"request_id"`
 	StatusCode int                 `json:"status_code"`
 	Headers    map[string][]string `json:"headers"`
 	Body       []byte              `json:"body,omitempty"`
+	BodyStream bool                `json:"body_stream,omitempty"`
+}
+
+// BodyChunkMessage carries one frame of a streamed request or response body.
+// The last frame of a body has EOF set, and Error set if the body was cut short.
+// Encoding is EncodingGzip if the sender compressed Data, which it only does
+// when the protocol version allows it; DecodeBodyChunk decompresses it.
+type BodyChunkMessage struct {
+	RequestID string `json:"request_id"`
+	Data      []byte `json:"data,omitempty"`
+	EOF       bool   `json:"eof,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+
+	// Precompressed is set by the sender on chunks of a body that already
+	// has a Content-Encoding, so they are not compressed again on the wire.
+	// It is not sent.
+	Precompressed bool `json:"-"`
+}
+
+// CancelMessage is sent from server to client when nobody is waiting for an
+// HTTP request's response any more, because the public caller went away or
+// the server timed out. The client should abandon the request and send
+// nothing more for it.
+type CancelMessage struct {
+	RequestID string `json:"request_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// WebSocketOpenMessage is sent from server to client when a public caller
+// asks to upgrade to a WebSocket. The client dials the local application with
+// the same path and headers. Host is the public host the caller asked for.
+type WebSocketOpenMessage struct {
+	StreamID string              `json:"stream_id"`
+	TunnelID string              `json:"tunnel_id,omitempty"`
+	Host     string              `json:"host,omitempty"`
+	Path     string              `json:"path"`
+	Headers  map[string][]string `json:"headers"`
+}
+
+// WebSocketOpenedMessage is sent from client to server with the result of
+// dialing the local application. Error is set if the dial failed, along with
+// the local application's status code if it answered the handshake.
+type WebSocketOpenedMessage struct {
+	StreamID    string              `json:"stream_id"`
+	Subprotocol string              `json:"subprotocol,omitempty"`
+	Headers     map[string][]string `json:"headers,omitempty"`
+	StatusCode  int                 `json:"status_code,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// WebSocketFrameMessage carries one WebSocket data message in either direction.
+// MessageType is the RFC 6455 opcode (1 for text, 2 for binary).
+type WebSocketFrameMessage struct {
+	StreamID    string `json:"stream_id"`
+	MessageType int    `json:"message_type"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// WebSocketCloseMessage is sent by either side when its end of a proxied
+// WebSocket closes
+type WebSocketCloseMessage struct {
+	StreamID string `json:"stream_id"`
+	Code     int    `json:"code"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// StreamOpenMessage is sent from server to client when a connection is accepted
+// on a TCP tunnel's public port
+type StreamOpenMessage struct {
+	StreamID   string `json:"stream_id"`
+	TunnelID   string `json:"tunnel_id,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// StreamDataMessage carries bytes of a TCP stream in either direction
+type StreamDataMessage struct {
+	StreamID string `json:"stream_id"`
+	Data     []byte `json:"data,omitempty"`
 }
 
-// ErrorMessage is sent when an error occurs
+// StreamCloseMessage is sent by either side when it has nothing more to write
+// to a TCP stream. Error is set if the stream was aborted rather than ended.
+type StreamCloseMessage struct {
+	StreamID string `json:"stream_id"`
+	Error    string `json:"error,omitempty"`
+}
+
+// WindowUpdateMessage is sent by the receiver of a stream once it has made
+// room for more of it, on connections speaking ProtocolVersionFlowControl.
+// It grants the sender Chunks more body chunk, WebSocket frame or stream data
+// messages. StreamID is the request ID for the body of an HTTP request or
+// response, and the stream ID otherwise. Each side starts every stream it
+// sends with credit for stream.DefaultDepth messages.
+type WindowUpdateMessage struct {
+	StreamID string `json:"stream_id"`
+	Chunks   int    `json:"chunks"`
+}
+
+// ErrorMessage is sent when an error occurs. TunnelID is set when the error
+// concerns only one of the client's tunnels.
 type ErrorMessage struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	TunnelID string `json:"tunnel_id,omitempty"`
 }
 
-// EncodeMessage wraps a typed message into a generic Message
+// EncodeMessage wraps a typed message into a generic Message. Raw bytes the
+// message carries go in Payload rather than Data; data is left unchanged.
 func EncodeMessage(msgType MessageType, data interface{}) (*Message, error) {
+	var payload []byte
+	var payloadKey string
+	if p, ok := data.(payloader); ok {
+		if key, field := p.payload(); len(*field) > 0 {
+			// Marshal a copy without the payload, so data is never modified
+			// and can be read or encoded by others at the same time
+			payload, payloadKey = *field, key
+			c := p.clone()
+			_, field = c.payload()
+			*field = nil
+			data = c
+		}
+	}
+
 	dataBytes, err := json.Marshal(data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal message data: %w", err)
 	}
 
-	return &Message{
-		Type: msgType,
-		Data: dataBytes,
-	}, nil
+	msg := &Message{
+		Type:       msgType,
+		Data:       dataBytes,
+		Payload:    payload,
+		payloadKey: payloadKey,
+	}
+	if chunk, ok := data.(*BodyChunkMessage); ok {
+		msg.compressed = chunk.Encoding != "" || chunk.Precompressed
+	}
+	return msg, nil
 }
 
 // DecodeRegister decodes a register message
@@ -93,7 +386,7 @@ func DecodeRegistered(msg *Message) (*RegisteredMessage, error) {
 // DecodeHTTPRequest decodes an HTTP request message
 func DecodeHTTPRequest(msg *Message) (*HTTPRequestMessage, error) {
 	var req HTTPRequestMessage
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
+	if err := unmarshal(msg, &req); err != nil {
 		return nil, fmt.Errorf("failed to decode HTTP request message: %w", err)
 	}
 	return &req, nil
@@ -102,12 +395,105 @@ func DecodeHTTPRequest(msg *Message) (*HTTPRequestMessage, error) {
 // DecodeHTTPResponse decodes an HTTP response message
 func DecodeHTTPResponse(msg *Message) (*HTTPResponseMessage, error) {
 	var resp HTTPResponseMessage
-	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+	if err := unmarshal(msg, &resp); err != nil {
 		return nil, fmt.Errorf("failed to decode HTTP response message: %w", err)
 	}
 	return &resp, nil
 }
 
+// DecodeBodyChunk decodes a request or response body chunk message
+func DecodeBodyChunk(msg *Message) (*BodyChunkMessage, error) {
+	var chunk BodyChunkMessage
+	if err := unmarshal(msg, &chunk); err != nil {
+		return nil, fmt.Errorf("failed to decode body chunk message: %w", err)
+	}
+	if err := decompressChunk(&chunk); err != nil {
+		return nil, fmt.Errorf("failed to decode body chunk message: %w", err)
+	}
+	return &chunk, nil
+}
+
+// DecodeCancel decodes a cancel message
+func DecodeCancel(msg *Message) (*CancelMessage, error) {
+	var cancel CancelMessage
+	if err := json.Unmarshal(msg.Data, &cancel); err != nil {
+		return nil, fmt.Errorf("failed to decode cancel message: %w", err)
+	}
+	return &cancel, nil
+}
+
+// DecodeWebSocketOpen decodes a WebSocket open message
+func DecodeWebSocketOpen(msg *Message) (*WebSocketOpenMessage, error) {
+	var open WebSocketOpenMessage
+	if err := json.Unmarshal(msg.Data, &open); err != nil {
+		return nil, fmt.Errorf("failed to decode WebSocket open message: %w", err)
+	}
+	return &open, nil
+}
+
+// DecodeWebSocketOpened decodes a WebSocket opened message
+func DecodeWebSocketOpened(msg *Message) (*WebSocketOpenedMessage, error) {
+	var opened WebSocketOpenedMessage
+	if err := json.Unmarshal(msg.Data, &opened); err != nil {
+		return nil, fmt.Errorf("failed to decode WebSocket opened message: %w", err)
+	}
+	return &opened, nil
+}
+
+// DecodeWebSocketFrame decodes a WebSocket frame message
+func DecodeWebSocketFrame(msg *Message) (*WebSocketFrameMessage, error) {
+	var frame WebSocketFrameMessage
+	if err := unmarshal(msg, &frame); err != nil {
+		return nil, fmt.Errorf("failed to decode WebSocket frame message: %w", err)
+	}
+	return &frame, nil
+}
+
+// DecodeWebSocketClose decodes a WebSocket close message
+func DecodeWebSocketClose(msg *Message) (*WebSocketCloseMessage, error) {
+	var closeMsg WebSocketCloseMessage
+	if err := json.Unmarshal(msg.Data, &closeMsg); err != nil {
+		return nil, fmt.Errorf("failed to decode WebSocket close message: %w", err)
+	}
+	return &closeMsg, nil
+}
+
+// DecodeStreamOpen decodes a stream open message
+func DecodeStreamOpen(msg *Message) (*StreamOpenMessage, error) {
+	var open StreamOpenMessage
+	if err := json.Unmarshal(msg.Data, &open); err != nil {
+		return nil, fmt.Errorf("failed to decode stream open message: %w", err)
+	}
+	return &open, nil
+}
+
+// DecodeStreamData decodes a stream data message
+func DecodeStreamData(msg *Message) (*StreamDataMessage, error) {
+	var data StreamDataMessage
+	if err := unmarshal(msg, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode stream data message: %w", err)
+	}
+	return &data, nil
+}
+
+// DecodeStreamClose decodes a stream close message
+func DecodeStreamClose(msg *Message) (*StreamCloseMessage, error) {
+	var closeMsg StreamCloseMessage
+	if err := json.Unmarshal(msg.Data, &closeMsg); err != nil {
+		return nil, fmt.Errorf("failed to decode stream close message: %w", err)
+	}
+	return &closeMsg, nil
+}
+
+// DecodeWindowUpdate decodes a window update message
+func DecodeWindowUpdate(msg *Message) (*WindowUpdateMessage, error) {
+	var update WindowUpdateMessage
+	if err := json.Unmarshal(msg.Data, &update); err != nil {
+		return nil, fmt.Errorf("failed to decode window update message: %w", err)
+	}
+	return &update, nil
+}
+
 // DecodeError decodes an error message
 func DecodeError(msg *Message) (*ErrorMessage, error) {
 	var errMsg ErrorMessage
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions. Version 1.0 sends every message as a JSON text message,
+// with body and stream bytes base64-encoded inside it. Clients that only speak
+// 1.0 may predate streaming, so request bodies are sent to them whole.
+// Version 1.1 sends messages as binary frames that carry those bytes raw.
+// Version 1.2 may gzip body chunks. Version 1.3 adds flow control: the sender
+// of a stream waits for window_update messages before sending more than the
+// receiver can buffer.
+//
+// The client advertises the newest version it speaks in RegisterMessage and
+// the server answers with the one it chose in RegisteredMessage. A client
+// must also speak every earlier minor version of its major version, so the
+// server may choose an older one. Until registration settles the version,
+// and for good with a peer that only speaks 1.0, both sides write JSON.
+// Readers accept either framing, so the switch needs no further coordination.
+const (
+	ProtocolVersionJSON        = "1.0"
+	ProtocolVersionBinary      = "1.1"
+	ProtocolVersionCompression = "1.2"
+	ProtocolVersionFlowControl = "1.3"
+
+	// ProtocolVersion is the newest version this build speaks
+	ProtocolVersion = ProtocolVersionFlowControl
+
+	// MinProtocolVersion is the oldest version this build speaks
+	MinProtocolVersion = ProtocolVersionJSON
+)
+
+// Capabilities a server lists in RegisteredMessage, for the features it
+// offers on a connection
+const (
+	// CapabilityStreaming means bodies are sent in chunks rather than whole
+	CapabilityStreaming = "streaming"
+
+	// CapabilityBinaryFraming means messages are sent as binary frames
+	CapabilityBinaryFraming = "binary-framing"
+
+	// CapabilityCompression means body chunks may be gzipped
+	CapabilityCompression = "compression"
+
+	// CapabilityFlowControl means streams are flow controlled with
+	// window_update messages
+	CapabilityFlowControl = "flow-control"
+
+	// CapabilityCancel means the server cancels requests nobody is waiting for
+	CapabilityCancel = "cancel"
+
+	// CapabilityWebSocketProxy means public WebSocket upgrades are proxied
+	CapabilityWebSocketProxy = "websocket-proxy"
+
+	// CapabilityTCP means TCP tunnels can be registered
+	CapabilityTCP = "tcp"
+
+	// CapabilityMultiTunnel means several tunnels can share a connection
+	CapabilityMultiTunnel = "multi-tunnel"
+
+	// CapabilityLoadBalancing means several clients can share a domain
+	CapabilityLoadBalancing = "load-balancing"
+
+	// CapabilityAuth means the server enforces the credentials a tunnel asks
+	// for in RegisterMessage.Auth
+	CapabilityAuth = "auth"
+
+	// CapabilityOIDC means the server can put tunnels behind a login with
+	// its OIDC provider, as asked for in TunnelAuth.OIDC
+	CapabilityOIDC = "oidc"
+
+	// CapabilityIPRules means the server enforces the addresses a tunnel
+	// accepts requests from, as asked for in RegisterMessage.IPRules
+	CapabilityIPRules = "ip-rules"
+
+	// CapabilitySubdomains means the server assigns subdomains to tunnels
+	// registered without a domain
+	CapabilitySubdomains = "subdomains"
+)
+
+// Version is a parsed protocol version
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion parses a protocol version such as "1.1"
+func ParseVersion(s string) (Version, error) {
+	major, minor, ok := strings.Cut(s, ".")
+	if ok {
+		var v Version
+		var err1, err2 error
+		v.Major, err1 = strconv.Atoi(major)
+		v.Minor, err2 = strconv.Atoi(minor)
+		if err1 == nil && err2 == nil && v.Major >= 0 && v.Minor >= 0 {
+			return v, nil
+		}
+	}
+	return Version{}, fmt.Errorf("invalid protocol version %q", s)
+}
+
+// MustParseVersion parses a protocol version known to be valid
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Less reports whether v is older than other
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// BinaryFraming reports whether a protocol version sends binary frames.
+// Invalid versions do not.
+func BinaryFraming(version string) bool {
+	v, err := ParseVersion(version)
+	return err == nil && !v.Less(MustParseVersion(ProtocolVersionBinary))
+}
+
+// Streaming reports whether a client speaking a protocol version is sure to
+// take request bodies in chunks. Invalid versions are not.
+func Streaming(version string) bool {
+	v, err := ParseVersion(version)
+	return err == nil && !v.Less(MustParseVersion(ProtocolVersionBinary))
+}
+
+// Compression reports whether a protocol version may gzip body chunks.
+// Invalid versions do not.
+func Compression(version string) bool {
+	v, err := ParseVersion(version)
+	return err == nil && !v.Less(MustParseVersion(ProtocolVersionCompression))
+}
+
+// FlowControl reports whether a protocol version flow controls streams.
+// Invalid versions do not.
+func FlowControl(version string) bool {
+	v, err := ParseVersion(version)
+	return err == nil && !v.Less(MustParseVersion(ProtocolVersionFlowControl))
+}
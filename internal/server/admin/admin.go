@@ -0,0 +1,181 @@
+// Package admin serves the JSON API operators use to inspect and control live
+// tunnels.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// DefaultDrainTimeout is how long a drain waits for requests in flight when
+// the caller does not say
+const DefaultDrainTimeout = 30 * time.Second
+
+// Handler serves the admin API. Every request must carry the admin token as
+// a bearer token.
+type Handler struct {
+	wsManager *wsmanager.Manager
+	registry  *registry.Registry
+	token     string
+	mux       *http.ServeMux
+}
+
+// New creates an admin API handler that accepts the given token
+func New(wsManager *wsmanager.Manager, reg *registry.Registry, token string) *Handler {
+	h := &Handler{
+		wsManager: wsManager,
+		registry:  reg,
+		token:     token,
+		mux:       http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET /api/tunnels", h.listTunnels)
+	h.mux.HandleFunc("GET /api/tunnels/{key}", h.getTunnel)
+	h.mux.HandleFunc("DELETE /api/tunnels/{key}", h.disconnectTunnel)
+	h.mux.HandleFunc("POST /api/tunnels/{key}/drain", h.drainTunnel)
+	h.mux.HandleFunc("GET /api/blocks", h.listBlocks)
+	h.mux.HandleFunc("PUT /api/blocks/{pattern}", h.block)
+	h.mux.HandleFunc("DELETE /api/blocks/{pattern}", h.unblock)
+	return h
+}
+
+// ServeHTTP implements http.Handler. Routes are:
+//
+//	GET    /api/tunnels                  live tunnels
+//	GET    /api/tunnels/{key}            one tunnel, by tunnel ID or domain
+//	DELETE /api/tunnels/{key}            close the tunnels for a tunnel ID
+//	                                     or domain
+//	POST   /api/tunnels/{key}/drain      stop new requests, then close the
+//	                                     tunnels once in-flight ones finish;
+//	                                     takes an optional ?timeout=30s
+//	GET    /api/blocks                   blocked domain patterns
+//	PUT    /api/blocks/{pattern}         block a domain and disconnect it
+//	DELETE /api/blocks/{pattern}         unblock a domain
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ossgrok admin"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the request's bearer token against the admin token
+func (h *Handler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || h.token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) listTunnels(w http.ResponseWriter, r *http.Request) {
+	tunnels := h.wsManager.Tunnels()
+	if tunnels == nil {
+		tunnels = []wsmanager.TunnelInfo{}
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+func (h *Handler) getTunnel(w http.ResponseWriter, r *http.Request) {
+	info, ok := h.wsManager.Tunnel(r.PathValue("key"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (h *Handler) disconnectTunnel(w http.ResponseWriter, r *http.Request) {
+	infos, err := h.wsManager.Disconnect(r.PathValue("key"))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	for _, info := range infos {
+		logger.Info("Admin disconnected tunnel: domain=%s, tunnel_id=%s", info.Domain, info.TunnelID)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *Handler) drainTunnel(w http.ResponseWriter, r *http.Request) {
+	timeout := DefaultDrainTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid timeout: "+s)
+			return
+		}
+		timeout = d
+	}
+
+	infos, err := h.wsManager.Drain(r.PathValue("key"), timeout)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	for _, info := range infos {
+		logger.Info("Admin draining tunnel: domain=%s, tunnel_id=%s, timeout=%s", info.Domain, info.TunnelID, timeout)
+	}
+	writeJSON(w, http.StatusAccepted, infos)
+}
+
+func (h *Handler) listBlocks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]string{"blocked": h.registry.Blocked()})
+}
+
+func (h *Handler) block(w http.ResponseWriter, r *http.Request) {
+	pattern := r.PathValue("pattern")
+	disconnected := h.wsManager.Block(pattern)
+	if disconnected == nil {
+		disconnected = []wsmanager.TunnelInfo{}
+	}
+
+	logger.Info("Admin blocked %s, disconnecting %d tunnels", pattern, len(disconnected))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pattern":      strings.ToLower(pattern),
+		"disconnected": disconnected,
+	})
+}
+
+func (h *Handler) unblock(w http.ResponseWriter, r *http.Request) {
+	if !h.registry.Unblock(r.PathValue("pattern")) {
+		writeError(w, http.StatusNotFound, "pattern is not blocked")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"blocked": h.registry.Blocked()})
+}
+
+// writeManagerError maps a wsmanager error to an HTTP status
+func writeManagerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, wsmanager.ErrTunnelNotFound) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
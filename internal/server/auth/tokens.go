@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+var (
+	// ErrInvalidToken is returned when a token is missing or unknown
+	ErrInvalidToken = errors.New("invalid or missing token")
+
+	// ErrForbidden is returned when a valid token may not register a tunnel
+	ErrForbidden = errors.New("token is not allowed to register this tunnel")
+)
+
+// TokenStore authenticates the tokens clients present at registration
+type TokenStore interface {
+	Authenticate(token string) (*Token, error)
+}
+
+// Token is a registration token and what it may register
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	// Domains lists the domains the token may register. Entries are exact
+	// domains, "*.example.com" for any subdomain of example.com, or "*".
+	Domains []string `json:"domains"`
+
+	// AllowTCP permits the token to open TCP tunnels
+	AllowTCP bool `json:"allow_tcp,omitempty"`
+}
+
+// AllowsDomain reports whether the token may register domain
+func (t *Token) AllowsDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, pattern := range t.Domains {
+		if MatchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks that the token may register a tunnel of the given
+// protocol. TCP tunnels have no domain and need AllowTCP instead.
+func (t *Token) Authorize(tunnelProtocol, domain string) error {
+	if tunnelProtocol == protocol.ProtocolTCP {
+		if !t.AllowTCP {
+			return fmt.Errorf("%w: TCP tunnels are not allowed for token %q", ErrForbidden, t.Name)
+		}
+		return nil
+	}
+
+	if !t.AllowsDomain(domain) {
+		return fmt.Errorf("%w: domain %s is not allowed for token %q", ErrForbidden, domain, t.Name)
+	}
+	return nil
+}
+
+// MatchDomain reports whether domain matches pattern. A leading "*." matches
+// one or more labels, and "*" on its own matches everything.
+func MatchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(domain, suffix) && len(domain) > len(suffix)
+	}
+	return pattern == domain
+}
+
+// tokenFile is the on-disk format of a FileStore
+type tokenFile struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// FileStore is a TokenStore backed by a JSON file of the form
+//
+//	{"tokens": [{"name": "alice", "token": "...", "domains": ["*.dev.example.com"]}]}
+type FileStore struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens map[string]*Token // keyed by SHA-256 of the token
+}
+
+// LoadFile loads a token store from a JSON file
+func LoadFile(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the token file, keeping the old tokens if it fails
+func (s *FileStore) Reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse token file: %w", err)
+	}
+
+	tokens := make(map[string]*Token, len(file.Tokens))
+	for i, t := range file.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("token %d (%q) in %s has no token value", i, t.Name, s.path)
+		}
+		tokens[hashToken(t.Token)] = t
+	}
+
+	s.mu.Lock()
+	s.tokens = tokens
+	s.mu.Unlock()
+
+	logger.Info("Loaded %d registration tokens from %s", len(tokens), s.path)
+	return nil
+}
+
+// Authenticate implements TokenStore
+func (s *FileStore) Authenticate(token string) (*Token, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Look up by hash so the lookup time doesn't depend on the token's prefix
+	t, ok := s.tokens[hashToken(token)]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// hashToken returns the hex SHA-256 of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+// Package certs serves TLS certificates that are not issued by autocert.
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// Wildcard is a certificate loaded from files, typically a wildcard such as
+// *.tunnel.example.com issued through a DNS challenge, which autocert cannot
+// do. It is served for every host it is valid for.
+type Wildcard struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// LoadWildcard loads a PEM certificate chain and private key
+func LoadWildcard(certFile, keyFile string) (*Wildcard, error) {
+	w := &Wildcard{certFile: certFile, keyFile: keyFile}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Reload reads the certificate files again, e.g. after they were renewed. The
+// previous certificate is kept if they cannot be loaded.
+func (w *Wildcard) Reload() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	w.mu.Lock()
+	w.cert = &cert
+	w.mu.Unlock()
+
+	logger.Info("Loaded certificate for %s (expires %s)",
+		strings.Join(cert.Leaf.DNSNames, ", "), cert.Leaf.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// Covers reports whether the certificate is valid for host
+func (w *Wildcard) Covers(host string) bool {
+	return w.certificate().Leaf.VerifyHostname(host) == nil
+}
+
+// certificate returns the current certificate
+func (w *Wildcard) certificate() *tls.Certificate {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.cert
+}
+
+// GetCertificate returns a tls.Config.GetCertificate that serves the
+// certificate to hosts it covers and asks fallback for every other host
+func (w *Wildcard) GetCertificate(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := w.certificate()
+		if hello.ServerName != "" && cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+			return cert, nil
+		}
+		return fallback(hello)
+	}
+}
@@ -0,0 +1,52 @@
+package httphandler
+
+import (
+	"net/http"
+
+	"github.com/R44VC0RP/ossgrok/internal/server/oidc"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// authenticate checks a public request against the credentials its tunnel
+// asked for, answering 401 Unauthorized if they are missing or wrong, so
+// unauthenticated traffic never reaches the client. The credentials are
+// removed from requests that pass, since they are the tunnel's rather than
+// the local application's.
+//
+// Tunnels behind an OIDC login also let through browsers with a session,
+// and send those without one off to log in. Only the server sets the
+// identity headers on their requests.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request, domain string) bool {
+	auth, ok := h.wsManager.TunnelAuth(domain)
+	if !ok || auth == nil {
+		return true
+	}
+
+	policy := auth.OIDC()
+	if policy != nil {
+		for _, name := range oidc.IdentityHeaders {
+			r.Header.Del(name)
+		}
+	}
+
+	if auth.Check(r) {
+		r.Header.Del("Authorization")
+		return true
+	}
+
+	// Only failures carry the challenge
+	if challenge := auth.Challenge(); challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	if policy != nil && h.oidc != nil {
+		if h.oidc.Authenticate(w, r, h.scheme(r), policy) {
+			w.Header().Del("WWW-Authenticate")
+			return true
+		}
+		return false
+	}
+
+	logger.Debug("Unauthenticated request: domain=%s, path=%s", domain, r.URL.Path)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,153 @@
+package httphandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/R44VC0RP/ossgrok/internal/server/iprange"
+)
+
+// Forwarding headers the server sets for the local application. Callers
+// that aren't trusted proxies can't set them themselves.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, such as "10.0.0.0/8, 127.0.0.1"
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	return iprange.ParseList(strings.Split(list, ","))
+}
+
+// trusted reports whether addr is one of the trusted proxies
+func (h *Handler) trusted(addr string) bool {
+	ip, err := netip.ParseAddr(strings.TrimSpace(addr))
+	if err != nil {
+		return false
+	}
+	return iprange.Contains(h.trustedProxies, ip)
+}
+
+// remoteIP returns the address the request's connection came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the public caller's address. Behind trusted proxies it is
+// the nearest address in X-Forwarded-For that isn't one of them.
+func (h *Handler) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !h.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !h.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// scheme returns the scheme the public caller used, "http" or "https".
+// Behind trusted proxies it is the one they report in X-Forwarded-Proto.
+func (h *Handler) scheme(r *http.Request) string {
+	if h.trusted(remoteIP(r)) {
+		if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+			return strings.TrimSpace(strings.Split(p, ",")[0])
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedHeaders returns a copy of the request's headers for the local
+// application, with X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host,
+// Forwarded (RFC 7239) and X-Real-IP describing the public request. Headers
+// from a trusted proxy are extended; anyone else's are replaced.
+func (h *Handler) forwardedHeaders(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+
+	remote := remoteIP(r)
+	proto := h.scheme(r)
+	host := r.Host
+
+	if h.trusted(remote) {
+		if fh := headers.Get("X-Forwarded-Host"); fh != "" {
+			host = strings.TrimSpace(strings.Split(fh, ",")[0])
+		}
+	} else {
+		for _, name := range forwardingHeaders {
+			headers.Del(name)
+		}
+	}
+
+	forwardedFor := remote
+	if prior := strings.Join(headers.Values("X-Forwarded-For"), ", "); prior != "" {
+		forwardedFor = prior + ", " + remote
+	}
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s",
+		forwardedNode(remote), forwardedValue(host), forwardedValue(proto))
+	if prior := strings.Join(headers.Values("Forwarded"), ", "); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+
+	headers.Set("X-Forwarded-For", forwardedFor)
+	headers.Set("X-Forwarded-Proto", proto)
+	headers.Set("X-Forwarded-Host", host)
+	headers.Set("Forwarded", forwarded)
+	headers.Set("X-Real-Ip", h.clientIP(r))
+	return headers
+}
+
+// forwardedNode formats an address as a Forwarded node, which puts IPv6
+// addresses in brackets and quotes
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a token
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	if value == "" {
+		return `""`
+	}
+	return value
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
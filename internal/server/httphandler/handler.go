@@ -3,24 +3,60 @@ package httphandler
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/metrics"
+	"github.com/R44VC0RP/ossgrok/internal/server/oidc"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
 	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
 )
 
+// statusClientClosedRequest is recorded for requests the caller abandoned
+// before a response could be sent. It is the status nginx uses.
+const statusClientClosedRequest = 499
+
+// Options configures a Handler
+type Options struct {
+	// TrustedProxies are the load balancers in front of the server, if any.
+	// The forwarding headers they set are passed on to the local application
+	// and extended; anyone else's are replaced.
+	TrustedProxies []netip.Prefix
+
+	// OIDC logs browsers in before letting them through to tunnels that ask
+	// for it. Its endpoints are answered before any tunnel sees the request.
+	OIDC *oidc.Gate
+
+	// IPRules apply to every tunnel, on top of the tunnel's own. Requests
+	// they refuse get 403 Forbidden, including those for the OIDC endpoints.
+	IPRules *tunnel.IPRules
+}
+
 // Handler handles HTTP requests and routes them to tunnels
 type Handler struct {
-	wsManager *wsmanager.Manager
+	wsManager      *wsmanager.Manager
+	trustedProxies []netip.Prefix
+	oidc           *oidc.Gate
+	ipRules        *tunnel.IPRules
 }
 
 // New creates a new HTTP handler
-func New(wsManager *wsmanager.Manager) *Handler {
+func New(wsManager *wsmanager.Manager, opts Options) *Handler {
 	return &Handler{
-		wsManager: wsManager,
+		wsManager:      wsManager,
+		trustedProxies: opts.TrustedProxies,
+		oidc:           opts.OIDC,
+		ipRules:        opts.IPRules,
 	}
 }
 
@@ -35,41 +71,80 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debug("Received request for domain: %s, path: %s", domain, r.URL.Path)
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		logger.Error("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+	if !h.allowIP(w, r, domain) {
+		return
+	}
+
+	if h.oidc != nil && h.oidc.Handles(r) {
+		h.oidc.Serve(w, r, h.scheme(r))
 		return
 	}
-	defer r.Body.Close()
+
+	if !h.authenticate(w, r, domain) {
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, domain)
+		return
+	}
+
+	start := time.Now()
 
 	// Generate unique request ID
 	requestID := generateRequestID()
 
-	// Create HTTP request message
+	// Create HTTP request message. Any body is streamed after the headers.
 	req := &protocol.HTTPRequestMessage{
 		RequestID: requestID,
 		Method:    r.Method,
+		Host:      r.Host,
 		Path:      r.URL.RequestURI(),
-		Headers:   r.Header,
-		Body:      body,
+		Headers:   h.forwardedHeaders(r),
+	}
+	if r.ContentLength != 0 {
+		req.BodyStream = true
+		req.ContentLength = r.ContentLength
 	}
 
 	// Send request to tunnel and wait for response
-	resp, err := h.wsManager.SendHTTPRequest(domain, req)
+	body := &countingReader{r: r.Body}
+	resp, err := h.wsManager.SendHTTPRequest(r.Context(), domain, req, body)
+	if err != nil && r.Context().Err() != nil {
+		// The caller went away, so there is no one to answer
+		logger.Debug("Request canceled by caller: domain=%s, path=%s", domain, r.URL.Path)
+		recordRequest(domain, statusClientClosedRequest, start, body.n.Load(), 0)
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to send request to tunnel: %v", err)
 
-		if err.Error() == fmt.Sprintf("no tunnel found for domain: %s", domain) {
-			http.Error(w, fmt.Sprintf("No tunnel registered for domain: %s", domain), http.StatusServiceUnavailable)
-		} else if err.Error() == "timeout waiting for response" {
-			http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+		status := http.StatusInternalServerError
+		if errors.Is(err, wsmanager.ErrTunnelNotFound) {
+			status = http.StatusServiceUnavailable
+			http.Error(w, fmt.Sprintf("No tunnel registered for domain: %s", domain), status)
+			// Don't label metrics with whatever hosts scanners make up
+			domain = ""
+		} else if errors.Is(err, wsmanager.ErrTunnelDraining) {
+			status = http.StatusServiceUnavailable
+			http.Error(w, fmt.Sprintf("Tunnel is draining: %s", domain), status)
+		} else if errors.Is(err, wsmanager.ErrTunnelGone) {
+			status = http.StatusBadGateway
+			http.Error(w, "Tunnel went away before responding", status)
+		} else if errors.Is(err, wsmanager.ErrTimeout) {
+			status = http.StatusGatewayTimeout
+			http.Error(w, "Gateway timeout", status)
+			metrics.RequestTimeouts.With(domain).Inc()
+		} else if errors.Is(err, wsmanager.ErrBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+			http.Error(w, "Request body too large for the tunnel client, which needs upgrading", status)
 		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			http.Error(w, "Internal server error", status)
 		}
+		recordRequest(domain, status, start, body.n.Load(), 0)
 		return
 	}
+	defer resp.Body.Close()
 
 	// Write response headers
 	for key, values := range resp.Headers {
@@ -81,16 +156,61 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Write response body
-	if len(resp.Body) > 0 {
-		if _, err := w.Write(resp.Body); err != nil {
-			logger.Error("Failed to write response body: %v", err)
-		}
+	// Stream response body, flushing each chunk as it arrives
+	written, err := io.Copy(&flushWriter{w: w}, resp.Body)
+	if err != nil && r.Context().Err() != nil {
+		logger.Debug("Response body abandoned by caller: domain=%s, path=%s", domain, r.URL.Path)
+	} else if err != nil {
+		logger.Error("Failed to write response body: %v", err)
+	}
+	recordRequest(domain, resp.StatusCode, start, body.n.Load(), written)
+
+	if errors.Is(err, wsmanager.ErrTunnelGone) || errors.Is(err, stream.ErrFull) {
+		// Drop the connection so the caller can tell the body is incomplete
+		panic(http.ErrAbortHandler)
 	}
 
 	logger.Debug("Request completed: domain=%s, path=%s, status=%d", domain, r.URL.Path, resp.StatusCode)
 }
 
+// recordRequest records the metrics for one proxied request
+func recordRequest(domain string, status int, start time.Time, bytesIn, bytesOut int64) {
+	code := strconv.Itoa(status)
+	metrics.HTTPRequests.With(domain, code).Inc()
+	metrics.HTTPRequestDuration.With(domain, code).Observe(time.Since(start).Seconds())
+	if domain != "" {
+		metrics.TunnelBytes.With(domain, "in").Add(uint64(bytesIn))
+		metrics.TunnelBytes.With(domain, "out").Add(uint64(bytesOut))
+	}
+}
+
+// countingReader counts the bytes read through it. The request body may
+// still be uploading while the response is written, so the count is atomic.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// flushWriter flushes after every write so streamed bodies reach the caller
+// without waiting for the server's output buffer to fill
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		http.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
+
 // generateRequestID generates a unique request ID
 func generateRequestID() string {
 	b := make([]byte, 16)
@@ -0,0 +1,23 @@
+package httphandler
+
+import (
+	"net/http"
+
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// allowIP checks the public caller's address against the server's IP rules
+// and those of the tunnel for domain, answering 403 Forbidden if either
+// refuses it, so blocked traffic never reaches the client. Behind trusted
+// proxies the caller is the address they report.
+func (h *Handler) allowIP(w http.ResponseWriter, r *http.Request, domain string) bool {
+	ip := h.clientIP(r)
+	rules, _ := h.wsManager.TunnelIPRules(domain)
+	if h.ipRules.Allows(ip) && rules.Allows(ip) {
+		return true
+	}
+
+	logger.Debug("Blocked request: domain=%s, ip=%s, path=%s", domain, ip, r.URL.Path)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,118 @@
+package httphandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/metrics"
+	"github.com/R44VC0RP/ossgrok/internal/server/wsmanager"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+var publicUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // The Origin header is forwarded, so the local app decides
+	},
+}
+
+// serveWebSocket proxies a WebSocket upgrade through the tunnel. The local
+// handshake is completed first so its status, subprotocol and cookies can be
+// passed back before the public connection is hijacked.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, domain string) {
+	ws, err := h.wsManager.OpenWebSocket(domain, &protocol.WebSocketOpenMessage{
+		StreamID: generateRequestID(),
+		Host:     r.Host,
+		Path:     r.URL.RequestURI(),
+		Headers:  h.forwardedHeaders(r),
+	})
+	if err != nil {
+		logger.Error("Failed to open WebSocket through tunnel: %v", err)
+
+		var upgradeErr *wsmanager.UpgradeError
+		if errors.Is(err, wsmanager.ErrTunnelNotFound) {
+			http.Error(w, fmt.Sprintf("No tunnel registered for domain: %s", domain), http.StatusServiceUnavailable)
+		} else if errors.Is(err, wsmanager.ErrTunnelDraining) {
+			http.Error(w, fmt.Sprintf("Tunnel is draining: %s", domain), http.StatusServiceUnavailable)
+		} else if errors.Is(err, wsmanager.ErrTimeout) {
+			http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+			metrics.RequestTimeouts.With(domain).Inc()
+		} else if errors.As(err, &upgradeErr) && upgradeErr.StatusCode != 0 {
+			http.Error(w, upgradeErr.Message, upgradeErr.StatusCode)
+		} else {
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+		}
+		return
+	}
+
+	responseHeader := http.Header{}
+	if ws.Subprotocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", ws.Subprotocol)
+	}
+	for _, cookie := range http.Header(ws.Headers).Values("Set-Cookie") {
+		responseHeader.Add("Set-Cookie", cookie)
+	}
+
+	publicConn, err := publicUpgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		logger.Error("Failed to upgrade public WebSocket: %v", err)
+		ws.Close(websocket.CloseInternalServerErr, "upgrade failed")
+		return
+	}
+	defer publicConn.Close()
+
+	logger.Debug("WebSocket opened: domain=%s, path=%s", domain, r.URL.Path)
+
+	bytesIn := metrics.TunnelBytes.With(domain, "in")
+	bytesOut := metrics.TunnelBytes.With(domain, "out")
+
+	// Public caller -> tunnel
+	go func() {
+		for {
+			messageType, data, err := publicConn.ReadMessage()
+			if err != nil {
+				code, reason := closeStatus(err)
+				ws.Close(code, reason)
+				return
+			}
+			if err := ws.Send(messageType, data); err != nil {
+				ws.Close(websocket.CloseGoingAway, "tunnel closed")
+				return
+			}
+			bytesIn.Add(uint64(len(data)))
+		}
+	}()
+
+	// Tunnel -> public caller
+	for {
+		frame, ok := ws.Recv()
+		if !ok {
+			break
+		}
+		if err := publicConn.WriteMessage(frame.MessageType, frame.Data); err != nil {
+			ws.Close(websocket.CloseGoingAway, "public connection closed")
+			break
+		}
+		bytesOut.Add(uint64(len(frame.Data)))
+	}
+
+	code, reason := ws.CloseStatus()
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	publicConn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+
+	logger.Debug("WebSocket closed: domain=%s, path=%s, code=%d", domain, r.URL.Path, code)
+}
+
+// closeStatus extracts the close code and reason from a WebSocket read error.
+// Connections that dropped without a close frame are reported as going away,
+// since 1006 may not be sent on the wire.
+func closeStatus(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+		return closeErr.Code, closeErr.Text
+	}
+	return websocket.CloseGoingAway, ""
+}
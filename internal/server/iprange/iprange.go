@@ -0,0 +1,65 @@
+// Package iprange parses the IP addresses and CIDR ranges operators and
+// clients configure, such as trusted proxies and tunnel IP rules
+package iprange
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Parse parses an IP address, such as "203.0.113.7", or a CIDR range, such
+// as "10.0.0.0/8". An address is returned as a range holding only itself, and
+// IPv4-mapped IPv6 addresses as plain IPv4.
+func Parse(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP range %q: %w", entry, err)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q: %w", entry, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParseList parses a list of addresses and ranges as for Parse. Blank entries
+// and duplicates are skipped, and the result is sorted so equal lists compare
+// equal.
+func ParseList(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		prefix, err := Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return prefixes, nil
+}
+
+// Contains reports whether addr is in any of the ranges
+func Contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
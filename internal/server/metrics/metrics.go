@@ -0,0 +1,284 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// the server needs: counters, gauges and histograms with labels, exposed in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 30s
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metric is anything that can be written in the text format
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]metric)
+)
+
+// register adds a metric to the set served by Handler
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[m.name()]; exists {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	registry[m.name()] = m
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		metrics := make([]metric, 0, len(registry))
+		for _, m := range registry {
+			metrics = append(metrics, m)
+		}
+		registryMu.Unlock()
+
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// desc is the name, help text and label names shared by every metric type
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+// writeHeader writes the HELP and TYPE lines
+func (d *desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, metricType)
+}
+
+// labelKey joins label values into a map key
+func (d *desc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders label pairs as {a="x",b="y"}, with extra appended
+func (d *desc) formatLabels(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], labelEscaper.Replace(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values for the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedKeys returns the keys of a label map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats a sample value
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	desc
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates and registers a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		desc:     desc{metricName: name, help: help, labels: labels},
+		counters: make(map[string]*Counter),
+	}
+	register(v)
+	return v
+}
+
+// With returns the counter for the given label values, in label order
+func (v *CounterVec) With(values ...string) *Counter {
+	key := v.labelKey(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.writeHeader(w, "counter")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, key := range sortedKeys(v.counters) {
+		fmt.Fprintf(w, "%s%s %d\n", v.metricName, v.formatLabels(key), v.counters[key].value.Load())
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are scraped
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge that calls fn on every scrape
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help}, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Observe records one observation
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bucket bounds, which must be sorted, and label names
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		desc:       desc{metricName: name, help: help, labels: labels},
+		buckets:    buckets,
+		histograms: make(map[string]*Histogram),
+	}
+	register(v)
+	return v
+}
+
+// With returns the histogram for the given label values, in label order
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := v.labelKey(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.histograms[key] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.writeHeader(w, "histogram")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, key := range sortedKeys(v.histograms) {
+		h := v.histograms[key]
+		h.mu.Lock()
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.formatLabels(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.formatLabels(key, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.metricName, v.formatLabels(key), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.metricName, v.formatLabels(key), h.count)
+
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+// Metrics recorded by the server. Gauges that read live state are registered
+// by main with NewGaugeFunc.
+var (
+	// HTTPRequests counts requests to tunnels by domain and response status.
+	// Requests for domains with no tunnel have an empty domain.
+	HTTPRequests = NewCounterVec("ossgrok_http_requests_total",
+		"HTTP requests proxied through tunnels, by domain and status code.", "domain", "status")
+
+	// HTTPRequestDuration is the time from receiving a request to finishing
+	// its response
+	HTTPRequestDuration = NewHistogramVec("ossgrok_http_request_duration_seconds",
+		"Time to proxy an HTTP request through a tunnel, including the response body.",
+		DefaultBuckets, "domain", "status")
+
+	// TunnelBytes counts body, WebSocket and TCP stream bytes per tunnel. In is
+	// from public callers towards the tunnel, out is back to the callers.
+	TunnelBytes = NewCounterVec("ossgrok_tunnel_bytes_total",
+		"Bytes relayed through tunnels, by tunnel and direction (in: to the client, out: to public callers).",
+		"tunnel", "direction")
+
+	// RequestTimeouts counts requests that got no response in time
+	RequestTimeouts = NewCounterVec("ossgrok_request_timeouts_total",
+		"Requests that timed out waiting for the tunnel client to respond, by domain.", "domain")
+
+	// RegistrationFailures counts rejected tunnel registrations by error code
+	RegistrationFailures = NewCounterVec("ossgrok_registration_failures_total",
+		"Tunnel registrations rejected by the server, by error code.", "code")
+)
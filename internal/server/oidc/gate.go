@@ -0,0 +1,494 @@
+// Package oidc puts tunnels behind a login with an OpenID Connect provider.
+//
+// Tunnel domains come and go, but a provider only redirects users back to
+// URLs registered with it in advance. So the login happens on one fixed
+// redirect URL on the server, which then hands the verified identity to the
+// tunnel's domain in a short-lived sealed token. The tunnel's domain turns
+// that into a session cookie of its own.
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// PathPrefix is where the gate's endpoints live on every domain it protects
+const PathPrefix = "/_ossgrok/oidc/"
+
+// SessionCookie holds a user's session on a tunnel domain. It is removed
+// from requests before they reach the local application.
+const SessionCookie = "_ossgrok_session"
+
+// stateCookie is the prefix of the cookies that carry a login in progress
+// from the redirect to the provider back to the callback
+const stateCookie = "_ossgrok_oidc_"
+
+const (
+	// DefaultSessionTTL is how long a login lasts when Config.SessionTTL is zero
+	DefaultSessionTTL = 12 * time.Hour
+
+	// stateTTL is how long a user has to log in at the provider
+	stateTTL = 10 * time.Minute
+
+	// handoffTTL is how long the token passing an identity from the callback
+	// to the tunnel's domain is valid
+	handoffTTL = time.Minute
+)
+
+// IdentityHeaders are the headers that pass a verified user to the local
+// application. Callers can't set them on tunnels behind a login.
+var IdentityHeaders = []string{
+	"X-Forwarded-Email",
+	"X-Forwarded-User",
+	"X-Forwarded-Groups",
+}
+
+// Config configures a Gate
+type Config struct {
+	// Issuer is the provider's issuer URL. Its endpoints are discovered from
+	// {Issuer}/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the callback URL registered with the provider, on a
+	// host the server answers for, such as
+	// "https://login.example.com/_ossgrok/oidc/callback"
+	RedirectURL string
+
+	// Scopes are requested from the provider. "openid email profile" is used
+	// when empty.
+	Scopes []string
+
+	// GroupsClaim is the ID token claim listing the user's groups. "groups"
+	// is used when empty.
+	GroupsClaim string
+
+	// CookieSecret seals sessions. A random secret is used when empty, which
+	// logs everyone out when the server restarts.
+	CookieSecret string
+
+	// SessionTTL is how long a login lasts. DefaultSessionTTL is used when
+	// zero.
+	SessionTTL time.Duration
+
+	// Policy applies to every tunnel, on top of the tunnel's own policy
+	Policy *Policy
+
+	// HTTPClient talks to the provider. A client with a 10 second timeout is
+	// used when nil.
+	HTTPClient *http.Client
+}
+
+// PolicyLookup returns the policy of the tunnel serving domain, and false if
+// no tunnel behind a login serves it
+type PolicyLookup func(domain string) (*Policy, bool)
+
+// Gate logs users in with an OIDC provider before letting them through to
+// tunnels that ask for it
+type Gate struct {
+	provider   *provider
+	sealer     *sealer
+	redirect   *url.URL
+	scopes     []string
+	sessionTTL time.Duration
+	policy     *Policy
+	lookup     PolicyLookup
+}
+
+// New creates a gate. The provider is not contacted until the first login.
+func New(cfg Config, lookup PolicyLookup) (*Gate, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, fmt.Errorf("issuer and client ID are required")
+	}
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil || (redirect.Scheme != "http" && redirect.Scheme != "https") || redirect.Host == "" ||
+		redirect.RawQuery != "" || redirect.Fragment != "" {
+		return nil, fmt.Errorf("invalid redirect URL %q, expected an http or https URL", cfg.RedirectURL)
+	}
+	if redirect.Path == "" {
+		redirect.Path = "/"
+	}
+
+	secret := cfg.CookieSecret
+	if secret == "" {
+		secret = randomString(32)
+	}
+	sealer, err := newSealer([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gate{
+		provider: &provider{
+			issuer:       cfg.Issuer,
+			clientID:     cfg.ClientID,
+			clientSecret: cfg.ClientSecret,
+			groupsClaim:  cfg.GroupsClaim,
+			client:       cfg.HTTPClient,
+		},
+		sealer:     sealer,
+		redirect:   redirect,
+		scopes:     cfg.Scopes,
+		sessionTTL: cfg.SessionTTL,
+		policy:     cfg.Policy,
+		lookup:     lookup,
+	}
+	if g.provider.groupsClaim == "" {
+		g.provider.groupsClaim = "groups"
+	}
+	if g.provider.client == nil {
+		g.provider.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(g.scopes) == 0 {
+		g.scopes = []string{"openid", "email", "profile"}
+	}
+	if g.sessionTTL <= 0 {
+		g.sessionTTL = DefaultSessionTTL
+	}
+	return g, nil
+}
+
+// RedirectHost returns the host of the redirect URL, which the server must
+// answer for
+func (g *Gate) RedirectHost() string {
+	return g.redirect.Hostname()
+}
+
+// Handles reports whether a request is for the gate: anything on the
+// redirect URL's host, which carries the login cookies and belongs to the
+// gate alone, and the session and logout endpoints under PathPrefix on tunnel
+// domains behind a login
+func (g *Gate) Handles(r *http.Request) bool {
+	if g.onRedirectHost(r) {
+		return true
+	}
+	if !strings.HasPrefix(r.URL.Path, PathPrefix) {
+		return false
+	}
+	_, ok := g.lookup(r.Host)
+	return ok
+}
+
+// onRedirectHost reports whether a request is for the redirect URL's host,
+// on any port
+func (g *Gate) onRedirectHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, g.redirect.Hostname())
+}
+
+// Serve answers a request to one of the gate's endpoints. scheme is the
+// scheme the caller used, "http" or "https".
+func (g *Gate) Serve(w http.ResponseWriter, r *http.Request, scheme string) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case g.onRedirectHost(r) && r.URL.Path == g.redirect.Path:
+		g.callback(w, r)
+	case g.onRedirectHost(r) && r.URL.Path == PathPrefix+"login":
+		g.login(w, r)
+	case r.URL.Path == PathPrefix+"session":
+		g.startSession(w, r, scheme)
+	case r.URL.Path == PathPrefix+"logout":
+		g.logout(w, r, scheme)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Authenticate lets a request through if it has a session for a user that
+// both the server's policy and the tunnel's allow, passing the user on to
+// the local application in IdentityHeaders. Otherwise it sends browsers off
+// to log in and answers anyone else with 401 Unauthorized, or answers 403
+// Forbidden to users the policies don't allow.
+func (g *Gate) Authenticate(w http.ResponseWriter, r *http.Request, scheme string, policy *Policy) bool {
+	if id, ok := g.session(r); ok {
+		if !g.allows(policy, id) {
+			logger.Debug("Forbidden request: domain=%s, user=%s", r.Host, id.Subject)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		removeCookie(r.Header, SessionCookie)
+		setIdentity(r.Header, id)
+		return true
+	}
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		login := url.URL{
+			Scheme:   g.redirect.Scheme,
+			Host:     g.redirect.Host,
+			Path:     PathPrefix + "login",
+			RawQuery: url.Values{"rd": {scheme + "://" + r.Host + r.URL.RequestURI()}}.Encode(),
+		}
+		http.Redirect(w, r, login.String(), http.StatusFound)
+		return false
+	}
+
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// loginState is what the gate remembers about a login while the user is at
+// the provider
+type loginState struct {
+	ID       string `json:"id"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+// handoff passes a verified identity from the callback to a tunnel domain
+type handoff struct {
+	Domain   string   `json:"domain"`
+	Identity Identity `json:"identity"`
+}
+
+// login sends the user to the provider, to come back to the tunnel URL in rd
+func (g *Gate) login(w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(r.URL.Query().Get("rd"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "Invalid return URL", http.StatusBadRequest)
+		return
+	}
+	if _, ok := g.lookup(target.Host); !ok {
+		http.Error(w, fmt.Sprintf("No tunnel requires login for domain: %s", target.Host), http.StatusNotFound)
+		return
+	}
+
+	meta, err := g.provider.discover(r.Context())
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := loginState{
+		ID:       randomString(16),
+		Nonce:    randomString(16),
+		Verifier: randomString(32),
+		Return:   target.String(),
+	}
+	sealed, err := g.sealer.seal("state", state, stateTTL)
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie + state.ID,
+		Value:    sealed,
+		Path:     g.redirect.Path,
+		MaxAge:   int(stateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   g.redirect.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	authorize, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		logger.Error("OIDC login failed: invalid authorization endpoint: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", g.provider.clientID)
+	query.Set("redirect_uri", g.redirect.String())
+	query.Set("scope", strings.Join(g.scopes, " "))
+	query.Set("state", state.ID)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+
+	http.Redirect(w, r, authorize.String(), http.StatusFound)
+}
+
+// callback verifies the user the provider sent back, and hands them to the
+// tunnel domain they were trying to reach
+func (g *Gate) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		logger.Warn("OIDC login refused by provider: %s %s", reason, query.Get("error_description"))
+		http.Error(w, "Login failed: "+reason, http.StatusForbidden)
+		return
+	}
+
+	id := query.Get("state")
+	cookie, err := r.Cookie(stateCookie + id)
+	var state loginState
+	if err != nil || g.sealer.open("state", cookie.Value, &state) != nil || state.ID != id {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie + id,
+		Path:     g.redirect.Path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   g.redirect.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	meta, err := g.provider.discover(r.Context())
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	rawToken, err := g.provider.exchange(r.Context(), meta, query.Get("code"), g.redirect.String(), state.Verifier)
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	identity, err := g.provider.verify(r.Context(), meta, rawToken, state.Nonce)
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	target, err := url.Parse(state.Return)
+	if err != nil {
+		http.Error(w, "Invalid return URL", http.StatusBadRequest)
+		return
+	}
+	policy, ok := g.lookup(target.Host)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No tunnel requires login for domain: %s", target.Host), http.StatusNotFound)
+		return
+	}
+	if !g.allows(policy, identity) {
+		logger.Info("OIDC login denied: domain=%s, user=%s, email=%s", target.Host, identity.Subject, identity.Email)
+		http.Error(w, "Forbidden: your account may not access "+target.Host, http.StatusForbidden)
+		return
+	}
+	logger.Info("OIDC login: domain=%s, user=%s, email=%s", target.Host, identity.Subject, identity.Email)
+
+	token, err := g.sealer.seal("handoff", handoff{Domain: target.Host, Identity: *identity}, handoffTTL)
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	next := url.URL{
+		Scheme:   target.Scheme,
+		Host:     target.Host,
+		Path:     PathPrefix + "session",
+		RawQuery: url.Values{"token": {token}, "rd": {target.RequestURI()}}.Encode(),
+	}
+	http.Redirect(w, r, next.String(), http.StatusFound)
+}
+
+// startSession sets the session cookie on a tunnel domain from a handoff,
+// and sends the user on to the page they asked for
+func (g *Gate) startSession(w http.ResponseWriter, r *http.Request, scheme string) {
+	var h handoff
+	if err := g.sealer.open("handoff", r.URL.Query().Get("token"), &h); err != nil || h.Domain != r.Host {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	sealed, err := g.sealer.seal("session", h, g.sessionTTL)
+	if err != nil {
+		logger.Error("OIDC login failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    sealed,
+		Path:     "/",
+		MaxAge:   int(g.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Only return to paths on this domain
+	rd := r.URL.Query().Get("rd")
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.HasPrefix(rd, `/\`) {
+		rd = "/"
+	}
+	http.Redirect(w, r, rd, http.StatusFound)
+}
+
+// logout ends the session on a tunnel domain
+func (g *Gate) logout(w http.ResponseWriter, r *http.Request, scheme string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Signed out")
+}
+
+// session returns the user logged in to the request's domain, if any
+func (g *Gate) session(r *http.Request) (*Identity, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var h handoff
+	if err := g.sealer.open("session", cookie.Value, &h); err != nil || h.Domain != r.Host {
+		return nil, false
+	}
+	return &h.Identity, true
+}
+
+// allows reports whether both the server's policy and a tunnel's allow a user
+func (g *Gate) allows(policy *Policy, id *Identity) bool {
+	return g.policy.Allows(id) && policy.Allows(id)
+}
+
+// setIdentity passes a user to the local application
+func setIdentity(header http.Header, id *Identity) {
+	for _, name := range IdentityHeaders {
+		header.Del(name)
+	}
+	header.Set("X-Forwarded-User", id.Subject)
+	if id.Email != "" && id.EmailVerified {
+		header.Set("X-Forwarded-Email", id.Email)
+	}
+	if len(id.Groups) > 0 {
+		header.Set("X-Forwarded-Groups", strings.Join(id.Groups, ","))
+	}
+}
+
+// removeCookie removes a cookie from a request's Cookie headers, leaving the
+// others as they were sent
+func removeCookie(header http.Header, name string) {
+	var kept []string
+	for _, line := range header.Values("Cookie") {
+		var parts []string
+		for _, part := range strings.Split(line, ";") {
+			if cookieName, _, _ := strings.Cut(strings.TrimSpace(part), "="); cookieName != name {
+				parts = append(parts, strings.TrimSpace(part))
+			}
+		}
+		if len(parts) > 0 {
+			kept = append(kept, strings.Join(parts, "; "))
+		}
+	}
+	header.Del("Cookie")
+	for _, line := range kept {
+		header.Add("Cookie", line)
+	}
+}
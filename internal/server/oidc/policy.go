@@ -0,0 +1,74 @@
+package oidc
+
+import (
+	"slices"
+	"strings"
+)
+
+// Identity is a user the provider has vouched for
+type Identity struct {
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+}
+
+// Policy restricts who may pass the gate: users with a verified email
+// address in one of EmailDomains, or in one of Groups. An empty policy lets
+// every user the provider vouches for through.
+type Policy struct {
+	EmailDomains []string
+	Groups       []string
+}
+
+// NewPolicy builds a policy, ignoring blank entries. Email domains are
+// matched without regard to case, and may be given with a leading "@".
+func NewPolicy(emailDomains, groups []string) *Policy {
+	p := &Policy{}
+	for _, domain := range emailDomains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" && !slices.Contains(p.EmailDomains, domain) {
+			p.EmailDomains = append(p.EmailDomains, domain)
+		}
+	}
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		if group != "" && !slices.Contains(p.Groups, group) {
+			p.Groups = append(p.Groups, group)
+		}
+	}
+	slices.Sort(p.EmailDomains)
+	slices.Sort(p.Groups)
+	return p
+}
+
+// Empty reports whether the policy lets every user through
+func (p *Policy) Empty() bool {
+	return p == nil || (len(p.EmailDomains) == 0 && len(p.Groups) == 0)
+}
+
+// Allows reports whether the policy lets a user through
+func (p *Policy) Allows(id *Identity) bool {
+	if p.Empty() {
+		return true
+	}
+	if id.EmailVerified {
+		if at := strings.LastIndex(id.Email, "@"); at >= 0 && slices.Contains(p.EmailDomains, id.Email[at+1:]) {
+			return true
+		}
+	}
+	for _, group := range id.Groups {
+		if slices.Contains(p.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal reports whether two policies let the same users through
+func (p *Policy) Equal(other *Policy) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return slices.Equal(p.EmailDomains, other.EmailDomains) && slices.Equal(p.Groups, other.Groups)
+}
@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// errInvalidToken is returned for sealed values that were tampered with,
+// were sealed for another purpose or have expired
+var errInvalidToken = errors.New("invalid or expired token")
+
+// sealer encrypts and authenticates the values the gate hands to browsers:
+// login state, handoffs between domains and sessions. Each is sealed for a
+// purpose, so one can't be passed off as another.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret []byte) (*sealer, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// envelope is what gets sealed: the value and when it expires
+type envelope struct {
+	Expires int64           `json:"exp"`
+	Value   json.RawMessage `json:"v"`
+}
+
+// seal encrypts v for purpose, valid for ttl
+func (s *sealer) seal(purpose string, v interface{}, ttl time.Duration) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(envelope{Expires: time.Now().Add(ttl).Unix(), Value: value})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(purpose))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed for purpose into v
+func (s *sealer) open(purpose, token string, v interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return errInvalidToken
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(purpose))
+	if err != nil {
+		return errInvalidToken
+	}
+
+	var env envelope
+	if err := json.Unmarshal(plaintext, &env); err != nil {
+		return errInvalidToken
+	}
+	if time.Now().Unix() > env.Expires {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(env.Value, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
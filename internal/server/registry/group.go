@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"sync/atomic"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+// Member is one tunnel connection serving a domain
+type Member struct {
+	Conn   TunnelConnection
+	Weight int
+}
+
+// Group is a snapshot of the connections serving a domain. A domain taken
+// with Register has a single member and no strategy.
+type Group struct {
+	Strategy string
+	Members  []Member
+	counter  *atomic.Uint64
+}
+
+// Next returns the next value of the domain's round-robin counter, which is
+// shared by every snapshot of the group
+func (g *Group) Next() uint64 {
+	return g.counter.Add(1) - 1
+}
+
+// ValidStrategy reports whether strategy is a load balancing strategy the
+// registry accepts for groups
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case protocol.LoadBalanceRoundRobin, protocol.LoadBalanceLeastPending, protocol.LoadBalanceWeighted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Policy is how a shared domain is protected, which every member of its
+// group must agree on
+type Policy interface {
+	// Match returns an error saying how other differs from the policy, or
+	// nil if they are the same
+	Match(other Policy) error
+}
+
+// entry is the registration of one domain
+type entry struct {
+	strategy string // empty when the domain is not shared
+	policy   Policy // of the group's first member, if any
+	members  []Member
+	counter  *atomic.Uint64
+}
+
+// indexOf returns the index of the member with the given tunnel ID, or -1
+func (e *entry) indexOf(tunnelID string) int {
+	for i, m := range e.members {
+		if m.Conn.TunnelID() == tunnelID {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes conn from the members and reports whether it was one
+func (e *entry) remove(conn TunnelConnection) bool {
+	for i, m := range e.members {
+		if m.Conn == conn {
+			e.members = append(e.members[:i], e.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
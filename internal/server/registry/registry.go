@@ -1,12 +1,21 @@
 package registry
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/R44VC0RP/ossgrok/internal/server/auth"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
 )
 
+// ErrDomainBlocked is returned when registering a domain an operator blocked
+var ErrDomainBlocked = errors.New("domain is blocked")
+
 // TunnelConnection represents a tunnel connection interface
 type TunnelConnection interface {
 	Domain() string
@@ -14,51 +23,192 @@ type TunnelConnection interface {
 	Close() error
 }
 
+// reservation holds a domain for a tunnel that is expected to reconnect
+type reservation struct {
+	tunnelID string
+	expires  time.Time
+}
+
 // Registry manages the mapping of domains to tunnel connections
 type Registry struct {
-	mu      sync.RWMutex
-	tunnels map[string]TunnelConnection
+	mu           sync.RWMutex
+	tunnels      map[string]*entry
+	reservations map[string]reservation
+	blocked      map[string]struct{} // domain patterns, as for auth.MatchDomain
 }
 
 // New creates a new tunnel registry
 func New() *Registry {
 	return &Registry{
-		tunnels: make(map[string]TunnelConnection),
+		tunnels:      make(map[string]*entry),
+		reservations: make(map[string]reservation),
+		blocked:      make(map[string]struct{}),
 	}
 }
 
-// Register registers a new tunnel for a domain
+// Register registers a new tunnel for a domain. The domain is not shared
+// with any other connection.
+//
+// A domain held by Release can only be taken by a connection with the same
+// tunnel ID until the reservation expires. A tunnel ID that is still
+// registered cannot be taken over; its owner has to be gone first.
 func (r *Registry) Register(domain string, conn TunnelConnection) error {
+	return r.register(domain, conn, "", 0, nil)
+}
+
+// RegisterMember adds a tunnel to the group of connections sharing a domain,
+// creating the group if the domain is free. Every member must ask for the
+// same load balancing strategy and a policy that matches the group's, or
+// whichever joined with a weaker one would open the domain to callers the
+// others refuse; weight is the member's share of requests under weighted
+// balancing.
+//
+// Reservations and live tunnel IDs are handled as for Register: a domain
+// the whole group left is held for the member that left last, and the others
+// can only rejoin once it is back or the reservation has expired.
+func (r *Registry) RegisterMember(domain string, conn TunnelConnection, strategy string, weight int, policy Policy) error {
+	if !ValidStrategy(strategy) {
+		return fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+	return r.register(domain, conn, strategy, weight, policy)
+}
+
+// register adds conn to the domain's entry. An empty strategy is an
+// exclusive registration.
+func (r *Registry) register(domain string, conn TunnelConnection, strategy string, weight int, policy Policy) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
-	if _, exists := r.tunnels[domain]; exists {
-		return fmt.Errorf("domain %s is already registered", domain)
+	if r.isBlocked(domain) {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrDomainBlocked, domain)
+	}
+
+	if weight <= 0 {
+		weight = 1
+	}
+	member := Member{Conn: conn, Weight: weight}
+
+	if e, exists := r.tunnels[domain]; exists {
+		switch {
+		case e.indexOf(conn.TunnelID()) >= 0:
+			r.mu.Unlock()
+			return fmt.Errorf("tunnel %s is still connected to domain %s", conn.TunnelID(), domain)
+		case strategy == "" || e.strategy == "":
+			r.mu.Unlock()
+			return fmt.Errorf("domain %s is already registered", domain)
+		case strategy != e.strategy:
+			r.mu.Unlock()
+			return fmt.Errorf("domain %s is load balanced with %s, not %s", domain, e.strategy, strategy)
+		default:
+			if e.policy != nil {
+				if err := e.policy.Match(policy); err != nil {
+					r.mu.Unlock()
+					return fmt.Errorf("domain %s is shared with %w", domain, err)
+				}
+			}
+			e.members = append(e.members, member)
+		}
+	} else {
+		if res, reserved := r.reservations[domain]; reserved && time.Now().Before(res.expires) &&
+			res.tunnelID != conn.TunnelID() {
+			r.mu.Unlock()
+			return fmt.Errorf("domain %s is reserved for a reconnecting tunnel", domain)
+		}
+		delete(r.reservations, domain)
+
+		r.tunnels[domain] = &entry{
+			strategy: strategy,
+			policy:   policy,
+			members:  []Member{member},
+			counter:  new(atomic.Uint64),
+		}
 	}
+	size := len(r.tunnels[domain].members)
+	r.mu.Unlock()
 
-	r.tunnels[domain] = conn
-	logger.Info("Registered tunnel for domain: %s (tunnel_id: %s)", domain, conn.TunnelID())
+	switch {
+	case strategy != "":
+		logger.Info("Registered tunnel for domain: %s (tunnel_id: %s), %d in %s group", domain, conn.TunnelID(), size, strategy)
+	default:
+		logger.Info("Registered tunnel for domain: %s (tunnel_id: %s)", domain, conn.TunnelID())
+	}
 	return nil
 }
 
-// Unregister removes a tunnel registration
+// Release unregisters a disconnected tunnel. If it was the domain's last
+// connection, the domain is held for the same tunnel ID for the grace period.
+// It does nothing if the connection has since been replaced.
+func (r *Registry) Release(domain string, conn TunnelConnection, grace time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, exists := r.tunnels[domain]
+	if !exists || !e.remove(conn) {
+		return
+	}
+	if len(e.members) > 0 {
+		logger.Info("Removed tunnel from group for domain: %s (tunnel_id: %s), %d left", domain, conn.TunnelID(), len(e.members))
+		return
+	}
+	delete(r.tunnels, domain)
+
+	// Drop reservations nobody came back for
+	now := time.Now()
+	for d, res := range r.reservations {
+		if now.After(res.expires) {
+			delete(r.reservations, d)
+		}
+	}
+
+	if grace > 0 {
+		r.reservations[domain] = reservation{
+			tunnelID: conn.TunnelID(),
+			expires:  time.Now().Add(grace),
+		}
+		logger.Info("Released tunnel for domain: %s (tunnel_id: %s), reserved for %s", domain, conn.TunnelID(), grace)
+	} else {
+		logger.Info("Unregistered tunnel for domain: %s (tunnel_id: %s)", domain, conn.TunnelID())
+	}
+}
+
+// Unregister removes every tunnel registered for a domain
 func (r *Registry) Unregister(domain string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if conn, exists := r.tunnels[domain]; exists {
+	if e, exists := r.tunnels[domain]; exists {
 		delete(r.tunnels, domain)
-		logger.Info("Unregistered tunnel for domain: %s (tunnel_id: %s)", domain, conn.TunnelID())
+		logger.Info("Unregistered %d tunnels for domain: %s", len(e.members), domain)
 	}
 }
 
-// GetTunnel retrieves a tunnel connection for a domain
+// GetTunnel retrieves a tunnel connection for a domain. For a domain shared
+// by a group it returns the first member; use GetGroup to balance requests.
 func (r *Registry) GetTunnel(domain string) (TunnelConnection, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	conn, exists := r.tunnels[domain]
-	return conn, exists
+	e, exists := r.tunnels[domain]
+	if !exists {
+		return nil, false
+	}
+	return e.members[0].Conn, true
+}
+
+// GetGroup returns the connections serving a domain
+func (r *Registry) GetGroup(domain string) (*Group, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, exists := r.tunnels[domain]
+	if !exists {
+		return nil, false
+	}
+	return &Group{
+		Strategy: e.strategy,
+		Members:  append([]Member(nil), e.members...),
+		counter:  e.counter,
+	}, true
 }
 
 // Count returns the number of registered tunnels
@@ -66,7 +216,11 @@ func (r *Registry) Count() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	return len(r.tunnels)
+	n := 0
+	for _, e := range r.tunnels {
+		n += len(e.members)
+	}
+	return n
 }
 
 // List returns all registered domains
@@ -80,3 +234,60 @@ func (r *Registry) List() []string {
 	}
 	return domains
 }
+
+// Block refuses future registrations for domains matching pattern, which may
+// be a domain or a wildcard such as "*.example.com". Tunnels already
+// registered are left alone.
+func (r *Registry) Block(pattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.blocked[strings.ToLower(pattern)] = struct{}{}
+	logger.Info("Blocked domain pattern: %s", pattern)
+}
+
+// Unblock removes a pattern added by Block and reports whether it was blocked
+func (r *Registry) Unblock(pattern string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pattern = strings.ToLower(pattern)
+	if _, ok := r.blocked[pattern]; !ok {
+		return false
+	}
+	delete(r.blocked, pattern)
+	logger.Info("Unblocked domain pattern: %s", pattern)
+	return true
+}
+
+// Blocked returns the blocked domain patterns, sorted
+func (r *Registry) Blocked() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	patterns := make([]string, 0, len(r.blocked))
+	for pattern := range r.blocked {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// IsBlocked reports whether domain matches a blocked pattern
+func (r *Registry) IsBlocked(domain string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.isBlocked(domain)
+}
+
+// isBlocked is IsBlocked for callers holding r.mu
+func (r *Registry) isBlocked(domain string) bool {
+	domain = strings.ToLower(domain)
+	for pattern := range r.blocked {
+		if auth.MatchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
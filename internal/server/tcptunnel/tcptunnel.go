@@ -0,0 +1,410 @@
+package tcptunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/metrics"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// ErrNoPortsAvailable is returned when every port in the range is in use
+var ErrNoPortsAvailable = errors.New("no TCP ports available")
+
+// reservation holds a port for a tunnel that is expected to reconnect
+type reservation struct {
+	tunnelID string
+	expires  time.Time
+}
+
+// Server allocates public ports for TCP tunnels from a configured range
+type Server struct {
+	mu           sync.Mutex
+	minPort      int
+	maxPort      int
+	listeners    map[int]*Listener
+	reservations map[int]reservation
+	ipRules      *tunnel.IPRules // the server's, for every tunnel
+}
+
+// New creates a new TCP tunnel server for ports minPort through maxPort
+func New(minPort, maxPort int) *Server {
+	return &Server{
+		minPort:      minPort,
+		maxPort:      maxPort,
+		listeners:    make(map[int]*Listener),
+		reservations: make(map[int]reservation),
+	}
+}
+
+// SetIPRules sets the server's IP rules, which every TCP tunnel applies to
+// its public connections. TCP tunnels have no rules of their own. It must be
+// called before any tunnel is registered.
+func (s *Server) SetIPRules(rules *tunnel.IPRules) {
+	s.ipRules = rules
+}
+
+// ParsePortRange parses a port range such as "10000-10100"
+func ParsePortRange(s string) (int, int, error) {
+	low, high, found := strings.Cut(s, "-")
+	if !found {
+		high = low
+	}
+
+	minPort, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return minPort, maxPort, nil
+}
+
+// Listen allocates a port from the range for a tunnel. A tunnel reconnecting
+// within its grace period gets its previous port back; one that is still
+// connected is refused. Connections are not accepted until Serve is called.
+func (s *Server) Listen(tunnelID string) (*Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		if l.tunnelID == tunnelID {
+			return nil, fmt.Errorf("tunnel %s is still connected on port %d", tunnelID, l.port)
+		}
+	}
+
+	now := time.Now()
+	for port, res := range s.reservations {
+		if now.After(res.expires) {
+			delete(s.reservations, port)
+			continue
+		}
+		if res.tunnelID == tunnelID {
+			delete(s.reservations, port)
+			if l, err := s.listen(port, tunnelID); err == nil {
+				return l, nil
+			}
+		}
+	}
+
+	for port := s.minPort; port <= s.maxPort; port++ {
+		if _, inUse := s.listeners[port]; inUse {
+			continue
+		}
+		if _, reserved := s.reservations[port]; reserved {
+			continue
+		}
+
+		l, err := s.listen(port, tunnelID)
+		if err != nil {
+			logger.Debug("TCP port %d unavailable: %v", port, err)
+			continue
+		}
+		return l, nil
+	}
+
+	return nil, ErrNoPortsAvailable
+}
+
+// listen opens a listener on port. Callers must hold s.mu.
+func (s *Server) listen(port int, tunnelID string) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		server:   s,
+		port:     port,
+		tunnelID: tunnelID,
+		ln:       ln,
+	}
+	s.listeners[port] = l
+	return l, nil
+}
+
+// Count returns the number of TCP tunnels with a public port open
+func (s *Server) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.listeners)
+}
+
+// Tunnels returns the connections of the TCP tunnels being served
+func (s *Server) Tunnels() []*tunnel.Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*tunnel.Connection, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		if l.conn != nil {
+			conns = append(conns, l.conn)
+		}
+	}
+	return conns
+}
+
+// Listener returns the listener serving a tunnel connection
+func (s *Server) Listener(conn *tunnel.Connection) (*Listener, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		if l.conn == conn {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// Listener is a public port serving one TCP tunnel
+type Listener struct {
+	server   *Server
+	port     int
+	tunnelID string
+	ln       net.Listener
+	conn     *tunnel.Connection // set by Serve, under server.mu
+	closed   bool               // under server.mu
+	streams  sync.Map           // map[streamID]*stream.Body
+	windows  sync.Map           // map[streamID]*stream.Window, if flow controlled
+}
+
+// Port returns the public port of the listener
+func (l *Listener) Port() int {
+	return l.port
+}
+
+// Close stops accepting connections and aborts every open stream
+func (l *Listener) Close() error {
+	return l.Release(0)
+}
+
+// Release closes the listener like Close, but holds its port for the same
+// tunnel ID for the grace period so a reconnecting client keeps its address.
+// It does nothing if the listener is already closed.
+func (l *Listener) Release(grace time.Duration) error {
+	l.server.mu.Lock()
+	if l.closed {
+		l.server.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	if l.server.listeners[l.port] == l {
+		delete(l.server.listeners, l.port)
+	}
+	if grace > 0 {
+		l.server.reservations[l.port] = reservation{
+			tunnelID: l.tunnelID,
+			expires:  time.Now().Add(grace),
+		}
+	}
+	l.server.mu.Unlock()
+
+	err := l.ln.Close()
+	l.streams.Range(func(key, value interface{}) bool {
+		value.(*stream.Body).Finish(errors.New("tunnel closed"))
+		return true
+	})
+	l.windows.Range(func(key, value interface{}) bool {
+		value.(*stream.Window).Close()
+		return true
+	})
+
+	logger.Info("Stopped listening for TCP tunnel on port %d", l.port)
+	return err
+}
+
+// HandleData delivers bytes from the client to a public connection, and
+// reports whether the stream belongs to this listener. The client waits for
+// credit while the public connection is slower than the tunnel; a client that
+// outruns the buffer anyway has the connection reset rather than stall the
+// tunnel.
+func (l *Listener) HandleData(data *protocol.StreamDataMessage) bool {
+	value, ok := l.streams.Load(data.StreamID)
+	if !ok {
+		return false
+	}
+
+	inbound := value.(*stream.Body)
+	err := inbound.Push(data.Data)
+	if errors.Is(err, stream.ErrFull) {
+		logger.Warn("Resetting TCP stream %s on port %d: the public connection is too slow", data.StreamID, l.port)
+		inbound.Finish(fmt.Errorf("stream reset: %w", err))
+	} else if err != nil {
+		logger.Debug("Discarding data for closed stream %s: %v", data.StreamID, err)
+	}
+	return true
+}
+
+// HandleWindowUpdate gives the client's credit to a stream, and reports
+// whether the stream belongs to this listener
+func (l *Listener) HandleWindowUpdate(update *protocol.WindowUpdateMessage) bool {
+	value, ok := l.windows.Load(update.StreamID)
+	if !ok {
+		return false
+	}
+
+	value.(*stream.Window).Grant(update.Chunks)
+	return true
+}
+
+// HandleClose handles the client finishing its side of a stream, and reports
+// whether the stream belongs to this listener
+func (l *Listener) HandleClose(closeMsg *protocol.StreamCloseMessage) bool {
+	value, ok := l.streams.Load(closeMsg.StreamID)
+	if !ok {
+		return false
+	}
+
+	if closeMsg.Error != "" {
+		// The client aborted the stream and reads no more of it either
+		value.(*stream.Body).Finish(errors.New(closeMsg.Error))
+		if window, ok := l.windows.Load(closeMsg.StreamID); ok {
+			window.(*stream.Window).Close()
+		}
+	} else {
+		value.(*stream.Body).Finish(nil)
+	}
+	return true
+}
+
+// Serve starts relaying the connections accepted on the listener through the
+// tunnel connection, until the listener is closed
+func (l *Listener) Serve(conn *tunnel.Connection) {
+	l.server.mu.Lock()
+	l.conn = conn
+	l.server.mu.Unlock()
+	go l.acceptLoop()
+
+	logger.Info("Listening for TCP tunnel on port %d (tunnel_id: %s)", l.port, conn.TunnelID())
+}
+
+// acceptLoop accepts public connections until the listener is closed
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("TCP tunnel accept error on port %d: %v", l.port, err)
+			}
+			return
+		}
+		go l.handle(c)
+	}
+}
+
+// handle relays one public connection through the tunnel
+func (l *Listener) handle(c net.Conn) {
+	if l.conn.Draining() {
+		logger.Debug("Refusing TCP connection on draining port %d from %s", l.port, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if ip, _, _ := net.SplitHostPort(c.RemoteAddr().String()); !l.server.ipRules.Allows(ip) {
+		logger.Debug("Refusing TCP connection on port %d from %s: blocked by IP rules", l.port, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	defer l.conn.StartRequest()()
+
+	streamID := generateStreamID()
+	var inbound *stream.Body
+	var window *stream.Window // nil if the client predates flow control
+	if l.conn.FlowControl() {
+		inbound = stream.NewBodyWithCredit(func(chunks int) {
+			l.send(protocol.TypeWindowUpdate, &protocol.WindowUpdateMessage{StreamID: streamID, Chunks: chunks})
+		})
+		window = stream.NewWindow()
+		l.windows.Store(streamID, window)
+		defer func() {
+			l.windows.Delete(streamID)
+			window.Close()
+		}()
+	} else {
+		inbound = stream.NewBody()
+	}
+	l.streams.Store(streamID, inbound)
+	defer l.streams.Delete(streamID)
+
+	logger.Debug("TCP connection opened: port=%d, stream=%s, remote=%s", l.port, streamID, c.RemoteAddr())
+
+	if err := l.send(protocol.TypeStreamOpen, &protocol.StreamOpenMessage{
+		StreamID:   streamID,
+		TunnelID:   l.tunnelID,
+		RemoteAddr: c.RemoteAddr().String(),
+	}); err != nil {
+		logger.Error("Failed to open stream through tunnel: %v", err)
+		c.Close()
+		return
+	}
+
+	bytesIn := metrics.TunnelBytes.With(l.conn.Domain(), "in")
+	stream.Relay(&countingConn{Conn: c, counter: metrics.TunnelBytes.With(l.conn.Domain(), "out")}, inbound, func(data []byte) error {
+		if err := window.Acquire(); err != nil {
+			return err
+		}
+		bytesIn.Add(uint64(len(data)))
+		return l.send(protocol.TypeStreamData, &protocol.StreamDataMessage{StreamID: streamID, Data: data})
+	}, func(err error) {
+		closeMsg := &protocol.StreamCloseMessage{StreamID: streamID}
+		if err != nil {
+			closeMsg.Error = err.Error()
+		}
+		l.send(protocol.TypeStreamClose, closeMsg)
+	})
+
+	logger.Debug("TCP connection closed: port=%d, stream=%s", l.port, streamID)
+}
+
+// countingConn counts the bytes written to a public connection
+type countingConn struct {
+	net.Conn
+	counter *metrics.Counter
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.Add(uint64(n))
+	return n, err
+}
+
+// CloseWrite shuts down the write side of the public connection
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// send encodes and sends a stream message to the client
+func (l *Listener) send(msgType protocol.MessageType, data interface{}) error {
+	msg, err := protocol.EncodeMessage(msgType, data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s message: %w", msgType, err)
+	}
+	return l.conn.SendMessage(msg)
+}
+
+// generateStreamID generates a random stream ID
+func generateStreamID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "tcp-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/oidc"
+)
+
+// Auth is the credentials a tunnel requires on its public URL. Only digests
+// of the secrets are kept, and they are compared in constant time. Tunnels
+// may also ask for browsers to log in with the server's OIDC provider.
+type Auth struct {
+	basic *[sha256.Size]byte // digest of "user:password"
+	token *[sha256.Size]byte
+	oidc  *oidc.Policy
+}
+
+// NewAuth validates the credentials a client asked for. It returns nil if
+// the client asked for none.
+func NewAuth(req *protocol.TunnelAuth) (*Auth, error) {
+	if req == nil || (req.Basic == "" && req.Token == "" && req.OIDC == nil) {
+		return nil, nil
+	}
+
+	a := &Auth{}
+	if req.Basic != "" {
+		user, password, ok := strings.Cut(req.Basic, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("invalid basic auth, expected user:password")
+		}
+		digest := sha256.Sum256([]byte(req.Basic))
+		a.basic = &digest
+	}
+	if req.Token != "" {
+		digest := sha256.Sum256([]byte(req.Token))
+		a.token = &digest
+	}
+	if req.OIDC != nil {
+		a.oidc = oidc.NewPolicy(req.OIDC.EmailDomains, req.OIDC.Groups)
+	}
+	return a, nil
+}
+
+// Check reports whether a request carries the credentials, as Basic auth or
+// as a bearer token in the Authorization header
+func (a *Auth) Check(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok && a.basic != nil {
+		return matches(a.basic, user+":"+password)
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && a.token != nil && strings.EqualFold(scheme, "Bearer") {
+		return matches(a.token, strings.TrimSpace(token))
+	}
+	return false
+}
+
+// Challenge returns the WWW-Authenticate header for requests that fail
+// Check, or "" if the tunnel only takes OIDC logins
+func (a *Auth) Challenge() string {
+	switch {
+	case a.basic != nil:
+		return `Basic realm="ossgrok", charset="UTF-8"`
+	case a.token != nil:
+		return `Bearer realm="ossgrok"`
+	}
+	return ""
+}
+
+// OIDC returns the policy for users logging in with the server's OIDC
+// provider, or nil if the tunnel doesn't take OIDC logins
+func (a *Auth) OIDC() *oidc.Policy {
+	if a == nil {
+		return nil
+	}
+	return a.oidc
+}
+
+// Methods lists the kinds of credentials accepted: "basic", "bearer" and
+// "oidc"
+func (a *Auth) Methods() []string {
+	var methods []string
+	if a != nil && a.basic != nil {
+		methods = append(methods, "basic")
+	}
+	if a != nil && a.token != nil {
+		methods = append(methods, "bearer")
+	}
+	if a != nil && a.oidc != nil {
+		methods = append(methods, "oidc")
+	}
+	return methods
+}
+
+// Equal reports whether two tunnels require the same credentials
+func (a *Auth) Equal(other *Auth) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	return sameDigest(a.basic, other.basic) && sameDigest(a.token, other.token) && a.oidc.Equal(other.oidc)
+}
+
+func matches(digest *[sha256.Size]byte, secret string) bool {
+	given := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(digest[:], given[:]) == 1
+}
+
+func sameDigest(a, b *[sha256.Size]byte) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -3,28 +3,102 @@ package tunnel
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/R44VC0RP/ossgrok/internal/protocol"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
 )
 
-// Connection represents a tunnel connection to a client
+// Connection represents one tunnel registered by a client. Several
+// connections may share the same Session.
 type Connection struct {
 	domain   string
 	tunnelID string
-	conn     *websocket.Conn
-	mu       sync.Mutex
+	session  *Session
+
+	// timeout and pathTimeouts are how long the tunnel's requests may wait
+	// for a response, when the client asked for something other than the
+	// server's default. pathTimeouts is sorted longest prefix first.
+	timeout      time.Duration
+	pathTimeouts []PathTimeout
+
+	// auth is the credentials the public URL requires, or nil for none
+	auth *Auth
+
+	// ipRules is the addresses the public URL accepts, or nil for any
+	ipRules *IPRules
+
+	requests atomic.Uint64
+	inFlight atomic.Int64
+	draining atomic.Bool
+	removed  atomic.Bool
+
+	// idleMu orders changes to inFlight with idle, the channels to close
+	// when it drops to zero
+	idleMu sync.Mutex
+	idle   []chan struct{}
 }
 
-// NewConnection creates a new tunnel connection
-func NewConnection(domain, tunnelID string, conn *websocket.Conn) *Connection {
+// NewConnection creates a new tunnel connection carried by session
+func NewConnection(domain, tunnelID string, session *Session) *Connection {
 	return &Connection{
 		domain:   domain,
 		tunnelID: tunnelID,
-		conn:     conn,
+		session:  session,
+	}
+}
+
+// PathTimeout is the timeout for requests whose path starts with Prefix
+type PathTimeout struct {
+	Prefix  string
+	Timeout time.Duration
+}
+
+// SetTimeouts sets the timeouts the client asked for. It must be called
+// before the tunnel is registered.
+func (c *Connection) SetTimeouts(timeout time.Duration, paths []PathTimeout) {
+	c.timeout = timeout
+	c.pathTimeouts = append([]PathTimeout(nil), paths...)
+	sort.SliceStable(c.pathTimeouts, func(i, j int) bool {
+		return len(c.pathTimeouts[i].Prefix) > len(c.pathTimeouts[j].Prefix)
+	})
+}
+
+// Timeout returns the timeout for a request path, or 0 if the client did
+// not ask for one
+func (c *Connection) Timeout(path string) time.Duration {
+	for _, pt := range c.pathTimeouts {
+		if strings.HasPrefix(path, pt.Prefix) {
+			return pt.Timeout
+		}
 	}
+	return c.timeout
+}
+
+// SetAuth sets the credentials the client asked callers for. It must be
+// called before the tunnel is registered.
+func (c *Connection) SetAuth(auth *Auth) {
+	c.auth = auth
+}
+
+// Auth returns the credentials the tunnel requires, or nil for none
+func (c *Connection) Auth() *Auth {
+	return c.auth
+}
+
+// SetIPRules sets the addresses the client asked to accept requests from.
+// It must be called before the tunnel is registered.
+func (c *Connection) SetIPRules(rules *IPRules) {
+	c.ipRules = rules
+}
+
+// IPRules returns the addresses the tunnel accepts, or nil for any
+func (c *Connection) IPRules() *IPRules {
+	return c.ipRules
 }
 
 // Domain returns the domain this tunnel serves
@@ -37,16 +111,83 @@ func (c *Connection) TunnelID() string {
 	return c.tunnelID
 }
 
-// SendMessage sends a message to the client
-func (c *Connection) SendMessage(msg *protocol.Message) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// StartRequest records a request, WebSocket or TCP stream starting on the
+// tunnel. The returned func marks it finished and may be called more than once.
+func (c *Connection) StartRequest() (done func()) {
+	c.requests.Add(1)
+	c.idleMu.Lock()
+	c.inFlight.Add(1)
+	c.idleMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(c.finishRequest)
+	}
+}
+
+// finishRequest records a request finishing, waking those waiting for the
+// tunnel to go idle if it was the last
+func (c *Connection) finishRequest() {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+
+	if c.inFlight.Add(-1) == 0 {
+		for _, ch := range c.idle {
+			close(ch)
+		}
+		c.idle = nil
+	}
+}
 
-	if err := c.conn.WriteJSON(msg); err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+// Idle returns a channel that is closed once no requests are in flight on
+// the tunnel, which may be straight away
+func (c *Connection) Idle() <-chan struct{} {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+
+	ch := make(chan struct{})
+	if c.inFlight.Load() == 0 {
+		close(ch)
+	} else {
+		c.idle = append(c.idle, ch)
 	}
+	return ch
+}
 
-	return nil
+// Requests returns how many requests the tunnel has started
+func (c *Connection) Requests() uint64 {
+	return c.requests.Load()
+}
+
+// InFlight returns how many requests on the tunnel have not finished
+func (c *Connection) InFlight() int64 {
+	return c.inFlight.Load()
+}
+
+// SetDraining stops the tunnel from being given new requests
+func (c *Connection) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Draining reports whether the tunnel is refusing new requests
+func (c *Connection) Draining() bool {
+	return c.draining.Load()
+}
+
+// Remove marks the tunnel closed by the server while its session carries on,
+// and reports whether this call removed it
+func (c *Connection) Remove() bool {
+	return c.removed.CompareAndSwap(false, true)
+}
+
+// Removed reports whether the server has closed the tunnel on its own
+func (c *Connection) Removed() bool {
+	return c.removed.Load()
+}
+
+// SendMessage sends a message to the client
+func (c *Connection) SendMessage(msg *protocol.Message) error {
+	return c.session.SendMessage(msg)
 }
 
 // SendHTTPRequest sends an HTTP request to the client
@@ -59,35 +200,58 @@ func (c *Connection) SendHTTPRequest(req *protocol.HTTPRequestMessage) error {
 	return c.SendMessage(msg)
 }
 
-// ReadMessage reads a message from the client
-func (c *Connection) ReadMessage() (*protocol.Message, error) {
-	var msg protocol.Message
-	if err := c.conn.ReadJSON(&msg); err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
+// SendRequestBodyChunk sends one frame of a streamed request body to the client
+func (c *Connection) SendRequestBodyChunk(chunk *protocol.BodyChunkMessage) error {
+	msg, err := protocol.EncodeMessage(protocol.TypeHTTPRequestBody, chunk)
+	if err != nil {
+		return fmt.Errorf("failed to encode request body chunk: %w", err)
 	}
 
-	return &msg, nil
+	return c.SendMessage(msg)
 }
 
-// Close closes the tunnel connection
-func (c *Connection) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// SendCancel tells the client to abandon an HTTP request
+func (c *Connection) SendCancel(requestID, reason string) error {
+	msg, err := protocol.EncodeMessage(protocol.TypeCancel, &protocol.CancelMessage{
+		RequestID: requestID,
+		Reason:    reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cancel message: %w", err)
+	}
 
-	logger.Debug("Closing tunnel connection for domain: %s (tunnel_id: %s)", c.domain, c.tunnelID)
+	return c.SendMessage(msg)
+}
 
-	// Send close message
-	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tunnel closed")
-	if err := c.conn.WriteMessage(websocket.CloseMessage, closeMsg); err != nil {
-		logger.Warn("Failed to send close message: %v", err)
+// SendWindowUpdate grants the client credit to send more chunks of a stream
+func (c *Connection) SendWindowUpdate(streamID string, chunks int) error {
+	msg, err := protocol.EncodeMessage(protocol.TypeWindowUpdate, &protocol.WindowUpdateMessage{
+		StreamID: streamID,
+		Chunks:   chunks,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode window update: %w", err)
 	}
 
-	return c.conn.Close()
+	return c.SendMessage(msg)
+}
+
+// FlowControl reports whether the client waits for window updates before
+// sending more of a stream
+func (c *Connection) FlowControl() bool {
+	return protocol.FlowControl(c.session.ProtocolVersion())
+}
+
+// Close closes the control connection carrying the tunnel. Other tunnels on
+// the same session are closed with it.
+func (c *Connection) Close() error {
+	logger.Debug("Closing tunnel connection for domain: %s (tunnel_id: %s)", c.domain, c.tunnelID)
+	return c.session.Close()
 }
 
-// Conn returns the underlying WebSocket connection
-func (c *Connection) Conn() *websocket.Conn {
-	return c.conn
+// Session returns the control connection carrying the tunnel
+func (c *Connection) Session() *Session {
+	return c.session
 }
 
 // MarshalJSON implements json.Marshaler for logging
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/R44VC0RP/ossgrok/internal/server/iprange"
+)
+
+// IPRules is the addresses a tunnel accepts public requests from. Denied
+// addresses are refused even when allowed, and when nothing is allowed
+// explicitly, every address that isn't denied is.
+type IPRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPRules parses lists of IP addresses and CIDR ranges, such as
+// "10.0.0.0/8" or "203.0.113.7". It returns nil if both lists are empty.
+func NewIPRules(allow, deny []string) (*IPRules, error) {
+	r := &IPRules{}
+	var err error
+	if r.allow, err = iprange.ParseList(allow); err != nil {
+		return nil, err
+	}
+	if r.deny, err = iprange.ParseList(deny); err != nil {
+		return nil, err
+	}
+	if len(r.allow) == 0 && len(r.deny) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Allows reports whether the rules accept requests from ip. Addresses that
+// can't be parsed are only accepted when nothing is allowed explicitly.
+func (r *IPRules) Allows(ip string) bool {
+	if r == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return len(r.allow) == 0
+	}
+	if iprange.Contains(r.deny, addr) {
+		return false
+	}
+	return len(r.allow) == 0 || iprange.Contains(r.allow, addr)
+}
+
+// Allowed lists the ranges allowed explicitly
+func (r *IPRules) Allowed() []string {
+	if r == nil {
+		return nil
+	}
+	return prefixStrings(r.allow)
+}
+
+// Denied lists the ranges denied
+func (r *IPRules) Denied() []string {
+	if r == nil {
+		return nil
+	}
+	return prefixStrings(r.deny)
+}
+
+// Equal reports whether two tunnels accept the same addresses
+func (r *IPRules) Equal(other *IPRules) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	return slices.Equal(r.allow, other.allow) && slices.Equal(r.deny, other.deny)
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var out []string
+	for _, prefix := range prefixes {
+		out = append(out, prefix.String())
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// Session is a client's control connection. A client may register several
+// tunnels over one session, so writes from all of them are serialized here.
+type Session struct {
+	conn        *websocket.Conn
+	mu          sync.Mutex
+	remoteAddr  string
+	connectedAt time.Time
+	closed      atomic.Bool
+
+	// version is the protocol version agreed at registration, and binary
+	// whether it has binary framing
+	version atomic.Value // string
+	binary  atomic.Bool
+}
+
+// NewSession creates a new session for a client's WebSocket connection
+// from remoteAddr
+func NewSession(conn *websocket.Conn, remoteAddr string) *Session {
+	return &Session{
+		conn:        conn,
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+	}
+}
+
+// RemoteAddr returns the address the client connected from
+func (s *Session) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+// ConnectedAt returns when the client connected
+func (s *Session) ConnectedAt() time.Time {
+	return s.connectedAt
+}
+
+// Closed reports whether the server closed the session itself, rather than
+// the client going away
+func (s *Session) Closed() bool {
+	return s.closed.Load()
+}
+
+// SetProtocolVersion records the protocol version agreed with the client.
+// Later messages are sent in binary frames if the version has them.
+func (s *Session) SetProtocolVersion(version string) {
+	s.version.Store(version)
+	s.binary.Store(protocol.BinaryFraming(version))
+}
+
+// ProtocolVersion returns the protocol version agreed with the client, or
+// 1.0 before registration has settled one
+func (s *Session) ProtocolVersion() string {
+	if version, ok := s.version.Load().(string); ok {
+		return version
+	}
+	return protocol.ProtocolVersionJSON
+}
+
+// SendMessage sends a message to the client
+func (s *Session) SendMessage(msg *protocol.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := protocol.WriteFrame(s.conn, msg, s.binary.Load()); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+
+	return nil
+}
+
+// ReadMessage reads a message from the client, in either framing
+func (s *Session) ReadMessage() (*protocol.Message, error) {
+	msg, err := protocol.ReadFrame(s.conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// Close closes the session, and with it every tunnel it carries
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed.Store(true)
+	logger.Debug("Closing control connection from %s", s.remoteAddr)
+
+	// Send close message
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tunnel closed")
+	if err := s.conn.WriteMessage(websocket.CloseMessage, closeMsg); err != nil {
+		logger.Warn("Failed to send close message: %v", err)
+	}
+
+	return s.conn.Close()
+}
+
+// Conn returns the underlying WebSocket connection
+func (s *Session) Conn() *websocket.Conn {
+	return s.conn
+}
@@ -0,0 +1,249 @@
+package wsmanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/auth"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// TunnelInfo describes a live tunnel for operators
+type TunnelInfo struct {
+	TunnelID        string    `json:"tunnel_id"`
+	Protocol        string    `json:"protocol"`
+	Domain          string    `json:"domain"` // public host:port for TCP tunnels
+	RemoteAddr      string    `json:"remote_addr"`
+	ProtocolVersion string    `json:"protocol_version"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	Requests        uint64    `json:"requests"`
+	InFlight        int64     `json:"in_flight"`
+	Draining        bool      `json:"draining,omitempty"`
+	Auth            []string  `json:"auth,omitempty"` // "basic", "bearer" and/or "oidc"
+	AllowIPs        []string  `json:"allow_ips,omitempty"`
+	DenyIPs         []string  `json:"deny_ips,omitempty"`
+}
+
+// newTunnelInfo snapshots a tunnel connection
+func newTunnelInfo(conn *tunnel.Connection, tunnelProtocol string) TunnelInfo {
+	return TunnelInfo{
+		TunnelID:        conn.TunnelID(),
+		Protocol:        tunnelProtocol,
+		Domain:          conn.Domain(),
+		RemoteAddr:      conn.Session().RemoteAddr(),
+		ProtocolVersion: conn.Session().ProtocolVersion(),
+		ConnectedAt:     conn.Session().ConnectedAt(),
+		Requests:        conn.Requests(),
+		InFlight:        conn.InFlight(),
+		Draining:        conn.Draining(),
+		Auth:            conn.Auth().Methods(),
+		AllowIPs:        conn.IPRules().Allowed(),
+		DenyIPs:         conn.IPRules().Denied(),
+	}
+}
+
+// Tunnels returns every live tunnel, HTTP tunnels first, sorted by domain
+func (m *Manager) Tunnels() []TunnelInfo {
+	var infos []TunnelInfo
+	for _, conn := range m.httpTunnels() {
+		infos = append(infos, newTunnelInfo(conn, protocol.ProtocolHTTP))
+	}
+	if m.tcp != nil {
+		for _, conn := range m.tcp.Tunnels() {
+			infos = append(infos, newTunnelInfo(conn, protocol.ProtocolTCP))
+		}
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Protocol != infos[j].Protocol {
+			return infos[i].Protocol == protocol.ProtocolHTTP
+		}
+		return infos[i].Domain < infos[j].Domain
+	})
+	return infos
+}
+
+// httpTunnels returns every registered HTTP tunnel, including each member of
+// a shared domain
+func (m *Manager) httpTunnels() []*tunnel.Connection {
+	var conns []*tunnel.Connection
+	for _, domain := range m.registry.List() {
+		if group, ok := m.registry.GetGroup(domain); ok {
+			for _, member := range group.Members {
+				conns = append(conns, member.Conn.(*tunnel.Connection))
+			}
+		}
+	}
+	return conns
+}
+
+// Tunnel returns a live tunnel by tunnel ID or domain. For a domain shared by
+// a group, it returns the first member.
+func (m *Manager) Tunnel(key string) (TunnelInfo, bool) {
+	conns, tunnelProtocol := m.findTunnels(key)
+	if len(conns) == 0 {
+		return TunnelInfo{}, false
+	}
+	return newTunnelInfo(conns[0], tunnelProtocol), true
+}
+
+// findTunnels looks up live tunnels by tunnel ID or domain. A domain shared
+// by a group gives every member.
+func (m *Manager) findTunnels(key string) ([]*tunnel.Connection, string) {
+	if group, ok := m.registry.GetGroup(strings.ToLower(key)); ok {
+		conns := make([]*tunnel.Connection, 0, len(group.Members))
+		for _, member := range group.Members {
+			conns = append(conns, member.Conn.(*tunnel.Connection))
+		}
+		return conns, protocol.ProtocolHTTP
+	}
+	for _, conn := range m.httpTunnels() {
+		if conn.TunnelID() == key {
+			return []*tunnel.Connection{conn}, protocol.ProtocolHTTP
+		}
+	}
+	if m.tcp != nil {
+		for _, conn := range m.tcp.Tunnels() {
+			if conn.TunnelID() == key || conn.Domain() == key {
+				return []*tunnel.Connection{conn}, protocol.ProtocolTCP
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Disconnect closes the tunnels found by tunnel ID or domain, and tells
+// their clients not to register them again. Other tunnels the clients run
+// over the same connections carry on. It returns the tunnels it closed.
+func (m *Manager) Disconnect(key string) ([]TunnelInfo, error) {
+	conns, tunnelProtocol := m.findTunnels(key)
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	infos := make([]TunnelInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, newTunnelInfo(conn, tunnelProtocol))
+		m.removeTunnel(conn, tunnelProtocol, "disconnected by an administrator")
+	}
+	return infos, nil
+}
+
+// Drain stops the tunnels found by tunnel ID or domain from taking new
+// requests, then closes each like Disconnect once its requests in flight
+// have finished or the timeout has passed. It returns the tunnels draining.
+func (m *Manager) Drain(key string, timeout time.Duration) ([]TunnelInfo, error) {
+	conns, tunnelProtocol := m.findTunnels(key)
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	infos := make([]TunnelInfo, 0, len(conns))
+	for _, conn := range conns {
+		conn.SetDraining()
+		logger.Info("Draining tunnel: domain=%s, tunnel_id=%s, in_flight=%d", conn.Domain(), conn.TunnelID(), conn.InFlight())
+		infos = append(infos, newTunnelInfo(conn, tunnelProtocol))
+		go m.finishDrain(conn, tunnelProtocol, timeout)
+	}
+	return infos, nil
+}
+
+// finishDrain closes a draining tunnel once it is idle or timeout has passed
+func (m *Manager) finishDrain(conn *tunnel.Connection, tunnelProtocol string, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-conn.Idle():
+	case <-timer.C:
+		logger.Warn("Drain timed out with %d requests in flight: domain=%s", conn.InFlight(), conn.Domain())
+	}
+	m.removeTunnel(conn, tunnelProtocol, "tunnel drained by an administrator")
+}
+
+// Block refuses future registrations for domains matching pattern and
+// closes the HTTP tunnels already registered for them. It returns the tunnels
+// it closed.
+func (m *Manager) Block(pattern string) []TunnelInfo {
+	m.registry.Block(pattern)
+
+	var disconnected []TunnelInfo
+	for _, conn := range m.httpTunnels() {
+		if auth.MatchDomain(pattern, conn.Domain()) {
+			disconnected = append(disconnected, newTunnelInfo(conn, protocol.ProtocolHTTP))
+			m.removeTunnel(conn, protocol.ProtocolHTTP, "domain blocked by an administrator")
+		}
+	}
+	return disconnected
+}
+
+// removeTunnel closes one tunnel and tells its client why, leaving the
+// client's other tunnels alone. A client with no other tunnel is disconnected
+// instead, which older clients also understand.
+func (m *Manager) removeTunnel(conn *tunnel.Connection, tunnelProtocol, reason string) {
+	sess := conn.Session()
+	if !m.hasOtherTunnels(conn) {
+		m.disconnect(sess, reason)
+		return
+	}
+	if !conn.Remove() {
+		return
+	}
+
+	logger.Info("Closing tunnel %s of client %s: %s", conn.TunnelID(), sess.RemoteAddr(), reason)
+	if tunnelProtocol == protocol.ProtocolTCP {
+		if listener, ok := m.tcp.Listener(conn); ok {
+			listener.Close()
+		}
+	} else {
+		m.registry.Release(conn.Domain(), conn, 0)
+	}
+	m.failPendingRequests(conn)
+	m.closeWebSockets(conn)
+
+	errMsg, _ := protocol.EncodeMessage(protocol.TypeError, &protocol.ErrorMessage{
+		Code:     protocol.ErrCodeTunnelClosed,
+		Message:  reason,
+		TunnelID: conn.TunnelID(),
+	})
+	if err := sess.SendMessage(errMsg); err != nil {
+		logger.Debug("Failed to tell %s its tunnel was closed: %v", sess.RemoteAddr(), err)
+	}
+}
+
+// hasOtherTunnels reports whether the session carrying a tunnel carries any
+// other live tunnel
+func (m *Manager) hasOtherTunnels(conn *tunnel.Connection) bool {
+	conns := m.httpTunnels()
+	if m.tcp != nil {
+		conns = append(conns, m.tcp.Tunnels()...)
+	}
+	for _, other := range conns {
+		if other != conn && other.Session() == conn.Session() && !other.Removed() {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnect tells a client why it is being disconnected and closes its
+// control connection
+func (m *Manager) disconnect(sess *tunnel.Session, reason string) {
+	if sess.Closed() {
+		return
+	}
+
+	logger.Info("Disconnecting client %s: %s", sess.RemoteAddr(), reason)
+	errMsg, _ := protocol.EncodeMessage(protocol.TypeError, &protocol.ErrorMessage{
+		Code:    protocol.ErrCodeDisconnected,
+		Message: reason,
+	})
+	if err := sess.SendMessage(errMsg); err != nil {
+		logger.Debug("Failed to send disconnect reason to %s: %v", sess.RemoteAddr(), err)
+	}
+	sess.Close()
+}
@@ -0,0 +1,120 @@
+package wsmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+)
+
+// pickTunnel chooses the tunnel connection to send a new request for domain
+// to. Domains shared by a group are balanced with the group's strategy;
+// draining members are skipped.
+func (m *Manager) pickTunnel(domain string) (*tunnel.Connection, error) {
+	group, ok := m.registry.GetGroup(domain)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, domain)
+	}
+
+	candidates := make([]registry.Member, 0, len(group.Members))
+	for _, member := range group.Members {
+		if !member.Conn.(*tunnel.Connection).Draining() {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelDraining, domain)
+	}
+	if len(candidates) == 1 {
+		return candidates[0].Conn.(*tunnel.Connection), nil
+	}
+
+	var picked registry.Member
+	switch group.Strategy {
+	case protocol.LoadBalanceLeastPending:
+		picked = leastPending(candidates, group.Next())
+	case protocol.LoadBalanceWeighted:
+		picked = weighted(candidates, group.Next())
+	default:
+		picked = candidates[group.Next()%uint64(len(candidates))]
+	}
+	return picked.Conn.(*tunnel.Connection), nil
+}
+
+// groupPolicy is how the members of a shared domain must all protect it, or
+// whichever registered without credentials or IP rules would open it to
+// everyone
+type groupPolicy struct {
+	auth    *tunnel.Auth
+	ipRules *tunnel.IPRules
+}
+
+// Match implements registry.Policy
+func (p groupPolicy) Match(other registry.Policy) error {
+	o, _ := other.(groupPolicy)
+	if !p.auth.Equal(o.auth) {
+		return errors.New("different credentials")
+	}
+	if !p.ipRules.Equal(o.ipRules) {
+		return errors.New("different IP rules")
+	}
+	return nil
+}
+
+// TunnelAuth returns the credentials the tunnels for domain require, which
+// is nil if they require none. ok is false when no tunnel serves domain.
+// Every member of a group has the same credentials, since the registry
+// refuses members that differ.
+func (m *Manager) TunnelAuth(domain string) (auth *tunnel.Auth, ok bool) {
+	group, ok := m.registry.GetGroup(domain)
+	if !ok || len(group.Members) == 0 {
+		return nil, false
+	}
+	return group.Members[0].Conn.(*tunnel.Connection).Auth(), true
+}
+
+// TunnelIPRules returns the addresses the tunnels for domain accept
+// requests from, which is nil if they accept any. ok is false when no
+// tunnel serves domain. Every member of a group has the same rules, since the
+// registry refuses members that differ.
+func (m *Manager) TunnelIPRules(domain string) (rules *tunnel.IPRules, ok bool) {
+	group, ok := m.registry.GetGroup(domain)
+	if !ok || len(group.Members) == 0 {
+		return nil, false
+	}
+	return group.Members[0].Conn.(*tunnel.Connection).IPRules(), true
+}
+
+// leastPending returns the member with the fewest requests in flight. Ties
+// go to the first one found starting from offset, so they rotate.
+func leastPending(members []registry.Member, offset uint64) registry.Member {
+	start := int(offset % uint64(len(members)))
+	best := members[start]
+	for i := 1; i < len(members); i++ {
+		m := members[(start+i)%len(members)]
+		if m.Conn.(*tunnel.Connection).InFlight() < best.Conn.(*tunnel.Connection).InFlight() {
+			best = m
+		}
+	}
+	return best
+}
+
+// weighted returns members in proportion to their weights: the nth request
+// goes to the member whose share of the total weight covers n
+func weighted(members []registry.Member, n uint64) registry.Member {
+	total := 0
+	for _, m := range members {
+		total += m.Weight
+	}
+
+	slot := int(n % uint64(total))
+	for _, m := range members {
+		if slot < m.Weight {
+			return m
+		}
+		slot -= m.Weight
+	}
+	return members[len(members)-1]
+}
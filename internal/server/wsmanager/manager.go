@@ -1,43 +1,179 @@
 package wsmanager
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/auth"
+	"github.com/R44VC0RP/ossgrok/internal/server/metrics"
 	"github.com/R44VC0RP/ossgrok/internal/server/registry"
+	"github.com/R44VC0RP/ossgrok/internal/server/tcptunnel"
 	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
 	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins (configure as needed)
 	},
+	EnableCompression: true, // permessage-deflate, if the client offers it
 }
 
+// readTimeout is how long a client may stay silent before its connection is
+// considered dead. Clients ping every 30 seconds.
+const readTimeout = 90 * time.Second
+
+var (
+	// ErrTunnelNotFound is returned when no tunnel is registered for a domain
+	ErrTunnelNotFound = errors.New("no tunnel found for domain")
+
+	// ErrTimeout is returned when the client does not respond in time
+	ErrTimeout = errors.New("timeout waiting for response")
+
+	// ErrTunnelDraining is returned when the tunnel for a domain is being
+	// drained and takes no new requests
+	ErrTunnelDraining = errors.New("tunnel is draining")
+
+	// ErrTunnelGone is returned when the tunnel a request was sent to
+	// disconnects before responding
+	ErrTunnelGone = errors.New("tunnel went away")
+
+	// ErrBodyTooLarge is returned when a request body has to be sent whole
+	// and is larger than maxInlineBody
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// maxInlineBody is the largest request body sent whole, to clients that
+// predate streaming
+const maxInlineBody = 32 << 20
+
 // PendingRequest represents a pending HTTP request awaiting response
 type PendingRequest struct {
-	ResponseChan chan *protocol.HTTPResponseMessage
-	Timeout      *time.Timer
+	ResponseChan chan *Response
+	Body         *stream.Body // set once the response headers arrive, if the body is streamed
+
+	tunnel *tunnel.Connection // the tunnel the request was sent to
+	gone   chan struct{}      // closed if the tunnel disconnects first
+}
+
+// Response is an HTTP response from a tunnel. Body may still be streaming in
+// from the client and must be closed by the caller.
+type Response struct {
+	StatusCode int
+	Headers    map[string][]string
+	Body       io.ReadCloser
+}
+
+// Options configures optional Manager features
+type Options struct {
+	// TCP allocates public ports for TCP tunnels. TCP tunnels are refused when nil.
+	TCP *tcptunnel.Server
+
+	// Tokens authenticates registrations. Any client may register when nil.
+	Tokens auth.TokenStore
+
+	// ReconnectGrace is how long a disconnected tunnel's domain or port is
+	// held for the same client to reconnect
+	ReconnectGrace time.Duration
+
+	// BaseDomain is the domain HTTP tunnels registered without a domain get
+	// a subdomain of, such as "tunnel.example.com". Such registrations are
+	// refused when empty.
+	BaseDomain string
+
+	// RequestTimeout is how long to wait for a client to start responding,
+	// unless its tunnel asked for another timeout. DefaultRequestTimeout is
+	// used when zero.
+	RequestTimeout time.Duration
+
+	// MaxRequestTimeout caps the timeouts tunnels may ask for.
+	// DefaultMaxRequestTimeout is used when zero, and RequestTimeout when it
+	// is shorter than that.
+	MaxRequestTimeout time.Duration
+
+	// MinProtocolVersion is the oldest protocol version clients may speak,
+	// such as "1.1". Clients speaking an older version are refused with an
+	// upgrade hint. protocol.MinProtocolVersion is used when empty.
+	MinProtocolVersion string
+
+	// OIDC means the HTTP handler has an OIDC gate, so tunnels may ask for
+	// browsers to log in. Such tunnels are refused when false.
+	OIDC bool
 }
 
 // Manager handles WebSocket connections and message routing
 type Manager struct {
-	registry        *registry.Registry
-	pendingRequests sync.Map // map[requestID]*PendingRequest
+	registry          *registry.Registry
+	tcp               *tcptunnel.Server
+	tokens            auth.TokenStore
+	reconnectGrace    time.Duration
+	baseDomain        string
+	requestTimeout    time.Duration
+	maxRequestTimeout time.Duration
+	minVersion        protocol.Version
+	oidc              bool
+	resumeKey         []byte // signs the resume secrets handed to clients
+	reservedHosts     map[string]bool
+	pendingRequests   sync.Map // map[requestID]*PendingRequest
+	webSockets        sync.Map // map[streamID]*WebSocketStream
+	sendWindows       sync.Map // map[requestID or streamID]*stream.Window
 }
 
 // New creates a new WebSocket manager
-func New(reg *registry.Registry) *Manager {
-	return &Manager{
-		registry: reg,
+func New(reg *registry.Registry, opts Options) *Manager {
+	m := &Manager{
+		registry:          reg,
+		tcp:               opts.TCP,
+		tokens:            opts.Tokens,
+		reconnectGrace:    opts.ReconnectGrace,
+		baseDomain:        strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(opts.BaseDomain, "."), "*.")),
+		requestTimeout:    opts.RequestTimeout,
+		maxRequestTimeout: opts.MaxRequestTimeout,
+		minVersion:        minProtocolVersion(opts.MinProtocolVersion),
+		oidc:              opts.OIDC,
+		resumeKey:         make([]byte, 32),
+		reservedHosts:     make(map[string]bool),
+	}
+	rand.Read(m.resumeKey)
+
+	if m.requestTimeout <= 0 {
+		m.requestTimeout = DefaultRequestTimeout
+	}
+	if m.maxRequestTimeout <= 0 {
+		m.maxRequestTimeout = DefaultMaxRequestTimeout
 	}
+	if m.maxRequestTimeout < m.requestTimeout {
+		m.maxRequestTimeout = m.requestTimeout
+	}
+	return m
+}
+
+// session tracks the tunnels a client registered over one control
+// connection. It is only used from the connection's read loop.
+type session struct {
+	conn *tunnel.Session
+
+	// host is the host the client used to reach the control plane, which is
+	// also the public host of its TCP tunnels
+	host string
+
+	tunnels   []*tunnel.Connection
+	listeners []*tcptunnel.Listener
 }
 
 // HandleWebSocket handles incoming WebSocket connections
@@ -50,9 +186,15 @@ func (m *Manager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("New WebSocket connection from %s", r.RemoteAddr)
 
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	sess := &session{conn: tunnel.NewSession(conn, r.RemoteAddr), host: host}
+
 	// Read the first message (should be registration)
-	var msg protocol.Message
-	if err := conn.ReadJSON(&msg); err != nil {
+	msg, err := sess.conn.ReadMessage()
+	if err != nil {
 		logger.Error("Failed to read registration message: %v", err)
 		conn.Close()
 		return
@@ -60,85 +202,276 @@ func (m *Manager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	if msg.Type != protocol.TypeRegister {
 		logger.Error("Expected register message, got: %s", msg.Type)
-		m.sendError(conn, "INVALID_MESSAGE", "Expected registration message")
+		m.sendError(sess.conn, protocol.ErrCodeInvalidMessage, "Expected registration message")
 		conn.Close()
 		return
 	}
 
-	registerMsg, err := protocol.DecodeRegister(&msg)
-	if err != nil {
-		logger.Error("Failed to decode register message: %v", err)
-		m.sendError(conn, "DECODE_ERROR", err.Error())
+	if !m.handleRegister(sess, msg) {
 		conn.Close()
 		return
 	}
 
-	// Generate tunnel ID
+	// Start listening for messages from the client
+	err = m.handleConnection(sess)
+	logger.Info("Client disconnected: remote=%s, tunnels=%d, error=%v",
+		r.RemoteAddr, len(sess.tunnels)+len(sess.listeners), err)
+
+	// Clean up on disconnect, holding the domains and ports in case the
+	// client reconnects. A client the server disconnected is not coming back.
+	grace := m.graceAfter(err)
+	if sess.conn.Closed() {
+		grace = 0
+	}
+	for _, tunnelConn := range sess.tunnels {
+		if tunnelConn.Removed() {
+			continue // already closed on its own by removeTunnel
+		}
+		m.registry.Release(tunnelConn.Domain(), tunnelConn, grace)
+		m.failPendingRequests(tunnelConn)
+		m.closeWebSockets(tunnelConn)
+	}
+	for _, listener := range sess.listeners {
+		listener.Release(grace)
+	}
+	conn.Close()
+}
+
+// handleRegister registers one tunnel on a session and reports whether it
+// succeeded. Failures are reported to the client.
+func (m *Manager) handleRegister(sess *session, msg *protocol.Message) bool {
+	registerMsg, err := protocol.DecodeRegister(msg)
+	if err != nil {
+		logger.Error("Failed to decode register message: %v", err)
+		m.sendError(sess.conn, protocol.ErrCodeDecodeError, err.Error())
+		return false
+	}
+
+	version, err := m.negotiateVersion(registerMsg.ProtocolVersion)
+	if err != nil {
+		logger.Warn("Rejected registration from %s: %v", sess.conn.RemoteAddr(), err)
+		m.sendError(sess.conn, protocol.ErrCodeUnsupportedVersion, err.Error())
+		return false
+	}
+	registerMsg.ProtocolVersion = version
+
+	if registerMsg.Protocol == "" || registerMsg.Protocol == protocol.ProtocolHTTP {
+		domain, err := m.resolveDomain(registerMsg)
+		if err != nil {
+			logger.Error("Rejected registration: %v", err)
+			m.sendError(sess.conn, protocol.ErrCodeInvalidDomain, err.Error())
+			return false
+		}
+		if m.reservedHosts[domain] || domain == strings.ToLower(sess.host) {
+			logger.Error("Rejected registration: %s is the server's own host", domain)
+			m.sendError(sess.conn, protocol.ErrCodeInvalidDomain, fmt.Sprintf("Domain %s is reserved for the server", domain))
+			return false
+		}
+		registerMsg.Domain = domain
+	}
+
+	if !m.authorize(sess.conn, registerMsg) {
+		return false
+	}
+
+	// Generate tunnel ID, or resume the one the client had before it
+	// dropped if it proves the ID is its own
 	tunnelID := generateTunnelID()
+	if m.canResume(registerMsg) {
+		tunnelID = registerMsg.ResumeTunnelID
+	}
 
-	// Create tunnel connection
-	tunnelConn := tunnel.NewConnection(registerMsg.Domain, tunnelID, conn)
+	var ok bool
+	switch registerMsg.Protocol {
+	case "", protocol.ProtocolHTTP:
+		ok = m.registerHTTPTunnel(sess, registerMsg, tunnelID)
+	case protocol.ProtocolTCP:
+		ok = m.registerTCPTunnel(sess, registerMsg, tunnelID)
+	default:
+		logger.Error("Unsupported tunnel protocol: %s", registerMsg.Protocol)
+		m.sendError(sess.conn, protocol.ErrCodeUnsupportedProtocol, fmt.Sprintf("Unsupported tunnel protocol: %s", registerMsg.Protocol))
+		return false
+	}
+
+	// The client switches to the agreed version when it reads the registered
+	// message, so the server does too once it has sent it
+	if ok {
+		sess.conn.SetProtocolVersion(registerMsg.ProtocolVersion)
+	}
+	return ok
+}
+
+// registerHTTPTunnel registers a domain for an HTTP tunnel on a session
+func (m *Manager) registerHTTPTunnel(sess *session, registerMsg *protocol.RegisterMessage, tunnelID string) bool {
+	timeout, pathTimeouts, err := m.tunnelTimeouts(registerMsg)
+	if err != nil {
+		logger.Error("Rejected registration: %v", err)
+		m.sendError(sess.conn, protocol.ErrCodeInvalidMessage, err.Error())
+		return false
+	}
+	auth, err := tunnel.NewAuth(registerMsg.Auth)
+	if err != nil {
+		logger.Error("Rejected registration: %v", err)
+		m.sendError(sess.conn, protocol.ErrCodeInvalidMessage, err.Error())
+		return false
+	}
+	if auth.OIDC() != nil && !m.oidc {
+		logger.Error("Rejected registration: %s asked for OIDC login, which is not configured", registerMsg.Domain)
+		m.sendError(sess.conn, protocol.ErrCodeOIDCDisabled, "OIDC login is not enabled on this server")
+		return false
+	}
+	var ipRules *tunnel.IPRules
+	if registerMsg.IPRules != nil {
+		if ipRules, err = tunnel.NewIPRules(registerMsg.IPRules.Allow, registerMsg.IPRules.Deny); err != nil {
+			logger.Error("Rejected registration: %v", err)
+			m.sendError(sess.conn, protocol.ErrCodeInvalidMessage, err.Error())
+			return false
+		}
+	}
 
-	// Register tunnel
-	if err := m.registry.Register(registerMsg.Domain, tunnelConn); err != nil {
+	// Create tunnel connection
+	tunnelConn := tunnel.NewConnection(registerMsg.Domain, tunnelID, sess.conn)
+	tunnelConn.SetTimeouts(timeout, pathTimeouts)
+	tunnelConn.SetAuth(auth)
+	tunnelConn.SetIPRules(ipRules)
+
+	// Register tunnel, joining the domain's group if the client asked to
+	// share it. The registry checks that it protects the domain like the
+	// rest of the group.
+	if registerMsg.LoadBalance != "" {
+		if !registry.ValidStrategy(registerMsg.LoadBalance) {
+			logger.Error("Unknown load balancing strategy: %s", registerMsg.LoadBalance)
+			m.sendError(sess.conn, protocol.ErrCodeInvalidMessage, fmt.Sprintf("Unknown load balancing strategy: %s", registerMsg.LoadBalance))
+			return false
+		}
+		err = m.registry.RegisterMember(registerMsg.Domain, tunnelConn, registerMsg.LoadBalance, registerMsg.Weight,
+			groupPolicy{auth: auth, ipRules: ipRules})
+	} else {
+		err = m.registry.Register(registerMsg.Domain, tunnelConn)
+	}
+	if err != nil {
 		logger.Error("Failed to register tunnel: %v", err)
-		m.sendError(conn, "REGISTRATION_FAILED", err.Error())
-		conn.Close()
-		return
+		code := protocol.ErrCodeRegistrationFailed
+		if errors.Is(err, registry.ErrDomainBlocked) {
+			code = protocol.ErrCodeForbidden
+		}
+		m.sendError(sess.conn, code, err.Error())
+		return false
 	}
 
 	// Send registration confirmation
 	registeredMsg, err := protocol.EncodeMessage(protocol.TypeRegistered, &protocol.RegisteredMessage{
-		TunnelID:  tunnelID,
-		ServerURL: fmt.Sprintf("https://%s", registerMsg.Domain),
+		TunnelID:        tunnelID,
+		ResumeSecret:    m.resumeSecret(tunnelID),
+		ServerURL:       fmt.Sprintf("https://%s", registerMsg.Domain),
+		Domain:          registerMsg.Domain,
+		ProtocolVersion: registerMsg.ProtocolVersion,
+		Capabilities:    m.capabilities(registerMsg.ProtocolVersion),
 	})
 	if err != nil {
 		logger.Error("Failed to encode registered message: %v", err)
-		m.registry.Unregister(registerMsg.Domain)
-		conn.Close()
-		return
+		m.registry.Release(registerMsg.Domain, tunnelConn, 0)
+		return false
 	}
 
-	if err := conn.WriteJSON(registeredMsg); err != nil {
+	if err := sess.conn.SendMessage(registeredMsg); err != nil {
 		logger.Error("Failed to send registered message: %v", err)
-		m.registry.Unregister(registerMsg.Domain)
-		conn.Close()
-		return
+		m.registry.Release(registerMsg.Domain, tunnelConn, 0)
+		return false
 	}
 
+	sess.tunnels = append(sess.tunnels, tunnelConn)
 	logger.Info("Tunnel registered successfully: domain=%s, tunnel_id=%s", registerMsg.Domain, tunnelID)
+	return true
+}
 
-	// Start listening for messages from the client
-	m.handleConnection(tunnelConn)
+// authorize checks the registration token, if the server requires one, and
+// reports the failure to the client
+func (m *Manager) authorize(conn *tunnel.Session, registerMsg *protocol.RegisterMessage) bool {
+	if m.tokens == nil {
+		return true
+	}
 
-	// Clean up on disconnect
-	m.registry.Unregister(registerMsg.Domain)
-	conn.Close()
+	token, err := m.tokens.Authenticate(registerMsg.Token)
+	if err != nil {
+		logger.Warn("Rejected registration for %q: %v", registerMsg.Domain, err)
+		m.sendError(conn, protocol.ErrCodeUnauthorized, err.Error())
+		return false
+	}
+
+	tunnelProtocol := registerMsg.Protocol
+	if tunnelProtocol == "" {
+		tunnelProtocol = protocol.ProtocolHTTP
+	}
+	if err := token.Authorize(tunnelProtocol, registerMsg.Domain); err != nil {
+		logger.Warn("Rejected registration for %q: %v", registerMsg.Domain, err)
+		m.sendError(conn, protocol.ErrCodeForbidden, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// graceAfter returns how long to hold a tunnel's domain after its connection
+// ended with err. A client that closed cleanly is not coming back.
+func (m *Manager) graceAfter(err error) time.Duration {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseNormalClosure {
+		return 0
+	}
+	return m.reconnectGrace
 }
 
-// handleConnection handles messages from a tunnel connection
-func (m *Manager) handleConnection(tunnelConn *tunnel.Connection) {
+// handleConnection handles messages from a client's control connection until
+// it fails, and returns the error that ended it. Further register messages
+// add tunnels to the session.
+func (m *Manager) handleConnection(sess *session) error {
 	for {
-		msg, err := tunnelConn.ReadMessage()
+		sess.conn.Conn().SetReadDeadline(time.Now().Add(readTimeout))
+
+		msg, err := sess.conn.ReadMessage()
 		if err != nil {
-			logger.Info("Tunnel disconnected: domain=%s, tunnel_id=%s, error=%v",
-				tunnelConn.Domain(), tunnelConn.TunnelID(), err)
-			return
+			return err
 		}
 
 		switch msg.Type {
+		case protocol.TypeRegister:
+			m.handleRegister(sess, msg)
 		case protocol.TypeHTTPResponse:
-			m.handleHTTPResponse(msg)
+			m.handleHTTPResponse(sess, msg)
+		case protocol.TypeHTTPResponseBody:
+			m.handleHTTPResponseBody(sess, msg)
+		case protocol.TypeWebSocketOpened:
+			m.handleWebSocketOpened(msg)
+		case protocol.TypeWebSocketFrame:
+			m.handleWebSocketFrame(msg)
+		case protocol.TypeWebSocketClose:
+			m.handleWebSocketClose(msg)
+		case protocol.TypeStreamData, protocol.TypeStreamClose:
+			m.handleStreamMessage(sess, msg)
+		case protocol.TypeWindowUpdate:
+			m.handleWindowUpdate(sess, msg)
 		case protocol.TypePing:
-			m.handlePing(tunnelConn)
+			m.handlePing(sess.conn)
 		default:
 			logger.Warn("Unknown message type from client: %s", msg.Type)
 		}
 	}
 }
 
-// handleHTTPResponse handles HTTP response from client
-func (m *Manager) handleHTTPResponse(msg *protocol.Message) {
+// pendingRequest returns the pending request with the given ID if it was
+// sent to one of the session's tunnels. A client can only answer its own.
+func (m *Manager) pendingRequest(sess *session, requestID string) (*PendingRequest, bool) {
+	pending, ok := m.pendingRequests.Load(requestID)
+	if !ok || pending.(*PendingRequest).tunnel.Session() != sess.conn {
+		return nil, false
+	}
+	return pending.(*PendingRequest), true
+}
+
+// handleHTTPResponse handles HTTP response from client. Only the first
+// response to a request counts.
+func (m *Manager) handleHTTPResponse(sess *session, msg *protocol.Message) {
 	resp, err := protocol.DecodeHTTPResponse(msg)
 	if err != nil {
 		logger.Error("Failed to decode HTTP response: %v", err)
@@ -146,67 +479,379 @@ func (m *Manager) handleHTTPResponse(msg *protocol.Message) {
 	}
 
 	// Find the pending request
-	if pending, ok := m.pendingRequests.LoadAndDelete(resp.RequestID); ok {
-		pr := pending.(*PendingRequest)
-		pr.Timeout.Stop()
-		pr.ResponseChan <- resp
-		close(pr.ResponseChan)
-	} else {
+	pr, ok := m.pendingRequest(sess, resp.RequestID)
+	if !ok {
 		logger.Warn("Received response for unknown request ID: %s", resp.RequestID)
+		return
+	}
+	if pr.Body != nil {
+		// The headers were delivered and the body is streaming
+		logger.Warn("Dropping duplicate response for request %s", resp.RequestID)
+		return
+	}
+
+	response := &Response{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+	}
+
+	if resp.BodyStream {
+		// Keep the request pending until the last body chunk arrives
+		if pr.tunnel.FlowControl() {
+			pr.Body = stream.NewBodyWithCredit(func(chunks int) {
+				pr.tunnel.SendWindowUpdate(resp.RequestID, chunks)
+			})
+		} else {
+			pr.Body = stream.NewBody()
+		}
+		response.Body = pr.Body
+	} else {
+		m.pendingRequests.Delete(resp.RequestID)
+		response.Body = io.NopCloser(bytes.NewReader(resp.Body))
+	}
+
+	pr.ResponseChan <- response
+}
+
+// handleHTTPResponseBody handles a chunk of a streamed HTTP response body.
+// The client waits for credit while the public caller is slower than the
+// tunnel, which bounds the memory held per response. A client that outruns
+// the buffer anyway has its response cut short rather than stall the tunnel.
+func (m *Manager) handleHTTPResponseBody(sess *session, msg *protocol.Message) {
+	chunk, err := protocol.DecodeBodyChunk(msg)
+	if err != nil {
+		logger.Error("Failed to decode HTTP response body chunk: %v", err)
+		return
+	}
+
+	pending, ok := m.pendingRequest(sess, chunk.RequestID)
+	if !ok || pending.Body == nil {
+		logger.Debug("Dropping response body chunk for unknown request ID: %s", chunk.RequestID)
+		return
+	}
+	body := pending.Body
+
+	if len(chunk.Data) > 0 {
+		err := body.Push(chunk.Data)
+		if errors.Is(err, stream.ErrFull) {
+			logger.Warn("Resetting response body for request %s: the public caller is too slow", chunk.RequestID)
+			body.Finish(fmt.Errorf("response body reset: %w", err))
+			m.cancelRequest(pending.tunnel, chunk.RequestID, "response body overflowed")
+			return
+		}
+		if err != nil {
+			// The public caller went away, drop the rest of the body
+			logger.Debug("Discarding response body for request %s: %v", chunk.RequestID, err)
+			m.cancelRequest(pending.tunnel, chunk.RequestID, "caller stopped reading")
+			return
+		}
+	}
+
+	if chunk.EOF {
+		// The request is complete before the caller can see the end of it
+		m.pendingRequests.Delete(chunk.RequestID)
+		if chunk.Error != "" {
+			body.Finish(fmt.Errorf("client aborted response body: %s", chunk.Error))
+		} else {
+			body.Finish(nil)
+		}
+	}
+}
+
+// handleWindowUpdate gives the client's credit to the stream it is for
+func (m *Manager) handleWindowUpdate(sess *session, msg *protocol.Message) {
+	update, err := protocol.DecodeWindowUpdate(msg)
+	if err != nil {
+		logger.Error("Failed to decode window update: %v", err)
+		return
+	}
+
+	if value, ok := m.sendWindows.Load(update.StreamID); ok {
+		value.(*stream.Window).Grant(update.Chunks)
+		return
+	}
+	for _, listener := range sess.listeners {
+		if listener.HandleWindowUpdate(update) {
+			return
+		}
+	}
+}
+
+// cancelRequest stops waiting on a pending request and tells the client to
+// abandon it. It does nothing if the request already completed.
+func (m *Manager) cancelRequest(tc *tunnel.Connection, requestID, reason string) {
+	if _, ok := m.pendingRequests.LoadAndDelete(requestID); !ok {
+		return
+	}
+
+	logger.Debug("Canceling request %s: %s", requestID, reason)
+	if err := tc.SendCancel(requestID, reason); err != nil {
+		logger.Debug("Failed to send cancel for request %s: %v", requestID, err)
+	}
+}
+
+// failPendingRequests fails every request waiting on a tunnel connection that
+// has gone away or been closed, so callers get an error now rather than when
+// they time out. Responses that are still streaming are cut short.
+func (m *Manager) failPendingRequests(tunnelConn *tunnel.Connection) {
+	failed := 0
+	m.pendingRequests.Range(func(key, value interface{}) bool {
+		pr := value.(*PendingRequest)
+		if pr.tunnel != tunnelConn {
+			return true
+		}
+
+		m.pendingRequests.Delete(key)
+		if pr.Body != nil {
+			pr.Body.Finish(ErrTunnelGone)
+		}
+		close(pr.gone)
+		if tunnelConn.Removed() {
+			// The client is still connected and would answer it for nothing
+			if err := tunnelConn.SendCancel(key.(string), "tunnel closed"); err != nil {
+				logger.Debug("Failed to send cancel for request %s: %v", key, err)
+			}
+		}
+		failed++
+		return true
+	})
+
+	if failed > 0 {
+		logger.Info("Failed %d pending requests for disconnected tunnel: domain=%s, tunnel_id=%s", failed, tunnelConn.Domain(), tunnelConn.TunnelID())
 	}
 }
 
 // handlePing handles ping message
-func (m *Manager) handlePing(tunnelConn *tunnel.Connection) {
+func (m *Manager) handlePing(conn *tunnel.Session) {
 	pongMsg, _ := protocol.EncodeMessage(protocol.TypePong, nil)
-	if err := tunnelConn.SendMessage(pongMsg); err != nil {
+	if err := conn.SendMessage(pongMsg); err != nil {
 		logger.Error("Failed to send pong: %v", err)
 	}
 }
 
-// SendHTTPRequest sends an HTTP request to a tunnel and waits for response
-func (m *Manager) SendHTTPRequest(domain string, req *protocol.HTTPRequestMessage) (*protocol.HTTPResponseMessage, error) {
-	tunnelConn, ok := m.registry.GetTunnel(domain)
-	if !ok {
-		return nil, fmt.Errorf("no tunnel found for domain: %s", domain)
+// PendingRequests returns the number of HTTP requests waiting on a tunnel
+// client, including responses whose bodies are still streaming
+func (m *Manager) PendingRequests() int {
+	n := 0
+	m.pendingRequests.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// SendHTTPRequest sends an HTTP request to a tunnel and waits for the response
+// headers. If req.BodyStream is set, body is streamed to the client alongside,
+// so a local application may answer before it has read all of it, or sent
+// whole to a client that predates streaming. If ctx ends
+// before the response body has been read, the client is told to abandon the
+// request.
+func (m *Manager) SendHTTPRequest(ctx context.Context, domain string, req *protocol.HTTPRequestMessage, body io.Reader) (*Response, error) {
+	tc, err := m.pickTunnel(domain)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create pending request
-	responseChan := make(chan *protocol.HTTPResponseMessage, 1)
-	timeout := time.NewTimer(30 * time.Second)
+	if req.BodyStream && !protocol.Streaming(tc.Session().ProtocolVersion()) {
+		// The client would drop body chunks, so it gets the body whole
+		inline, err := io.ReadAll(io.LimitReader(body, maxInlineBody+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if len(inline) > maxInlineBody {
+			return nil, ErrBodyTooLarge
+		}
+		req.Body = inline
+		req.BodyStream = false
+	}
+
+	started := tc.StartRequest()
 
-	pr := &PendingRequest{
-		ResponseChan: responseChan,
-		Timeout:      timeout,
+	// Create pending request
+	pending := &PendingRequest{
+		ResponseChan: make(chan *Response, 1),
+		tunnel:       tc,
+		gone:         make(chan struct{}),
 	}
+	m.pendingRequests.Store(req.RequestID, pending)
 
-	m.pendingRequests.Store(req.RequestID, pr)
+	// Tell the client to stop if the caller goes away before the response
+	stopWatching := context.AfterFunc(ctx, func() {
+		m.cancelRequest(tc, req.RequestID, "caller went away")
+	})
 
-	// Send request to client
-	tc := tunnelConn.(*tunnel.Connection)
+	// Send request to client, telling it how long we will wait
+	timeout := m.requestTimeoutFor(tc, req.Path)
+	req.TunnelID = tc.TunnelID()
+	req.Timeout = timeout.Milliseconds()
 	if err := tc.SendHTTPRequest(req); err != nil {
+		stopWatching()
 		m.pendingRequests.Delete(req.RequestID)
-		timeout.Stop()
-		return nil, fmt.Errorf("failed to send request to tunnel: %w", err)
+		started()
+		return nil, fmt.Errorf("%w: failed to send request: %v", ErrTunnelGone, err)
 	}
 
-	// Wait for response or timeout
-	select {
-	case resp := <-responseChan:
-		return resp, nil
-	case <-timeout.C:
-		m.pendingRequests.Delete(req.RequestID)
-		return nil, fmt.Errorf("timeout waiting for response")
+	// Wait for response or timeout. The upload counts towards the timeout,
+	// or a caller that stalls it, or a client that never grants credit for
+	// it, would hold the request forever.
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Stream the body while waiting, so a response that comes first is not
+	// stuck behind it. The upload is stopped once the request is done with,
+	// since body must not be read after that.
+	done := started
+	var uploaded chan struct{}
+	var up *upload
+	if req.BodyStream {
+		up = m.uploadRequestBody(tc, req, body)
+		uploaded = up.finished
+		done = func() {
+			up.window.Close()
+			<-up.finished
+			started()
+		}
 	}
+
+	for {
+		select {
+		case <-uploaded:
+			uploaded = nil
+			if up.err != nil {
+				stopWatching()
+				m.cancelRequest(tc, req.RequestID, "request body failed")
+				done()
+				return nil, fmt.Errorf("failed to stream request body to tunnel: %w", up.err)
+			}
+		case resp := <-pending.ResponseChan:
+			if !stopWatching() {
+				// The caller went away just as the response arrived
+				resp.Body.Close()
+				done()
+				return nil, fmt.Errorf("request canceled: %w", ctx.Err())
+			}
+
+			// Keep watching the caller while the body streams. The request
+			// stays in flight until the caller is done with the body.
+			respBody := resp.Body
+			stopStreaming := context.AfterFunc(ctx, func() {
+				respBody.Close()
+				m.cancelRequest(tc, req.RequestID, "caller went away")
+			})
+			resp.Body = &responseBody{
+				ReadCloser: respBody,
+				finish: func() {
+					stopStreaming()
+					m.cancelRequest(tc, req.RequestID, "caller stopped reading")
+					done()
+				},
+			}
+			return resp, nil
+		case <-pending.gone:
+			stopWatching()
+			done()
+			return nil, ErrTunnelGone
+		case <-ctx.Done():
+			// The watcher has told the client
+			done()
+			return nil, fmt.Errorf("request canceled: %w", ctx.Err())
+		case <-timer.C:
+			stopWatching()
+			m.cancelRequest(tc, req.RequestID, "timed out")
+			done()
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// upload is a request body being streamed to a client
+type upload struct {
+	window   *stream.Window // nil if the client predates flow control
+	finished chan struct{}
+	err      error // set once finished is closed
+}
+
+// uploadRequestBody starts streaming body to the client for req. The body is
+// gzipped on its way through the tunnel if the client can take it and it isn't
+// compressed already. A failed send means the control connection is gone.
+func (m *Manager) uploadRequestBody(tc *tunnel.Connection, req *protocol.HTTPRequestMessage, body io.Reader) *upload {
+	up := &upload{finished: make(chan struct{})}
+	if tc.FlowControl() {
+		up.window = stream.NewWindow()
+		m.sendWindows.Store(req.RequestID, up.window)
+	}
+
+	compress := protocol.Compression(tc.Session().ProtocolVersion())
+	precompressed := !protocol.Compressible(req.Headers)
+	sendChunk := func(chunk *protocol.BodyChunkMessage) error {
+		if len(chunk.Data) > 0 {
+			if err := up.window.Acquire(); err != nil {
+				return err
+			}
+		}
+		chunk.Precompressed = precompressed
+		if compress && !precompressed {
+			protocol.CompressChunk(chunk)
+		}
+		if err := tc.SendRequestBodyChunk(chunk); err != nil {
+			return fmt.Errorf("%w: %v", ErrTunnelGone, err)
+		}
+		return nil
+	}
+
+	go func() {
+		defer close(up.finished)
+		_, up.err = stream.Copy(req.RequestID, body, sendChunk)
+		m.sendWindows.Delete(req.RequestID)
+	}()
+	return up
 }
 
-// sendError sends an error message to a connection
-func (m *Manager) sendError(conn *websocket.Conn, code, message string) {
+// responseBody is a response body handed to the caller. Closing it before the
+// client has sent all of the body tells the client to stop.
+type responseBody struct {
+	io.ReadCloser
+	finish func()
+}
+
+func (b *responseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// sendError sends an error message to a client. Errors are only sent when a
+// registration is refused, so they are counted as registration failures.
+func (m *Manager) sendError(conn *tunnel.Session, code, message string) {
+	metrics.RegistrationFailures.With(code).Inc()
+
 	errMsg, _ := protocol.EncodeMessage(protocol.TypeError, &protocol.ErrorMessage{
 		Code:    code,
 		Message: message,
 	})
-	conn.WriteJSON(errMsg)
+	conn.SendMessage(errMsg)
+}
+
+// isTunnelID reports whether id looks like an ID from generateTunnelID
+func isTunnelID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// resumeSecret returns the secret a client must present to resume a tunnel
+// ID. Tunnel IDs are shown to operators and in logs, so they are not enough
+// on their own.
+func (m *Manager) resumeSecret(tunnelID string) string {
+	mac := hmac.New(sha256.New, m.resumeKey)
+	mac.Write([]byte(tunnelID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canResume reports whether a registration may take back the tunnel ID it
+// asks to resume
+func (m *Manager) canResume(registerMsg *protocol.RegisterMessage) bool {
+	return isTunnelID(registerMsg.ResumeTunnelID) &&
+		hmac.Equal([]byte(registerMsg.ResumeSecret), []byte(m.resumeSecret(registerMsg.ResumeTunnelID)))
 }
 
 // generateTunnelID generates a random tunnel ID
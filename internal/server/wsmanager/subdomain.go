@@ -0,0 +1,95 @@
+package wsmanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+// randomSubdomainAttempts is how many random subdomains are tried before
+// giving up on finding a free one
+const randomSubdomainAttempts = 5
+
+// subdomainLabel matches a single DNS label
+var subdomainLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// resolveDomain returns the domain an HTTP tunnel registration is for. A
+// registration without a domain gets the subdomain it asked for under the
+// base domain, or a random free one.
+func (m *Manager) resolveDomain(registerMsg *protocol.RegisterMessage) (string, error) {
+	if registerMsg.Domain != "" {
+		domain := strings.ToLower(registerMsg.Domain)
+		if !validHostname(domain) {
+			return "", fmt.Errorf("invalid domain %q", registerMsg.Domain)
+		}
+		if domain == m.baseDomain {
+			// The apex belongs to the server, which hands out names under it
+			return "", fmt.Errorf("domain %s is the base domain, register a subdomain of it", domain)
+		}
+		return domain, nil
+	}
+
+	if m.baseDomain == "" {
+		return "", fmt.Errorf("a domain is required, this server does not assign subdomains")
+	}
+
+	if registerMsg.Subdomain != "" {
+		label := strings.ToLower(registerMsg.Subdomain)
+		if !subdomainLabel.MatchString(label) {
+			return "", fmt.Errorf("invalid subdomain %q", registerMsg.Subdomain)
+		}
+		return label + "." + m.baseDomain, nil
+	}
+
+	for i := 0; i < randomSubdomainAttempts; i++ {
+		domain := randomSubdomain() + "." + m.baseDomain
+		if _, taken := m.registry.GetTunnel(domain); !taken {
+			return domain, nil
+		}
+	}
+	return "", fmt.Errorf("no free subdomain found under %s", m.baseDomain)
+}
+
+// validHostname reports whether domain is a lowercase hostname made of
+// valid labels, without a port or trailing dot
+func validHostname(domain string) bool {
+	if len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !subdomainLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReserveHosts refuses registrations for hosts the server answers itself,
+// such as the OIDC redirect host. The host clients reach the control plane on
+// is always refused. It must be called before clients connect.
+func (m *Manager) ReserveHosts(hosts ...string) {
+	for _, host := range hosts {
+		m.reservedHosts[strings.ToLower(host)] = true
+	}
+}
+
+// InBaseDomain reports whether host is a subdomain the server assigns, one
+// label under the base domain
+func (m *Manager) InBaseDomain(host string) bool {
+	if m.baseDomain == "" {
+		return false
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+m.baseDomain)
+	return ok && subdomainLabel.MatchString(label)
+}
+
+// randomSubdomain generates a random subdomain label
+func randomSubdomain() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,86 @@
+package wsmanager
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// registerTCPTunnel allocates a public port for a TCP tunnel on a session and
+// starts accepting connections on it. The public host is the one the client
+// used to reach the control plane.
+func (m *Manager) registerTCPTunnel(sess *session, registerMsg *protocol.RegisterMessage, tunnelID string) bool {
+	if m.tcp == nil {
+		logger.Error("TCP tunnel requested but TCP tunnels are disabled")
+		m.sendError(sess.conn, protocol.ErrCodeTCPDisabled, "TCP tunnels are not enabled on this server")
+		return false
+	}
+
+	listener, err := m.tcp.Listen(tunnelID)
+	if err != nil {
+		logger.Error("Failed to allocate TCP port: %v", err)
+		m.sendError(sess.conn, protocol.ErrCodeRegistrationFailed, err.Error())
+		return false
+	}
+
+	publicAddr := net.JoinHostPort(sess.host, fmt.Sprintf("%d", listener.Port()))
+	tunnelConn := tunnel.NewConnection(publicAddr, tunnelID, sess.conn)
+
+	registeredMsg, err := protocol.EncodeMessage(protocol.TypeRegistered, &protocol.RegisteredMessage{
+		TunnelID:        tunnelID,
+		ResumeSecret:    m.resumeSecret(tunnelID),
+		ServerURL:       "tcp://" + publicAddr,
+		RemotePort:      listener.Port(),
+		ProtocolVersion: registerMsg.ProtocolVersion,
+		Capabilities:    m.capabilities(registerMsg.ProtocolVersion),
+	})
+	if err != nil {
+		logger.Error("Failed to encode registered message: %v", err)
+		listener.Close()
+		return false
+	}
+
+	if err := sess.conn.SendMessage(registeredMsg); err != nil {
+		logger.Error("Failed to send registered message: %v", err)
+		listener.Close()
+		return false
+	}
+
+	listener.Serve(tunnelConn)
+	sess.listeners = append(sess.listeners, listener)
+	logger.Info("TCP tunnel registered successfully: address=%s, tunnel_id=%s", publicAddr, tunnelID)
+	return true
+}
+
+// handleStreamMessage routes TCP stream messages to the listener that owns
+// the stream
+func (m *Manager) handleStreamMessage(sess *session, msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.TypeStreamData:
+		data, err := protocol.DecodeStreamData(msg)
+		if err != nil {
+			logger.Error("Failed to decode stream data: %v", err)
+			return
+		}
+		for _, listener := range sess.listeners {
+			if listener.HandleData(data) {
+				return
+			}
+		}
+		logger.Debug("Dropping stream data for unknown stream: %s", data.StreamID)
+	case protocol.TypeStreamClose:
+		closeMsg, err := protocol.DecodeStreamClose(msg)
+		if err != nil {
+			logger.Error("Failed to decode stream close: %v", err)
+			return
+		}
+		for _, listener := range sess.listeners {
+			if listener.HandleClose(closeMsg) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package wsmanager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+const (
+	// DefaultRequestTimeout is how long to wait for a client to start
+	// responding when neither the server nor the tunnel sets a timeout
+	DefaultRequestTimeout = 30 * time.Second
+
+	// DefaultMaxRequestTimeout is the longest timeout a tunnel may ask for
+	// when the server does not set a maximum
+	DefaultMaxRequestTimeout = 5 * time.Minute
+)
+
+// tunnelTimeouts validates the timeouts a registration asks for and caps
+// them at the server's maximum
+func (m *Manager) tunnelTimeouts(registerMsg *protocol.RegisterMessage) (time.Duration, []tunnel.PathTimeout, error) {
+	if registerMsg.Timeout < 0 {
+		return 0, nil, fmt.Errorf("invalid timeout: %dms", registerMsg.Timeout)
+	}
+	timeout := m.capTimeout(registerMsg.Domain, "", registerMsg.Timeout)
+
+	var paths []tunnel.PathTimeout
+	for _, pt := range registerMsg.PathTimeouts {
+		if !strings.HasPrefix(pt.Prefix, "/") {
+			return 0, nil, fmt.Errorf("invalid timeout path %q, must start with /", pt.Prefix)
+		}
+		if pt.Timeout <= 0 {
+			return 0, nil, fmt.Errorf("invalid timeout for %s: %dms", pt.Prefix, pt.Timeout)
+		}
+		paths = append(paths, tunnel.PathTimeout{
+			Prefix:  pt.Prefix,
+			Timeout: m.capTimeout(registerMsg.Domain, pt.Prefix, pt.Timeout),
+		})
+	}
+	return timeout, paths, nil
+}
+
+// capTimeout converts a requested timeout in milliseconds, logging when it
+// is longer than the server allows
+func (m *Manager) capTimeout(domain, prefix string, ms int64) time.Duration {
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout > m.maxRequestTimeout {
+		logger.Warn("Capping timeout for %s%s at %s, %s was requested", domain, prefix, m.maxRequestTimeout, timeout)
+		return m.maxRequestTimeout
+	}
+	return timeout
+}
+
+// requestTimeoutFor returns how long a request to a tunnel waits for the
+// response headers, or a WebSocket for the local application's handshake
+func (m *Manager) requestTimeoutFor(tc *tunnel.Connection, path string) time.Duration {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if timeout := tc.Timeout(path); timeout > 0 {
+		return timeout
+	}
+	return m.requestTimeout
+}
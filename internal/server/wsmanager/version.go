@@ -0,0 +1,92 @@
+package wsmanager
+
+import (
+	"fmt"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+)
+
+// minProtocolVersion parses the oldest protocol version the server accepts,
+// falling back to the oldest one it speaks when the setting is empty or
+// unusable
+func minProtocolVersion(setting string) protocol.Version {
+	oldest := protocol.MustParseVersion(protocol.MinProtocolVersion)
+	newest := protocol.MustParseVersion(protocol.ProtocolVersion)
+	if setting == "" {
+		return oldest
+	}
+
+	v, err := protocol.ParseVersion(setting)
+	if err != nil {
+		logger.Warn("Ignoring minimum protocol version: %v", err)
+		return oldest
+	}
+	if v.Less(oldest) {
+		return oldest
+	}
+	if newest.Less(v) {
+		logger.Warn("Minimum protocol version %s is newer than this server speaks, using %s", v, newest)
+		return newest
+	}
+	return v
+}
+
+// negotiateVersion picks the protocol version to speak with a client whose
+// newest version is requested: that version, or the server's newest if the
+// client is ahead within the same major version. The error explains which
+// side needs upgrading.
+func (m *Manager) negotiateVersion(requested string) (string, error) {
+	newest := protocol.MustParseVersion(protocol.ProtocolVersion)
+
+	v, err := protocol.ParseVersion(requested)
+	if err != nil {
+		return "", fmt.Errorf("%v, upgrade the ossgrok client", err)
+	}
+	if v.Major > newest.Major {
+		return "", fmt.Errorf("client speaks protocol %s but this server only speaks up to %s, upgrade the ossgrok server or use an older client", v, newest)
+	}
+	if v.Less(m.minVersion) {
+		return "", fmt.Errorf("client speaks protocol %s but this server requires %s or newer, upgrade the ossgrok client", v, m.minVersion)
+	}
+
+	if newest.Less(v) {
+		v = newest
+	}
+	return v.String(), nil
+}
+
+// capabilities lists the features the server offers a client speaking
+// version
+func (m *Manager) capabilities(version string) []string {
+	caps := []string{
+		protocol.CapabilityCancel,
+		protocol.CapabilityWebSocketProxy,
+		protocol.CapabilityMultiTunnel,
+		protocol.CapabilityLoadBalancing,
+		protocol.CapabilityAuth,
+		protocol.CapabilityIPRules,
+	}
+	if protocol.Streaming(version) {
+		caps = append(caps, protocol.CapabilityStreaming)
+	}
+	if protocol.BinaryFraming(version) {
+		caps = append(caps, protocol.CapabilityBinaryFraming)
+	}
+	if protocol.Compression(version) {
+		caps = append(caps, protocol.CapabilityCompression)
+	}
+	if protocol.FlowControl(version) {
+		caps = append(caps, protocol.CapabilityFlowControl)
+	}
+	if m.tcp != nil {
+		caps = append(caps, protocol.CapabilityTCP)
+	}
+	if m.baseDomain != "" {
+		caps = append(caps, protocol.CapabilitySubdomains)
+	}
+	if m.oidc {
+		caps = append(caps, protocol.CapabilityOIDC)
+	}
+	return caps
+}
@@ -0,0 +1,284 @@
+package wsmanager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+	"github.com/R44VC0RP/ossgrok/internal/server/tunnel"
+	"github.com/R44VC0RP/ossgrok/internal/stream"
+	"github.com/R44VC0RP/ossgrok/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// webSocketFrameBuffer is the number of frames buffered towards the public
+// caller. A flow controlled client never sends more than that ahead of it;
+// any other client that does has the WebSocket closed.
+const webSocketFrameBuffer = stream.DefaultDepth
+
+// UpgradeError is returned when the local application refuses a WebSocket upgrade
+type UpgradeError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *UpgradeError) Error() string {
+	return fmt.Sprintf("local application refused WebSocket upgrade: %s", e.Message)
+}
+
+// WebSocketStream is a WebSocket proxied through a tunnel to the local application
+type WebSocketStream struct {
+	id      string
+	manager *Manager
+	conn    *tunnel.Connection
+	release func() // marks the stream finished on the tunnel
+
+	opened chan *protocol.WebSocketOpenedMessage
+	frames chan *protocol.WebSocketFrameMessage
+	done   chan struct{}
+	once   sync.Once
+
+	// window is the credit for frames sent to the client, and taken counts
+	// the frames received since the client was last granted credit. Both
+	// are nil or unused if the client predates flow control.
+	window *stream.Window
+	taken  int
+
+	closeCode   int
+	closeReason string
+
+	// Subprotocol and Headers come from the local application's handshake
+	Subprotocol string
+	Headers     map[string][]string
+}
+
+// OpenWebSocket asks the client for a domain to dial a WebSocket on the local
+// application and waits for the result of the handshake
+func (m *Manager) OpenWebSocket(domain string, open *protocol.WebSocketOpenMessage) (*WebSocketStream, error) {
+	tc, err := m.pickTunnel(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &WebSocketStream{
+		id:      open.StreamID,
+		manager: m,
+		conn:    tc,
+		release: tc.StartRequest(),
+		opened:  make(chan *protocol.WebSocketOpenedMessage, 1),
+		frames:  make(chan *protocol.WebSocketFrameMessage, webSocketFrameBuffer),
+		done:    make(chan struct{}),
+	}
+	if tc.FlowControl() {
+		ws.window = stream.NewWindow()
+		m.sendWindows.Store(ws.id, ws.window)
+	}
+	m.webSockets.Store(ws.id, ws)
+
+	open.TunnelID = ws.conn.TunnelID()
+	msg, err := protocol.EncodeMessage(protocol.TypeWebSocketOpen, open)
+	if err != nil {
+		m.webSockets.Delete(ws.id)
+		m.sendWindows.Delete(ws.id)
+		ws.release()
+		return nil, fmt.Errorf("failed to encode WebSocket open: %w", err)
+	}
+	if err := ws.conn.SendMessage(msg); err != nil {
+		m.webSockets.Delete(ws.id)
+		m.sendWindows.Delete(ws.id)
+		ws.release()
+		return nil, fmt.Errorf("failed to send WebSocket open to tunnel: %w", err)
+	}
+
+	// The handshake is a request like any other, so it gets the same time
+	timeout := time.NewTimer(m.requestTimeoutFor(tc, open.Path))
+	defer timeout.Stop()
+
+	select {
+	case opened := <-ws.opened:
+		if opened.Error != "" {
+			m.webSockets.Delete(ws.id)
+			m.sendWindows.Delete(ws.id)
+			ws.release()
+			return nil, &UpgradeError{StatusCode: opened.StatusCode, Message: opened.Error}
+		}
+		ws.Subprotocol = opened.Subprotocol
+		ws.Headers = opened.Headers
+		return ws, nil
+	case <-ws.done:
+		return nil, &UpgradeError{Message: "tunnel closed during handshake"}
+	case <-timeout.C:
+		m.webSockets.Delete(ws.id)
+		m.sendWindows.Delete(ws.id)
+		ws.release()
+		return nil, ErrTimeout
+	}
+}
+
+// Recv returns the next frame from the local application. It returns false
+// once either side has closed the stream.
+func (ws *WebSocketStream) Recv() (*protocol.WebSocketFrameMessage, bool) {
+	select {
+	case frame := <-ws.frames:
+		ws.took()
+		return frame, true
+	case <-ws.done:
+		// Deliver frames that arrived before the close
+		select {
+		case frame := <-ws.frames:
+			return frame, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// took counts a frame taken off the queue and grants the client credit once
+// half the queue is free
+func (ws *WebSocketStream) took() {
+	if ws.window == nil {
+		return
+	}
+	ws.taken++
+	if ws.taken >= webSocketFrameBuffer/2 {
+		ws.conn.SendWindowUpdate(ws.id, ws.taken)
+		ws.taken = 0
+	}
+}
+
+// Send forwards a frame from the public caller to the local application,
+// waiting while the client has no room for it
+func (ws *WebSocketStream) Send(messageType int, data []byte) error {
+	if err := ws.window.Acquire(); err != nil {
+		return err
+	}
+	msg, err := protocol.EncodeMessage(protocol.TypeWebSocketFrame, &protocol.WebSocketFrameMessage{
+		StreamID:    ws.id,
+		MessageType: messageType,
+		Data:        data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode WebSocket frame: %w", err)
+	}
+	return ws.conn.SendMessage(msg)
+}
+
+// Close closes the stream from the public side and tells the client to close
+// its end
+func (ws *WebSocketStream) Close(code int, reason string) {
+	if !ws.finish(code, reason) {
+		return
+	}
+
+	msg, err := protocol.EncodeMessage(protocol.TypeWebSocketClose, &protocol.WebSocketCloseMessage{
+		StreamID: ws.id,
+		Code:     code,
+		Reason:   reason,
+	})
+	if err == nil {
+		if err := ws.conn.SendMessage(msg); err != nil {
+			logger.Debug("Failed to send WebSocket close for stream %s: %v", ws.id, err)
+		}
+	}
+}
+
+// CloseStatus returns the close code and reason once the stream has closed
+func (ws *WebSocketStream) CloseStatus() (int, string) {
+	<-ws.done
+	return ws.closeCode, ws.closeReason
+}
+
+// finish marks the stream closed. It reports whether this call closed it.
+func (ws *WebSocketStream) finish(code int, reason string) bool {
+	closed := false
+	ws.once.Do(func() {
+		ws.closeCode = code
+		ws.closeReason = reason
+		close(ws.done)
+		ws.manager.webSockets.Delete(ws.id)
+		ws.manager.sendWindows.Delete(ws.id)
+		ws.window.Close()
+		ws.release()
+		closed = true
+	})
+	return closed
+}
+
+// handleWebSocketOpened handles the result of a local WebSocket dial
+func (m *Manager) handleWebSocketOpened(msg *protocol.Message) {
+	opened, err := protocol.DecodeWebSocketOpened(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket opened message: %v", err)
+		return
+	}
+
+	if value, ok := m.webSockets.Load(opened.StreamID); ok {
+		select {
+		case value.(*WebSocketStream).opened <- opened:
+		default:
+		}
+	}
+}
+
+// handleWebSocketFrame forwards a frame from the local application to the
+// public caller. The client waits for credit while the public caller is slower
+// than the tunnel; a client that overflows the queue anyway has the WebSocket
+// closed rather than stall the tunnel.
+func (m *Manager) handleWebSocketFrame(msg *protocol.Message) {
+	frame, err := protocol.DecodeWebSocketFrame(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket frame: %v", err)
+		return
+	}
+
+	value, ok := m.webSockets.Load(frame.StreamID)
+	if !ok {
+		logger.Debug("Dropping WebSocket frame for unknown stream: %s", frame.StreamID)
+		return
+	}
+	ws := value.(*WebSocketStream)
+
+	select {
+	case <-ws.done:
+		return
+	default:
+	}
+
+	select {
+	case ws.frames <- frame:
+	default:
+		logger.Warn("Closing WebSocket stream %s: the public caller is too slow", ws.id)
+		ws.Close(websocket.CloseInternalServerErr, "message queue full")
+	}
+}
+
+// handleWebSocketClose handles the local application closing its WebSocket
+func (m *Manager) handleWebSocketClose(msg *protocol.Message) {
+	closeMsg, err := protocol.DecodeWebSocketClose(msg)
+	if err != nil {
+		logger.Error("Failed to decode WebSocket close: %v", err)
+		return
+	}
+
+	if value, ok := m.webSockets.Load(closeMsg.StreamID); ok {
+		value.(*WebSocketStream).finish(closeMsg.Code, closeMsg.Reason)
+	}
+}
+
+// closeWebSockets closes every proxied WebSocket carried by a tunnel
+// connection. The client is told too if it is still connected.
+func (m *Manager) closeWebSockets(tunnelConn *tunnel.Connection) {
+	m.webSockets.Range(func(key, value interface{}) bool {
+		ws := value.(*WebSocketStream)
+		if ws.conn != tunnelConn {
+			return true
+		}
+		if tunnelConn.Removed() {
+			ws.Close(websocket.CloseGoingAway, "tunnel closed")
+		} else {
+			ws.finish(websocket.CloseGoingAway, "tunnel closed")
+		}
+		return true
+	})
+}
@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+// DefaultDepth is the number of chunks a Body buffers, and so the credit a
+// sender starts each stream with
+const DefaultDepth = 16
+
+var (
+	// ErrClosed is returned by Push once the reading side has closed the
+	// body, and by Window.Acquire once the stream is over
+	ErrClosed = errors.New("stream: body closed")
+
+	// ErrFull is returned by Push when the sender has outrun the reader by
+	// more than the buffer holds
+	ErrFull = errors.New("stream: body buffer full")
+)
+
+// Body reassembles body chunk messages into an io.ReadCloser.
+//
+// The tunnel read loop pushes chunks in as they arrive and the consumer reads
+// them out. The buffer is bounded and Push never blocks, since one slow
+// consumer must not stall every other stream on the tunnel. Instead the
+// sender waits for credit, which the Body grants as the consumer makes room.
+// A sender that ignores it overflows the buffer and the stream is reset.
+type Body struct {
+	chunks   chan []byte
+	finished chan struct{}
+	closed   chan struct{}
+
+	finishOnce sync.Once
+	closeOnce  sync.Once
+	err        error
+
+	buf []byte
+
+	// grant, if set, is called with the chunks taken out of the buffer
+	// since it was last called
+	grant func(chunks int)
+	taken int
+}
+
+// NewBody creates a new streamed body for a sender that does not wait for
+// credit
+func NewBody() *Body {
+	return NewBodyWithCredit(nil)
+}
+
+// NewBodyWithCredit creates a new streamed body that calls grant as the
+// consumer makes room, so the sender's Window can be topped up. Grants are
+// batched to half the buffer.
+func NewBodyWithCredit(grant func(chunks int)) *Body {
+	return &Body{
+		chunks:   make(chan []byte, DefaultDepth),
+		finished: make(chan struct{}),
+		closed:   make(chan struct{}),
+		grant:    grant,
+	}
+}
+
+// Push queues a chunk for the reader. It fails with ErrFull rather than
+// block when the buffer is full.
+func (b *Body) Push(chunk []byte) error {
+	select {
+	case <-b.closed:
+		return ErrClosed
+	case <-b.finished:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case b.chunks <- chunk:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// Finish marks the end of the body. A nil error means the body ended
+// normally and readers see io.EOF once the buffered chunks are drained.
+func (b *Body) Finish(err error) {
+	b.finishOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		b.err = err
+		close(b.finished)
+	})
+}
+
+// Read implements io.Reader
+func (b *Body) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		select {
+		case chunk := <-b.chunks:
+			b.buf = chunk
+		case <-b.closed:
+			return 0, io.ErrClosedPipe
+		case <-b.finished:
+			// Drain anything queued before the body was finished
+			select {
+			case chunk := <-b.chunks:
+				b.buf = chunk
+			default:
+				return 0, b.err
+			}
+		}
+		b.took()
+	}
+
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// took counts a chunk taken out of the buffer and grants credit for it once
+// half the buffer is free
+func (b *Body) took() {
+	if b.grant == nil {
+		return
+	}
+	b.taken++
+	if b.taken >= DefaultDepth/2 {
+		b.grant(b.taken)
+		b.taken = 0
+	}
+}
+
+// Close releases the body. Pending and future pushes fail with ErrClosed.
+func (b *Body) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
+
+// Copy reads r in chunks of at most protocol.MaxBodyChunkSize bytes and hands
+// each one to send. The last chunk sent is always marked EOF, and carries the
+// read error if r failed. It returns the number of body bytes sent.
+func Copy(requestID string, r io.Reader, send func(*protocol.BodyChunkMessage) error) (int64, error) {
+	var written int64
+	buf := make([]byte, protocol.MaxBodyChunkSize)
+
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			// The send may hold on to the slice, so give it its own copy
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := send(&protocol.BodyChunkMessage{RequestID: requestID, Data: data}); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+
+		if readErr == io.EOF {
+			return written, send(&protocol.BodyChunkMessage{RequestID: requestID, EOF: true})
+		}
+		if readErr != nil {
+			send(&protocol.BodyChunkMessage{RequestID: requestID, EOF: true, Error: readErr.Error()})
+			return written, readErr
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"io"
+	"net"
+
+	"github.com/R44VC0RP/ossgrok/internal/protocol"
+)
+
+// Relay copies bytes between conn and a tunnel stream until both directions
+// are finished.
+//
+// Bytes read from conn are handed to send; when conn reaches EOF or fails,
+// sendClose is called with the read error (nil on a clean EOF). Bytes pushed
+// into inbound are written to conn, and when inbound finishes the write side
+// of conn is shut down so the peer sees EOF without losing its own direction.
+func Relay(conn net.Conn, inbound *Body, send func(data []byte) error, sendClose func(err error)) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(conn, inbound); err != nil {
+			conn.Close()
+			return
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+
+	buf := make([]byte, protocol.MaxBodyChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if sendErr := send(data); sendErr != nil {
+				conn.Close()
+				inbound.Close()
+				break
+			}
+		}
+		if err == io.EOF {
+			sendClose(nil)
+			break
+		}
+		if err != nil {
+			sendClose(err)
+			break
+		}
+	}
+
+	<-done
+	conn.Close()
+	inbound.Close()
+}
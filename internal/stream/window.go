@@ -0,0 +1,74 @@
+package stream
+
+import "sync"
+
+// Window is the sending side of a stream's flow control. It counts the chunks
+// the sender may still send before the receiver has made room for them.
+//
+// A nil Window never runs out, for peers that predate flow control.
+type Window struct {
+	mu     sync.Mutex
+	credit int
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewWindow creates a window with the credit of an empty Body
+func NewWindow() *Window {
+	return &Window{
+		credit: DefaultDepth,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Acquire takes one chunk of credit, blocking until the receiver grants some
+// or the window is closed
+func (w *Window) Acquire() error {
+	if w == nil {
+		return nil
+	}
+
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.wake:
+		case <-w.closed:
+			return ErrClosed
+		}
+	}
+}
+
+// Grant adds credit for chunks the receiver has taken out of its buffer
+func (w *Window) Grant(chunks int) {
+	if w == nil || chunks <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	w.credit += chunks
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close fails pending and future calls to Acquire, once the stream is over
+func (w *Window) Close() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		close(w.closed)
+	})
+}